@@ -9,10 +9,17 @@ package websocket
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"net"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/cloudwego/hertz/pkg/app/client"
+	"github.com/cloudwego/hertz/pkg/common/config"
+	errs "github.com/cloudwego/hertz/pkg/common/errors"
 	"github.com/cloudwego/hertz/pkg/protocol"
 )
 
@@ -23,6 +30,12 @@ var ErrBadHandshake = errors.New("websocket: bad handshake")
 // ClientUpgrader is a helper for upgrading hertz http response to websocket conn.
 // See ExampleClient for usage
 type ClientUpgrader struct {
+	// HandshakeTimeout specifies the duration for the handshake to complete,
+	// including dialing, writing the request and reading the response. It is
+	// applied to the request by PrepareRequest, which also records the
+	// deadline checked by UpgradeResponse. Zero means no timeout.
+	HandshakeTimeout time.Duration
+
 	// ReadBufferSize and WriteBufferSize specify I/O buffer sizes in bytes. If a buffer
 	// size is zero, then buffers allocated by the HTTP server are used. The
 	// I/O buffer sizes do not limit the size of the messages that can be sent
@@ -40,11 +53,117 @@ type ClientUpgrader struct {
 	// WriteBufferSize.
 	WriteBufferPool BufferPool
 
-	// EnableCompression specify if the server should attempt to negotiate per
+	// Subprotocols specifies the client's requested subprotocols in order of
+	// preference. The server's choice is validated against the protocols
+	// offered in the request and is available from Conn.Subprotocol.
+	Subprotocols []string
+
+	// EnableCompression specify if the client should attempt to negotiate per
 	// message compression (RFC 7692). Setting this value to true does not
-	// guarantee that compression will be supported. Currently only "no context
-	// takeover" modes are supported.
+	// guarantee that compression will be supported.
 	EnableCompression bool
+
+	// ServerContextTakeover specifies if the server may reuse its compression
+	// context across messages. If false, the client requests
+	// "server_no_context_takeover".
+	ServerContextTakeover bool
+
+	// ClientContextTakeover specifies if the client reuses its compression
+	// context across messages. If false, the client offers
+	// "client_no_context_takeover".
+	ClientContextTakeover bool
+
+	// ServerMaxWindowBits requests the server to compress with an LZ77 sliding
+	// window of at most 2^ServerMaxWindowBits bytes, which bounds the memory
+	// the client needs for ServerContextTakeover. Valid values are 8 to 15.
+	// Zero means no limit.
+	ServerMaxWindowBits int
+
+	// Extensions specifies the extensions the client offers in addition to
+	// permessage-deflate, in order of preference.
+	Extensions []Extension
+
+	// Codecs maps subprotocols to the codec used by Conn.WriteValue and
+	// Conn.ReadValue. The codec of the negotiated subprotocol, or of the
+	// empty string if no subprotocol is negotiated, is set on the connection.
+	// Subprotocols must still list the subprotocols offered to the server.
+	Codecs map[string]Codec
+
+	// Keepalive specifies the pings sent to detect an unresponsive server.
+	// The zero value disables keepalive.
+	Keepalive KeepaliveConfig
+
+	// ValidateUTF8 specifies if text messages received from the server are
+	// checked for valid UTF-8 while they are read, after decompression. On
+	// invalid text, the read methods return ErrInvalidUTF8 and the connection
+	// is failed with CloseInvalidFramePayloadData.
+	ValidateUTF8 bool
+
+	// ValidateWriteUTF8 specifies if text messages written to the server are
+	// checked for valid UTF-8. Writing invalid text returns ErrInvalidUTF8.
+	ValidateWriteUTF8 bool
+
+	// Interceptors are called in order for every data message read from and
+	// written to the server. See Interceptor.
+	Interceptors []Interceptor
+}
+
+// compressionOffer returns the permessage-deflate offer sent to the server.
+func (p *ClientUpgrader) compressionOffer() string {
+	offer := "permessage-deflate"
+	if !p.ServerContextTakeover {
+		offer += "; server_no_context_takeover"
+	}
+	if !p.ClientContextTakeover {
+		offer += "; client_no_context_takeover"
+	}
+	if isValidWindowBits(p.ServerMaxWindowBits) {
+		offer += "; server_max_window_bits=" + strconv.Itoa(p.ServerMaxWindowBits)
+	}
+	return offer
+}
+
+// acceptCompression validates the permessage-deflate response from the
+// server against the offer as specified in RFC 7692, section 7.1.
+func (p *ClientUpgrader) acceptCompression(params map[string]string) (CompressionParams, error) {
+	cp := CompressionParams{
+		ClientNoContextTakeover: !p.ClientContextTakeover,
+		ServerMaxWindowBits:     defaultWindowBits,
+		ClientMaxWindowBits:     defaultWindowBits,
+	}
+	for k, v := range params {
+		switch k {
+		case "server_no_context_takeover":
+			if v != "" {
+				return cp, fmt.Errorf("%w: invalid %s parameter", ErrBadHandshake, k)
+			}
+			cp.ServerNoContextTakeover = true
+		case "client_no_context_takeover":
+			if v != "" {
+				return cp, fmt.Errorf("%w: invalid %s parameter", ErrBadHandshake, k)
+			}
+			cp.ClientNoContextTakeover = true
+		case "server_max_window_bits":
+			bits, ok := parseWindowBits(v)
+			if !ok || (isValidWindowBits(p.ServerMaxWindowBits) && bits > p.ServerMaxWindowBits) {
+				return cp, fmt.Errorf("%w: invalid %s parameter", ErrBadHandshake, k)
+			}
+			cp.ServerMaxWindowBits = bits
+		default:
+			// client_max_window_bits is never offered because compress/flate
+			// cannot compress with a window smaller than 32KB.
+			return cp, fmt.Errorf("%w: unexpected permessage-deflate parameter %s", ErrBadHandshake, k)
+		}
+	}
+	if p.EnableCompression && !p.ServerContextTakeover && !cp.ServerNoContextTakeover {
+		return cp, fmt.Errorf("%w: server_no_context_takeover not accepted", ErrBadHandshake)
+	}
+	if p.EnableCompression && isValidWindowBits(p.ServerMaxWindowBits) {
+		if _, ok := params["server_max_window_bits"]; !ok {
+			return cp, fmt.Errorf("%w: server_max_window_bits not accepted", ErrBadHandshake)
+		}
+	}
+	return cp, nil
 }
 
 // PrepareRequest prepares request for websocket
@@ -56,8 +175,23 @@ func (p *ClientUpgrader) PrepareRequest(req *protocol.Request) {
 	req.Header.Set("Connection", "Upgrade")
 	req.Header.Set("Sec-WebSocket-Version", "13")
 	req.Header.Set("Sec-WebSocket-Key", generateChallengeKey())
+	if len(p.Subprotocols) > 0 {
+		req.Header.Set("Sec-WebSocket-Protocol", strings.Join(p.Subprotocols, ", "))
+	}
+	if p.HandshakeTimeout > 0 {
+		deadline := time.Now().Add(p.HandshakeTimeout)
+		req.SetOptions(config.WithRequestTimeout(p.HandshakeTimeout),
+			config.WithTag(handshakeDeadlineTag, strconv.FormatInt(deadline.UnixNano(), 10)))
+	}
+	var offers []string
 	if p.EnableCompression {
-		req.Header.Set("Sec-WebSocket-Extensions", "permessage-deflate; server_no_context_takeover; client_no_context_takeover")
+		offers = append(offers, p.compressionOffer())
+	}
+	for _, ext := range p.Extensions {
+		offers = append(offers, ext.Offer())
+	}
+	if len(offers) > 0 {
+		req.Header.Set("Sec-WebSocket-Extensions", strings.Join(offers, ", "))
 	}
 }
 
@@ -66,6 +200,12 @@ func (p *ClientUpgrader) PrepareRequest(req *protocol.Request) {
 // It returns Conn if success. ErrBadHandshake is returned if headers go wrong.
 // This method must be called after PrepareRequest and (*.Client).DoXXX
 func (p *ClientUpgrader) UpgradeResponse(req *protocol.Request, resp *protocol.Response) (*Conn, error) {
+	if p.HandshakeTimeout > 0 {
+		if deadline, ok := handshakeDeadline(req); ok && time.Now().After(deadline) {
+			return nil, &HandshakeTimeoutError{Duration: p.HandshakeTimeout}
+		}
+	}
+
 	if resp.StatusCode() != 101 ||
 		!tokenContainsValue(resp.Header.Get("Upgrade"), "websocket") ||
 		!tokenContainsValue(resp.Header.Get("Connection"), "Upgrade") ||
@@ -73,6 +213,20 @@ func (p *ClientUpgrader) UpgradeResponse(req *protocol.Request, resp *protocol.R
 		return nil, ErrBadHandshake
 	}
 
+	subprotocol, err := checkSubprotocol(req, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	// can not use p.EnableCompression, the application may offer
+	// permessage-deflate in the request header itself
+	extensions := append([]Extension{deflateExtension{client: p}}, p.Extensions...)
+	negotiated, err := confirmExtensions(req.Header.Peek("Sec-WebSocket-Extensions"),
+		resp.Header.Peek("Sec-WebSocket-Extensions"), extensions)
+	if err != nil {
+		return nil, err
+	}
+
 	c, err := resp.Hijack()
 	if err != nil {
 		return nil, fmt.Errorf("Hijack response connection err: %w", err)
@@ -80,19 +234,68 @@ func (p *ClientUpgrader) UpgradeResponse(req *protocol.Request, resp *protocol.R
 
 	c.SetDeadline(time.Time{})
 	conn := newConn(c, false, p.ReadBufferSize, p.WriteBufferSize, p.WriteBufferPool, nil, nil)
+	conn.subprotocol = subprotocol
+	if len(negotiated) > 0 {
+		conn.setExtensions(negotiated)
+	}
+	conn.resp = resp
+	conn.codec = p.Codecs[subprotocol]
+	conn.validateUTF8 = p.ValidateUTF8
+	conn.validateWriteUTF8 = p.ValidateWriteUTF8
+	conn.interceptors = p.Interceptors
+	conn.startKeepalive(p.Keepalive)
+	return conn, nil
+}
+
+// handshakeDeadlineTag is the request option tag holding the deadline of the
+// handshake, in Unix nanoseconds, recorded by PrepareRequest.
+const handshakeDeadlineTag = "websocket.handshake_deadline"
 
-	// can not use p.EnableCompression, always follow ext returned from server
-	compress := false
-	extensions := parseDataHeader(resp.Header.Peek("Sec-WebSocket-Extensions"))
-	for _, ext := range extensions {
-		if bytes.HasPrefix(ext, strPermessageDeflate) {
-			compress = true
+// handshakeDeadline returns the deadline PrepareRequest recorded on req.
+func handshakeDeadline(req *protocol.Request) (time.Time, bool) {
+	ns, err := strconv.ParseInt(req.Options().Tag(handshakeDeadlineTag), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ns), true
+}
+
+// checkSubprotocol returns the subprotocol selected by the server. The server
+// must select one of the protocols offered in the request, or none.
+func checkSubprotocol(req *protocol.Request, resp *protocol.Response) (string, error) {
+	selected := bytes.TrimSpace(resp.Header.Peek("Sec-WebSocket-Protocol"))
+	if len(selected) == 0 {
+		return "", nil
+	}
+	for _, offered := range parseDataHeader(req.Header.Peek("Sec-WebSocket-Protocol")) {
+		if bytes.Equal(offered, selected) {
+			return string(selected), nil
 		}
 	}
-	if compress {
-		conn.newCompressionWriter = compressNoContextTakeover
-		conn.newDecompressionReader = decompressNoContextTakeover
+	return "", fmt.Errorf("%w: server selected subprotocol %q that was not offered", ErrBadHandshake, selected)
+}
+
+// Handshake performs the opening handshake: it prepares req, sends it with c
+// and upgrades the response. The caller sets the request URI before calling
+// Handshake. If the handshake does not complete within HandshakeTimeout, the
+// returned error is a *HandshakeTimeoutError.
+func (p *ClientUpgrader) Handshake(ctx context.Context, c *client.Client, req *protocol.Request, resp *protocol.Response) (*Conn, error) {
+	p.PrepareRequest(req)
+	if err := c.Do(ctx, req, resp); err != nil {
+		if p.HandshakeTimeout > 0 && isTimeout(err) {
+			return nil, &HandshakeTimeoutError{Duration: p.HandshakeTimeout, Err: err}
+		}
+		return nil, err
 	}
-	conn.resp = resp
-	return conn, nil
+	return p.UpgradeResponse(req, resp)
+}
+
+// isTimeout reports whether err was caused by a timeout in the hertz client
+// or the network.
+func isTimeout(err error) bool {
+	if errors.Is(err, errs.ErrTimeout) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
 }
@@ -8,9 +8,13 @@
 package websocket
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
+	"testing"
 	"time"
 
 	"github.com/cloudwego/hertz/pkg/app"
@@ -20,13 +24,21 @@ import (
 	"github.com/cloudwego/hertz/pkg/protocol"
 )
 
-const (
-	testaddr = "localhost:10012"
-	testpath = "/echo"
-)
+const testpath = "/echo"
+
+// freeAddr returns a local address with a free port for a test server.
+func freeAddr() string {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		panic(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
 
 func ExampleClient() {
-	runServer(testaddr)
+	addr := freeAddr()
+	runServer(addr)
 	time.Sleep(50 * time.Millisecond) // await server running
 
 	c, err := client.NewClient(client.WithDialer(standard.NewDialer()))
@@ -35,7 +47,7 @@ func ExampleClient() {
 	}
 
 	req, resp := protocol.AcquireRequest(), protocol.AcquireResponse()
-	req.SetRequestURI("http://" + testaddr + testpath)
+	req.SetRequestURI("http://" + addr + testpath)
 	req.SetMethod("GET")
 
 	u := &ClientUpgrader{}
@@ -59,7 +71,10 @@ func ExampleClient() {
 }
 
 func runServer(addr string) {
-	upgrader := HertzUpgrader{} // use default options
+	runServerWithUpgrader(addr, &HertzUpgrader{}) // use default options
+}
+
+func runServerWithUpgrader(addr string, upgrader *HertzUpgrader) {
 	h := server.Default(server.WithHostPorts(addr))
 	// https://github.com/cloudwego/hertz/issues/121
 	h.NoHijackConnPool = true
@@ -90,3 +105,216 @@ func runServer(addr string) {
 		}
 	}()
 }
+
+func dialTestServer(addr string, u *ClientUpgrader) (*Conn, error) {
+	c, err := client.NewClient(client.WithDialer(standard.NewDialer()))
+	if err != nil {
+		return nil, err
+	}
+
+	req, resp := protocol.AcquireRequest(), protocol.AcquireResponse()
+	req.SetRequestURI("http://" + addr + testpath)
+	req.SetMethod("GET")
+
+	u.PrepareRequest(req)
+	if err := c.Do(context.Background(), req, resp); err != nil {
+		return nil, err
+	}
+	return u.UpgradeResponse(req, resp)
+}
+
+func TestClientCompressionContextTakeover(t *testing.T) {
+	addr := freeAddr()
+	runServerWithUpgrader(addr, &HertzUpgrader{
+		EnableCompression:     true,
+		ServerContextTakeover: true,
+		ClientContextTakeover: true,
+	})
+	time.Sleep(50 * time.Millisecond) // await server running
+
+	conn, err := dialTestServer(addr, &ClientUpgrader{
+		EnableCompression:     true,
+		ServerContextTakeover: true,
+		ClientContextTakeover: true,
+		ServerMaxWindowBits:   15,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	params, ok := conn.CompressionParams()
+	if !ok || params != (CompressionParams{false, false, 15, 15}) {
+		t.Fatalf("CompressionParams() = %+v, %v", params, ok)
+	}
+	for _, m := range textMessages(20) {
+		if err := conn.WriteMessage(TextMessage, m); err != nil {
+			t.Fatal(err)
+		}
+		_, p, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p, m) {
+			t.Fatalf("got %q, want %q", p, m)
+		}
+	}
+}
+
+var acceptCompressionTests = []struct {
+	upgrader ClientUpgrader
+	resp     string
+	params   CompressionParams
+	ok       bool
+}{
+	{
+		ClientUpgrader{EnableCompression: true},
+		"permessage-deflate; server_no_context_takeover; client_no_context_takeover",
+		CompressionParams{true, true, 15, 15}, true,
+	},
+	{
+		ClientUpgrader{EnableCompression: true},
+		"permessage-deflate",
+		CompressionParams{}, false,
+	},
+	{
+		ClientUpgrader{EnableCompression: true, ServerContextTakeover: true, ClientContextTakeover: true, ServerMaxWindowBits: 12},
+		"permessage-deflate; server_max_window_bits=10",
+		CompressionParams{false, false, 10, 15}, true,
+	},
+	{
+		ClientUpgrader{EnableCompression: true, ServerContextTakeover: true, ServerMaxWindowBits: 12},
+		"permessage-deflate; server_max_window_bits=13",
+		CompressionParams{}, false,
+	},
+	{
+		ClientUpgrader{EnableCompression: true, ServerContextTakeover: true, ServerMaxWindowBits: 12},
+		"permessage-deflate",
+		CompressionParams{}, false,
+	},
+	{
+		ClientUpgrader{EnableCompression: true, ServerContextTakeover: true},
+		"permessage-deflate; client_max_window_bits=10",
+		CompressionParams{}, false,
+	},
+}
+
+func TestAcceptCompression(t *testing.T) {
+	for _, tt := range acceptCompressionTests {
+		_, params, _ := parseExtension(tt.resp)
+		cp, err := tt.upgrader.acceptCompression(params)
+		if (err == nil) != tt.ok || (tt.ok && cp != tt.params) {
+			t.Errorf("acceptCompression(%q) = %+v, %v, want %+v, ok=%v", tt.resp, cp, err, tt.params, tt.ok)
+		}
+		if err != nil && !errors.Is(err, ErrBadHandshake) {
+			t.Errorf("acceptCompression(%q) returned %v, want ErrBadHandshake", tt.resp, err)
+		}
+	}
+}
+
+func TestClientHandshakeTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		// Accept connections but never respond to the handshake.
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	c, err := client.NewClient(client.WithDialer(standard.NewDialer()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, resp := protocol.AcquireRequest(), protocol.AcquireResponse()
+	req.SetRequestURI("http://" + ln.Addr().String() + testpath)
+	req.SetMethod("GET")
+
+	u := &ClientUpgrader{HandshakeTimeout: 50 * time.Millisecond}
+	start := time.Now()
+	_, err = u.Handshake(context.Background(), c, req, resp)
+	var te *HandshakeTimeoutError
+	if !errors.As(err, &te) {
+		t.Fatalf("Handshake() returned %v, want *HandshakeTimeoutError", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Handshake() took %v", d)
+	}
+}
+
+func TestUpgradeResponseDeadline(t *testing.T) {
+	u := &ClientUpgrader{HandshakeTimeout: time.Nanosecond}
+	req, resp := protocol.AcquireRequest(), protocol.AcquireResponse()
+	u.PrepareRequest(req)
+	if _, ok := handshakeDeadline(req); !ok {
+		t.Fatal("PrepareRequest did not record the handshake deadline")
+	}
+	time.Sleep(time.Millisecond)
+	resp.SetStatusCode(101)
+	_, err := u.UpgradeResponse(req, resp)
+	var te *HandshakeTimeoutError
+	if !errors.As(err, &te) {
+		t.Fatalf("UpgradeResponse() returned %v, want *HandshakeTimeoutError", err)
+	}
+}
+
+func TestClientSubprotocol(t *testing.T) {
+	addr := freeAddr()
+	runServerWithUpgrader(addr, &HertzUpgrader{Subprotocols: []string{"v2.json", "v1.json"}})
+	time.Sleep(50 * time.Millisecond) // await server running
+
+	for _, tt := range []struct {
+		offer []string
+		want  string
+	}{
+		{[]string{"v1.json", "v2.json"}, "v2.json"},
+		{[]string{"v1.json"}, "v1.json"},
+		{[]string{"v3.json"}, ""},
+		{nil, ""},
+	} {
+		conn, err := dialTestServer(addr, &ClientUpgrader{Subprotocols: tt.offer})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := conn.Subprotocol(); got != tt.want {
+			t.Errorf("offer %v: Subprotocol() = %q, want %q", tt.offer, got, tt.want)
+		}
+		conn.Close()
+	}
+}
+
+func TestCheckSubprotocol(t *testing.T) {
+	for _, tt := range []struct {
+		offer, selected string
+		want            string
+		ok              bool
+	}{
+		{"", "", "", true},
+		{"chat, superchat", "superchat", "superchat", true},
+		{"chat", "", "", true},
+		{"chat", "superchat", "", false},
+		{"", "chat", "", false},
+	} {
+		req, resp := protocol.AcquireRequest(), protocol.AcquireResponse()
+		if tt.offer != "" {
+			req.Header.Set("Sec-WebSocket-Protocol", tt.offer)
+		}
+		if tt.selected != "" {
+			resp.Header.Set("Sec-WebSocket-Protocol", tt.selected)
+		}
+		got, err := checkSubprotocol(req, resp)
+		if got != tt.want || (err == nil) != tt.ok {
+			t.Errorf("checkSubprotocol(%q, %q) = %q, %v", tt.offer, tt.selected, got, err)
+		}
+		if err != nil && !errors.Is(err, ErrBadHandshake) {
+			t.Errorf("checkSubprotocol(%q, %q) returned %v, want ErrBadHandshake", tt.offer, tt.selected, err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/bytedance/sonic"
+)
+
+// Codec converts between Go values and the messages written by WriteValue
+// and read by ReadValue. This package provides the JSON codecs; codecs for
+// other formats are in separate modules under codec/, such as
+// github.com/hertz-contrib/websocket/codec/msgpack, codec/cbor and
+// codec/protobuf.
+type Codec interface {
+	// MessageType returns the type of the messages written with the codec,
+	// TextMessage or BinaryMessage.
+	MessageType() int
+
+	// Marshal returns the encoding of v.
+	Marshal(v interface{}) ([]byte, error)
+
+	// Unmarshal decodes data and stores the result in the value pointed to
+	// by v.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec encodes values as JSON text messages with sonic.
+type JSONCodec struct {
+	// API is the sonic configuration used for encoding and decoding, for
+	// example sonic.ConfigStd. If nil, sonic.ConfigDefault is used.
+	API sonic.API
+}
+
+func (c JSONCodec) api() sonic.API {
+	if c.API == nil {
+		return sonic.ConfigDefault
+	}
+	return c.API
+}
+
+func (JSONCodec) MessageType() int { return TextMessage }
+
+func (c JSONCodec) Marshal(v interface{}) ([]byte, error) { return c.api().Marshal(v) }
+
+func (c JSONCodec) Unmarshal(data []byte, v interface{}) error { return c.api().Unmarshal(data, v) }
+
+// StdJSONCodec encodes values as JSON text messages with encoding/json.
+type StdJSONCodec struct{}
+
+func (StdJSONCodec) MessageType() int { return TextMessage }
+
+func (StdJSONCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+func (StdJSONCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// defaultCodec is the codec of connections without a codec.
+var defaultCodec Codec = JSONCodec{}
+
+// SetCodec sets the codec used by WriteValue and ReadValue. If codec is nil,
+// JSONCodec is used. SetCodec must not be called concurrently with the read
+// and write methods.
+func (c *Conn) SetCodec(codec Codec) {
+	c.codec = codec
+}
+
+// Codec returns the codec used by WriteValue and ReadValue.
+func (c *Conn) Codec() Codec {
+	if c.codec == nil {
+		return defaultCodec
+	}
+	return c.codec
+}
+
+// WriteValue writes the encoding of v as a message of the type given by the
+// connection's codec.
+func (c *Conn) WriteValue(v interface{}) error {
+	codec := c.Codec()
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(codec.MessageType(), data)
+}
+
+// ReadValue reads the next message from the connection and decodes it with
+// the connection's codec into the value pointed to by v.
+func (c *Conn) ReadValue(v interface{}) error {
+	_, p, err := c.ReadMessage()
+	if err != nil {
+		return err
+	}
+	return c.Codec().Unmarshal(p, v)
+}
+
+// WriteValueContext is like WriteValue, but aborts the write when ctx is done.
+// See WriteMessageContext for details about cancellation.
+func (c *Conn) WriteValueContext(ctx context.Context, v interface{}) error {
+	return c.writeContext(ctx, func() error {
+		return c.WriteValue(v)
+	})
+}
+
+// ReadValueContext is like ReadValue, but aborts the read when ctx is done.
+// See NextReaderContext for details about cancellation.
+func (c *Conn) ReadValueContext(ctx context.Context, v interface{}) error {
+	return c.readContext(ctx, func() error {
+		return c.ReadValue(v)
+	})
+}
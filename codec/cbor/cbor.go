@@ -0,0 +1,27 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+// Package cbor provides a websocket.Codec that encodes values as CBOR. It is
+// a separate module so that applications that do not use CBOR do not depend
+// on its implementation.
+package cbor
+
+import (
+	"github.com/fxamacker/cbor/v2"
+	"github.com/hertz-contrib/websocket"
+)
+
+// Codec encodes values as CBOR binary messages as specified in RFC 8949.
+type Codec struct{}
+
+var _ websocket.Codec = Codec{}
+
+func (Codec) MessageType() int { return websocket.BinaryMessage }
+
+func (Codec) Marshal(v interface{}) ([]byte, error) { return cbor.Marshal(v) }
+
+func (Codec) Unmarshal(data []byte, v interface{}) error { return cbor.Unmarshal(data, v) }
@@ -0,0 +1,10 @@
+module github.com/hertz-contrib/websocket/codec/cbor
+
+go 1.16
+
+require (
+	github.com/fxamacker/cbor/v2 v2.4.0
+	github.com/hertz-contrib/websocket v0.0.0-00010101000000-000000000000
+)
+
+replace github.com/hertz-contrib/websocket => ../..
@@ -0,0 +1,10 @@
+module github.com/hertz-contrib/websocket/codec/msgpack
+
+go 1.16
+
+require (
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	github.com/hertz-contrib/websocket v0.0.0-00010101000000-000000000000
+)
+
+replace github.com/hertz-contrib/websocket => ../..
@@ -0,0 +1,27 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+// Package msgpack provides a websocket.Codec that encodes values as
+// MessagePack. It is a separate module so that applications that do not use
+// MessagePack do not depend on its implementation.
+package msgpack
+
+import (
+	"github.com/hertz-contrib/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec encodes values as MessagePack binary messages.
+type Codec struct{}
+
+var _ websocket.Codec = Codec{}
+
+func (Codec) MessageType() int { return websocket.BinaryMessage }
+
+func (Codec) Marshal(v interface{}) ([]byte, error) { return msgpack.Marshal(v) }
+
+func (Codec) Unmarshal(data []byte, v interface{}) error { return msgpack.Unmarshal(data, v) }
@@ -0,0 +1,33 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package msgpack
+
+import (
+	"testing"
+
+	"github.com/hertz-contrib/websocket"
+)
+
+func TestCodec(t *testing.T) {
+	type value struct {
+		A int    `msgpack:"a"`
+		B string `msgpack:"b"`
+	}
+	if mt := (Codec{}).MessageType(); mt != websocket.BinaryMessage {
+		t.Errorf("MessageType() = %d, want %d", mt, websocket.BinaryMessage)
+	}
+	want := value{1, "hello"}
+	p, err := (Codec{}).Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got value
+	if err := (Codec{}).Unmarshal(p, &got); err != nil || got != want {
+		t.Errorf("Unmarshal() = %+v, %v, want %+v", got, err, want)
+	}
+}
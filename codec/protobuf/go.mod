@@ -0,0 +1,10 @@
+module github.com/hertz-contrib/websocket/codec/protobuf
+
+go 1.16
+
+require (
+	google.golang.org/protobuf v1.27.1
+	github.com/hertz-contrib/websocket v0.0.0-00010101000000-000000000000
+)
+
+replace github.com/hertz-contrib/websocket => ../..
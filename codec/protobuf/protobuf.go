@@ -0,0 +1,42 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+// Package protobuf provides a websocket.Codec that encodes values as
+// Protocol Buffers. It is a separate module so that applications that do not
+// use Protocol Buffers do not depend on its implementation.
+package protobuf
+
+import (
+	"fmt"
+
+	"github.com/hertz-contrib/websocket"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec encodes values as Protocol Buffers binary messages. The values must
+// implement proto.Message.
+type Codec struct{}
+
+var _ websocket.Codec = Codec{}
+
+func (Codec) MessageType() int { return websocket.BinaryMessage }
+
+func (Codec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("protobuf: %T does not implement proto.Message", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (Codec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("protobuf: %T does not implement proto.Message", v)
+	}
+	return proto.Unmarshal(data, m)
+}
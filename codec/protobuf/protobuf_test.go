@@ -0,0 +1,34 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package protobuf
+
+import (
+	"testing"
+
+	"github.com/hertz-contrib/websocket"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestCodec(t *testing.T) {
+	if mt := (Codec{}).MessageType(); mt != websocket.BinaryMessage {
+		t.Errorf("MessageType() = %d, want %d", mt, websocket.BinaryMessage)
+	}
+	p, err := (Codec{}).Marshal(wrapperspb.String("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &wrapperspb.StringValue{}
+	if err := (Codec{}).Unmarshal(p, got); err != nil || !proto.Equal(got, wrapperspb.String("hello")) {
+		t.Errorf("Unmarshal() = %v, %v", got, err)
+	}
+
+	if _, err := (Codec{}).Marshal(struct{}{}); err == nil {
+		t.Error("Marshal() accepted a value that is not a proto.Message")
+	}
+}
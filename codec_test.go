@@ -0,0 +1,109 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package websocket
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+type codecTestValue struct {
+	A int    `json:"a"`
+	B string `json:"b"`
+}
+
+// gobCodec is a binary codec for the tests.
+type gobCodec struct{}
+
+func (gobCodec) MessageType() int { return BinaryMessage }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func TestCodecs(t *testing.T) {
+	for _, tt := range []struct {
+		codec       Codec
+		messageType int
+	}{
+		{nil, TextMessage},
+		{JSONCodec{API: sonic.ConfigStd}, TextMessage},
+		{StdJSONCodec{}, TextMessage},
+		{gobCodec{}, BinaryMessage},
+	} {
+		var buf bytes.Buffer
+		wc := newTestConn(nil, &buf, true)
+		rc := newTestConn(&buf, nil, false)
+		wc.SetCodec(tt.codec)
+		rc.SetCodec(tt.codec)
+
+		want := codecTestValue{1, "hello"}
+		if err := wc.WriteValue(want); err != nil {
+			t.Fatalf("%T: WriteValue() returned %v", tt.codec, err)
+		}
+		data := append([]byte(nil), buf.Bytes()...)
+		var got codecTestValue
+		if err := rc.ReadValue(&got); err != nil {
+			t.Fatalf("%T: ReadValue() returned %v", tt.codec, err)
+		}
+		if got != want {
+			t.Errorf("%T: ReadValue() = %+v, want %+v", tt.codec, got, want)
+		}
+
+		mt, _, err := newTestConn(bytes.NewReader(data), nil, false).ReadMessage()
+		if err != nil || mt != tt.messageType {
+			t.Errorf("%T: message type = %d, %v, want %d", tt.codec, mt, err, tt.messageType)
+		}
+	}
+}
+
+func TestCodecSubprotocol(t *testing.T) {
+	addr := freeAddr()
+	codecs := map[string]Codec{
+		"v1.json": JSONCodec{},
+		"v1.gob":  gobCodec{},
+	}
+	runServerWithUpgrader(addr, &HertzUpgrader{
+		Subprotocols: []string{"v1.gob", "v1.json"},
+		Codecs:       codecs,
+	})
+	time.Sleep(50 * time.Millisecond) // await server running
+
+	for _, subprotocol := range []string{"v1.json", "v1.gob"} {
+		conn, err := dialTestServer(addr, &ClientUpgrader{
+			Subprotocols: []string{subprotocol},
+			Codecs:       codecs,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(conn.Codec(), codecs[subprotocol]) {
+			t.Errorf("%s: Codec() = %T", subprotocol, conn.Codec())
+		}
+		want := codecTestValue{2, subprotocol}
+		if err := conn.WriteValue(want); err != nil {
+			t.Fatal(err)
+		}
+		var got codecTestValue
+		if err := conn.ReadValue(&got); err != nil || got != want {
+			t.Errorf("%s: ReadValue() = %+v, %v, want %+v", subprotocol, got, err, want)
+		}
+		conn.Close()
+	}
+}
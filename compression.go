@@ -11,8 +11,10 @@ import (
 	"compress/flate"
 	"errors"
 	"io"
+	"io/ioutil"
 	"strings"
 	"sync"
+	"time"
 )
 
 const (
@@ -28,15 +30,149 @@ var (
 	}}
 )
 
-func decompressNoContextTakeover(r io.Reader) io.ReadCloser {
-	const tail =
-	// Add four bytes as specified in RFC
-	"\x00\x00\xff\xff" +
-		// Add final block to squelch unexpected EOF error from flate reader.
-		"\x01\x00\x00\xff\xff"
+const (
+	minWindowBits     = 8
+	maxWindowBits     = 15
+	defaultWindowBits = maxWindowBits
+)
+
+const flateTail =
+// Add four bytes as specified in RFC
+"\x00\x00\xff\xff" +
+	// Add final block to squelch unexpected EOF error from flate reader.
+	"\x01\x00\x00\xff\xff"
+
+// CompressionParams describes the permessage-deflate parameters negotiated
+// for a connection as defined in RFC 7692, section 7.1.
+type CompressionParams struct {
+	// ServerNoContextTakeover reports whether the server resets its
+	// compression context after every message.
+	ServerNoContextTakeover bool
+
+	// ClientNoContextTakeover reports whether the client resets its
+	// compression context after every message.
+	ClientNoContextTakeover bool
+
+	// ServerMaxWindowBits is the base-2 logarithm of the LZ77 sliding window
+	// size used by the server to compress messages.
+	ServerMaxWindowBits int
+
+	// ClientMaxWindowBits is the base-2 logarithm of the LZ77 sliding window
+	// size used by the client to compress messages.
+	ClientMaxWindowBits int
+}
+
+// parseWindowBits parses a max_window_bits extension parameter value. The
+// value must be a decimal integer in the range 8 to 15 without leading zeros.
+func parseWindowBits(v string) (int, bool) {
+	if len(v) == 0 || len(v) > 2 || v[0] == '0' {
+		return 0, false
+	}
+	n := 0
+	for i := 0; i < len(v); i++ {
+		if v[i] < '0' || v[i] > '9' {
+			return 0, false
+		}
+		n = n*10 + int(v[i]-'0')
+	}
+	if n < minWindowBits || n > maxWindowBits {
+		return 0, false
+	}
+	return n, true
+}
+
+func isValidWindowBits(bits int) bool {
+	return minWindowBits <= bits && bits <= maxWindowBits
+}
+
+// deflateExtension negotiates permessage-deflate with the compression
+// options of an upgrader.
+type deflateExtension struct {
+	server *HertzUpgrader
+	client *ClientUpgrader
+}
+
+func (e deflateExtension) Name() string {
+	return "permessage-deflate"
+}
+
+func (e deflateExtension) Offer() string {
+	return e.client.compressionOffer()
+}
+
+func (e deflateExtension) Accept(params map[string]string) (string, NegotiatedExtension, bool) {
+	cp, resp, ok := e.server.acceptDeflateOffer(params)
+	if !ok {
+		return "", nil, false
+	}
+	return resp, newPerMessageDeflate(cp, true), true
+}
+
+func (e deflateExtension) Confirm(params map[string]string) (NegotiatedExtension, error) {
+	cp, err := e.client.acceptCompression(params)
+	if err != nil {
+		return nil, err
+	}
+	return newPerMessageDeflate(cp, false), nil
+}
 
+// perMessageDeflate compresses the messages of a connection that negotiated
+// permessage-deflate.
+type perMessageDeflate struct {
+	c         *Conn // set by Conn.setExtensions
+	params    CompressionParams
+	newWriter func(io.WriteCloser, int) io.WriteCloser
+	newReader func(io.Reader) io.ReadCloser
+	writeCtx  *flateWriteContext // nil unless this endpoint uses context takeover
+}
+
+// newPerMessageDeflate configures the message compressors for the
+// negotiated permessage-deflate parameters.
+func newPerMessageDeflate(params CompressionParams, isServer bool) *perMessageDeflate {
+	d := &perMessageDeflate{params: params}
+
+	writeNoContextTakeover, readNoContextTakeover := params.ServerNoContextTakeover, params.ClientNoContextTakeover
+	readWindowBits := params.ClientMaxWindowBits
+	if !isServer {
+		writeNoContextTakeover, readNoContextTakeover = readNoContextTakeover, writeNoContextTakeover
+		readWindowBits = params.ServerMaxWindowBits
+	}
+	if !isValidWindowBits(readWindowBits) {
+		readWindowBits = defaultWindowBits
+	}
+
+	if writeNoContextTakeover {
+		d.newWriter = compressNoContextTakeover
+	} else {
+		d.writeCtx = &flateWriteContext{}
+		d.newWriter = d.writeCtx.newWriter
+	}
+	if readNoContextTakeover {
+		d.newReader = decompressNoContextTakeover
+	} else {
+		d.newReader = newFlateReadContext(readWindowBits).newReader
+	}
+	return d
+}
+
+func (d *perMessageDeflate) RSV() byte {
+	return RSV1
+}
+
+func (d *perMessageDeflate) NewReader(r io.Reader, rsv byte) io.ReadCloser {
+	return d.newReader(r)
+}
+
+func (d *perMessageDeflate) NewWriter(w io.WriteCloser, messageType int) (io.WriteCloser, byte) {
+	if !d.c.enableWriteCompression {
+		return w, 0
+	}
+	return d.newWriter(w, d.c.compressionLevel), RSV1
+}
+
+func decompressNoContextTakeover(r io.Reader) io.ReadCloser {
 	fr, _ := flateReaderPool.Get().(io.ReadCloser)
-	fr.(flate.Resetter).Reset(io.MultiReader(r, strings.NewReader(tail)), nil)
+	fr.(flate.Resetter).Reset(io.MultiReader(r, strings.NewReader(flateTail)), nil)
 	return &flateReadWrapper{fr}
 }
 
@@ -122,6 +258,44 @@ func (w *flateWriteWrapper) Close() error {
 	return err2
 }
 
+// minRatioCheckSize is the decompressed size of a message from which on the
+// compression ratio limit is enforced. Small messages are allowed to compress
+// well.
+const minRatioCheckSize = 64 << 10
+
+// decompressionLimitReader enforces the read limit and the compression ratio
+// limit on the decompressed size of a message. The ratio is taken against the
+// compressed bytes consumed so far, not the declared frame lengths, so that a
+// single large frame cannot hide a highly compressed prefix.
+type decompressionLimitReader struct {
+	c *Conn
+	r *extensionReader
+	n int64 // decompressed bytes read
+}
+
+func (r *decompressionLimitReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+
+	c := r.c
+	if (c.readLimit > 0 && r.n > c.readLimit) ||
+		(c.readRatio > 0 && r.n > minRatioCheckSize && r.n > c.readRatio*c.readConsumed) {
+		c.setReadErr(ErrReadLimit)
+		c.WriteControl(CloseMessage, FormatCloseMessage(CloseMessageTooBig, ""), time.Now().Add(writeWait))
+		return 0, ErrReadLimit
+	}
+	return n, err
+}
+
+func (r *decompressionLimitReader) Close() error {
+	if r.r.keepsContext() {
+		// The rest of the message is decompressed to keep the sliding window
+		// in sync; count it against the limits.
+		io.Copy(ioutil.Discard, r)
+	}
+	return r.r.Close()
+}
+
 type flateReadWrapper struct {
 	fr io.ReadCloser
 }
@@ -149,3 +323,132 @@ func (r *flateReadWrapper) Close() error {
 	r.fr = nil
 	return err
 }
+
+// flateWriteContext holds the compressor shared by all messages written to a
+// connection that negotiated context takeover. The compressor is flushed, not
+// reset, at the end of every message so that later messages can refer to
+// data in earlier ones.
+type flateWriteContext struct {
+	fw    *flate.Writer
+	tw    truncWriter
+	level int
+	reset bool // discard the sliding window before the next message
+}
+
+func (fc *flateWriteContext) newWriter(w io.WriteCloser, level int) io.WriteCloser {
+	fc.tw = truncWriter{w: w}
+	switch {
+	case fc.fw == nil || fc.level != level:
+		fc.fw, _ = flate.NewWriter(&fc.tw, level)
+		fc.level = level
+	case fc.reset:
+		fc.fw.Reset(&fc.tw)
+	}
+	fc.reset = false
+	return &flateContextWriteWrapper{fc: fc}
+}
+
+type flateContextWriteWrapper struct {
+	fc *flateWriteContext
+}
+
+func (w *flateContextWriteWrapper) Write(p []byte) (int, error) {
+	if w.fc == nil {
+		return 0, errWriteClosed
+	}
+	n, err := w.fc.fw.Write(p)
+	if err != nil {
+		w.fc.reset = true
+	}
+	return n, err
+}
+
+func (w *flateContextWriteWrapper) Close() error {
+	if w.fc == nil {
+		return errWriteClosed
+	}
+	fc := w.fc
+	w.fc = nil
+	err1 := fc.fw.Flush()
+	if err1 != nil {
+		fc.reset = true
+	}
+	if fc.tw.p != [4]byte{0, 0, 0xff, 0xff} {
+		fc.reset = true
+		return errors.New("websocket: internal error, unexpected bytes at end of flate stream")
+	}
+	err2 := fc.tw.w.Close()
+	if err1 != nil {
+		return err1
+	}
+	return err2
+}
+
+// flateReadContext keeps the sliding window of decompressed data for a
+// connection on which the peer uses context takeover. The window is supplied
+// as the preset dictionary when decompressing the next message.
+type flateReadContext struct {
+	window []byte
+	size   int
+}
+
+func newFlateReadContext(windowBits int) *flateReadContext {
+	size := 1 << uint(windowBits)
+	return &flateReadContext{window: make([]byte, 0, size), size: size}
+}
+
+// append adds p to the end of the sliding window, dropping the oldest bytes
+// when the window is full.
+func (fc *flateReadContext) append(p []byte) {
+	if len(p) >= fc.size {
+		fc.window = append(fc.window[:0], p[len(p)-fc.size:]...)
+		return
+	}
+	if over := len(fc.window) + len(p) - fc.size; over > 0 {
+		n := copy(fc.window, fc.window[over:])
+		fc.window = fc.window[:n]
+	}
+	fc.window = append(fc.window, p...)
+}
+
+func (fc *flateReadContext) newReader(r io.Reader) io.ReadCloser {
+	fr, _ := flateReaderPool.Get().(io.ReadCloser)
+	fr.(flate.Resetter).Reset(io.MultiReader(r, strings.NewReader(flateTail)), fc.window)
+	return &flateContextReadWrapper{fr: fr, fc: fc}
+}
+
+type flateContextReadWrapper struct {
+	fr io.ReadCloser
+	fc *flateReadContext
+}
+
+func (r *flateContextReadWrapper) Read(p []byte) (int, error) {
+	if r.fr == nil {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := r.fr.Read(p)
+	r.fc.append(p[:n])
+	if err == io.EOF {
+		r.release()
+	}
+	return n, err
+}
+
+// Close consumes the remainder of the message so that the sliding window
+// stays in sync with the peer's compressor.
+func (r *flateContextReadWrapper) Close() error {
+	if r.fr == nil {
+		return io.ErrClosedPipe
+	}
+	_, err := io.Copy(ioutil.Discard, r)
+	if r.fr != nil {
+		r.release()
+	}
+	return err
+}
+
+func (r *flateContextReadWrapper) release() {
+	r.fr.Close()
+	flateReaderPool.Put(r.fr)
+	r.fr = nil
+}
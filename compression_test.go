@@ -9,10 +9,14 @@ package websocket
 
 import (
 	"bytes"
+	"compress/flate"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"strings"
 	"testing"
+	"time"
 )
 
 type nopCloser struct{ io.Writer }
@@ -63,8 +67,7 @@ func BenchmarkWriteWithCompression(b *testing.B) {
 	w := ioutil.Discard
 	c := newTestConn(nil, w, false)
 	messages := textMessages(100)
-	c.enableWriteCompression = true
-	c.newCompressionWriter = compressNoContextTakeover
+	c.setCompression(CompressionParams{ServerNoContextTakeover: true, ClientNoContextTakeover: true})
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		c.WriteMessage(TextMessage, messages[i%len(messages)])
@@ -85,3 +88,322 @@ func TestValidCompressionLevel(t *testing.T) {
 		}
 	}
 }
+
+func TestParseWindowBits(t *testing.T) {
+	tests := []struct {
+		value string
+		bits  int
+		ok    bool
+	}{
+		{"8", 8, true},
+		{"15", 15, true},
+		{"", 0, false},
+		{"7", 0, false},
+		{"16", 0, false},
+		{"09", 0, false},
+		{"1a", 0, false},
+		{"100", 0, false},
+	}
+	for _, tt := range tests {
+		bits, ok := parseWindowBits(tt.value)
+		if bits != tt.bits || ok != tt.ok {
+			t.Errorf("parseWindowBits(%q) = %d, %v, want %d, %v", tt.value, bits, ok, tt.bits, tt.ok)
+		}
+	}
+}
+
+func TestFlateReadContextWindow(t *testing.T) {
+	fc := newFlateReadContext(minWindowBits)
+	fc.append([]byte("hello"))
+	fc.append(bytes.Repeat([]byte("a"), fc.size-8))
+	fc.append([]byte("world"))
+	if len(fc.window) != fc.size {
+		t.Fatalf("len(window) = %d, want %d", len(fc.window), fc.size)
+	}
+	if !bytes.HasPrefix(fc.window, []byte("llo")) || !bytes.HasSuffix(fc.window, []byte("world")) {
+		t.Fatalf("window = %q", fc.window)
+	}
+	fc.append(bytes.Repeat([]byte("b"), 2*fc.size))
+	if !bytes.Equal(fc.window, bytes.Repeat([]byte("b"), fc.size)) {
+		t.Fatalf("window not replaced by large write")
+	}
+}
+
+func TestContextTakeover(t *testing.T) {
+	messages := textMessages(100)
+	for _, isServer := range []bool{true, false} {
+		for _, params := range []CompressionParams{
+			{ServerNoContextTakeover: true, ClientNoContextTakeover: true, ServerMaxWindowBits: 15, ClientMaxWindowBits: 15},
+			{ServerMaxWindowBits: 15, ClientMaxWindowBits: 15},
+			{ServerMaxWindowBits: 15, ClientMaxWindowBits: 9},
+		} {
+			name := fmt.Sprintf("s:%v, p:%+v", isServer, params)
+			var connBuf bytes.Buffer
+			wc := newTestConn(nil, &connBuf, isServer)
+			rc := newTestConn(&connBuf, nil, !isServer)
+			wc.setCompression(params)
+			rc.setCompression(params)
+
+			for i, m := range messages {
+				if err := wc.WriteMessage(TextMessage, m); err != nil {
+					t.Fatalf("%s: WriteMessage() returned %v", name, err)
+				}
+				// Leave every third message partially read to check that the
+				// sliding window stays in sync.
+				if i%3 == 0 {
+					_, r, err := rc.NextReader()
+					if err != nil {
+						t.Fatalf("%s: NextReader() returned %v", name, err)
+					}
+					r.Read(make([]byte, 3))
+					continue
+				}
+				_, p, err := rc.ReadMessage()
+				if err != nil {
+					t.Fatalf("%s: ReadMessage() returned %v", name, err)
+				}
+				if !bytes.Equal(p, m) {
+					t.Fatalf("%s: message %d = %q, want %q", name, i, p, m)
+				}
+			}
+		}
+	}
+}
+
+func TestContextTakeoverPartialReadNextReader(t *testing.T) {
+	// A message larger than the buffers of the decompressor, so that closing
+	// the partially read message reads the rest from the connection.
+	var b bytes.Buffer
+	for i := 0; b.Len() < 1<<17; i++ {
+		fmt.Fprintf(&b, "%x ", i*7919)
+	}
+	large := b.Bytes()
+
+	var connBuf bytes.Buffer
+	wc := newTestConn(nil, &connBuf, true)
+	rc := newTestConn(&connBuf, nil, false)
+	wc.setCompression(CompressionParams{})
+	rc.setCompression(CompressionParams{})
+	wc.WriteMessage(TextMessage, large)
+	wc.WriteMessage(TextMessage, []byte("next"))
+
+	_, r, err := rc.NextReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Read(make([]byte, 10))
+
+	done := make(chan error, 1)
+	go func() {
+		_, p, err := rc.ReadMessage()
+		if err == nil && string(p) != "next" {
+			err = fmt.Errorf("read %q, want %q", p, "next")
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("NextReader() deadlocked closing the partially read message")
+	}
+}
+
+func TestContextTakeoverCompressionRatio(t *testing.T) {
+	messages := textMessages(100)
+	size := func(params CompressionParams) int {
+		var connBuf bytes.Buffer
+		wc := newTestConn(nil, &connBuf, true)
+		wc.setCompression(params)
+		wc.SetCompressionLevel(flate.BestCompression)
+		for _, m := range messages {
+			wc.WriteMessage(TextMessage, m)
+		}
+		return connBuf.Len()
+	}
+	noTakeover := size(CompressionParams{ServerNoContextTakeover: true, ClientNoContextTakeover: true})
+	takeover := size(CompressionParams{})
+	if takeover >= noTakeover {
+		t.Fatalf("context takeover wrote %d bytes, no context takeover wrote %d bytes", takeover, noTakeover)
+	}
+}
+
+func TestContextTakeoverPreparedMessage(t *testing.T) {
+	var connBuf bytes.Buffer
+	wc := newTestConn(nil, &connBuf, true)
+	rc := newTestConn(&connBuf, nil, false)
+	wc.setCompression(CompressionParams{})
+	rc.setCompression(CompressionParams{})
+
+	pm, err := NewPreparedMessage(TextMessage, []byte("prepared: planet, country, city, street"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]byte{}
+	for i, m := range textMessages(10) {
+		if i%2 == 0 {
+			if err := wc.WritePreparedMessage(pm); err != nil {
+				t.Fatal(err)
+			}
+			want = append(want, pm.data)
+		}
+		if err := wc.WriteMessage(TextMessage, m); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, m)
+	}
+	for i, m := range want {
+		_, p, err := rc.ReadMessage()
+		if err != nil {
+			t.Fatalf("%d: ReadMessage() returned %v", i, err)
+		}
+		if !bytes.Equal(p, m) {
+			t.Fatalf("%d: got %q, want %q", i, p, m)
+		}
+	}
+	if _, ok := wc.CompressionParams(); !ok {
+		t.Fatal("CompressionParams() not set")
+	}
+}
+
+func TestDecompressedReadLimit(t *testing.T) {
+	bomb := make([]byte, 1<<20)
+	for _, params := range []CompressionParams{
+		{ServerNoContextTakeover: true, ClientNoContextTakeover: true},
+		{},
+	} {
+		var connBuf, closeBuf bytes.Buffer
+		wc := newTestConn(nil, &connBuf, false)
+		rc := newTestConn(&connBuf, &closeBuf, true)
+		wc.setCompression(params)
+		rc.setCompression(params)
+		rc.SetReadLimit(64 << 10)
+
+		wc.WriteMessage(BinaryMessage, bomb[:1024])
+		wc.WriteMessage(BinaryMessage, bomb)
+		if compressed := connBuf.Len(); compressed > 64<<10 {
+			t.Fatalf("%+v: compressed size %d exceeds read limit", params, compressed)
+		}
+
+		if _, p, err := rc.ReadMessage(); err != nil || len(p) != 1024 {
+			t.Fatalf("%+v: ReadMessage() returned %d bytes, %v", params, len(p), err)
+		}
+		if _, _, err := rc.ReadMessage(); err != ErrReadLimit {
+			t.Fatalf("%+v: ReadMessage() returned %v, want %v", params, err, ErrReadLimit)
+		}
+		if !bytes.Contains(closeBuf.Bytes(), FormatCloseMessage(CloseMessageTooBig, "")) {
+			t.Errorf("%+v: close message %d not sent", params, CloseMessageTooBig)
+		}
+		if _, _, err := rc.NextReader(); err != ErrReadLimit {
+			t.Errorf("%+v: NextReader() after read limit returned %v, want %v", params, err, ErrReadLimit)
+		}
+	}
+}
+
+func TestCompressionRatioLimit(t *testing.T) {
+	random := make([]byte, 256<<10)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	var connBuf, closeBuf bytes.Buffer
+	wc := newTestConn(nil, &connBuf, false)
+	rc := newTestConn(&connBuf, &closeBuf, true)
+	params := CompressionParams{ServerNoContextTakeover: true, ClientNoContextTakeover: true}
+	wc.setCompression(params)
+	rc.setCompression(params)
+	rc.SetCompressionRatioLimit(100)
+
+	// Small messages and messages with a low ratio pass.
+	for _, m := range [][]byte{make([]byte, 32<<10), random} {
+		wc.WriteMessage(BinaryMessage, m)
+		if _, p, err := rc.ReadMessage(); err != nil || !bytes.Equal(p, m) {
+			t.Fatalf("ReadMessage() returned %d bytes, %v, want %d bytes", len(p), err, len(m))
+		}
+	}
+
+	wc.WriteMessage(BinaryMessage, make([]byte, 1<<20))
+	if _, _, err := rc.ReadMessage(); err != ErrReadLimit {
+		t.Fatalf("ReadMessage() returned %v, want %v", err, ErrReadLimit)
+	}
+	if !bytes.Contains(closeBuf.Bytes(), FormatCloseMessage(CloseMessageTooBig, "")) {
+		t.Errorf("close message %d not sent", CloseMessageTooBig)
+	}
+}
+
+func TestCompressionRatioLimitSingleFrame(t *testing.T) {
+	// A highly compressed prefix followed by incompressible data, written as
+	// one frame. The declared frame length covers the random tail, but the
+	// prefix decompresses from a few KB actually read.
+	m := make([]byte, 2<<20)
+	rand.New(rand.NewSource(1)).Read(m[1<<20:])
+
+	var connBuf, closeBuf bytes.Buffer
+	wc := newConn(fakeNetConn{Writer: &connBuf}, false, 1024, 4<<20, nil, nil, nil)
+	rc := newTestConn(&connBuf, &closeBuf, true)
+	params := CompressionParams{ServerNoContextTakeover: true, ClientNoContextTakeover: true}
+	wc.setCompression(params)
+	rc.setCompression(params)
+	rc.SetCompressionRatioLimit(100)
+
+	wc.WriteMessage(BinaryMessage, m)
+	if b := connBuf.Bytes(); b[0]&finalBit == 0 || b[1]&0x7f != 127 {
+		t.Fatalf("message not written as a single frame")
+	}
+	if _, _, err := rc.ReadMessage(); err != ErrReadLimit {
+		t.Fatalf("ReadMessage() returned %v, want %v", err, ErrReadLimit)
+	}
+	if !bytes.Contains(closeBuf.Bytes(), FormatCloseMessage(CloseMessageTooBig, "")) {
+		t.Errorf("close message %d not sent", CloseMessageTooBig)
+	}
+}
+
+func TestCompressionRejectsRSV1(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		frames []byte
+	}{
+		{"ping", []byte{finalBit | rsv1Bit | PingMessage, maskBit, 0, 0, 0, 0}},
+		{"close", []byte{finalBit | rsv1Bit | CloseMessage, maskBit, 0, 0, 0, 0}},
+		{"continuation", []byte{
+			TextMessage, maskBit | 1, 0, 0, 0, 0, 'a',
+			finalBit | rsv1Bit | continuationFrame, maskBit | 1, 0, 0, 0, 0, 'b',
+		}},
+	} {
+		var closeBuf bytes.Buffer
+		rc := newTestConn(bytes.NewReader(tt.frames), &closeBuf, true)
+		rc.setCompression(CompressionParams{})
+		_, _, err := rc.ReadMessage()
+		if err == nil || !strings.Contains(err.Error(), "RSV1 set") {
+			t.Errorf("%s: ReadMessage() returned %v, want RSV1 protocol error", tt.name, err)
+		}
+		if !bytes.Contains(closeBuf.Bytes(), FormatCloseMessage(CloseProtocolError, "")[:2]) {
+			t.Errorf("%s: close message %d not sent", tt.name, CloseProtocolError)
+		}
+	}
+}
+
+func TestContextTakeoverLargePartialRead(t *testing.T) {
+	large := make([]byte, 256<<10)
+	rand.New(rand.NewSource(1)).Read(large)
+
+	var connBuf bytes.Buffer
+	wc := newTestConn(nil, &connBuf, false)
+	rc := newTestConn(&connBuf, nil, true)
+	wc.setCompression(CompressionParams{})
+	rc.setCompression(CompressionParams{})
+
+	wc.WriteMessage(BinaryMessage, large)
+	wc.WriteMessage(TextMessage, []byte("next"))
+
+	_, r, err := rc.NextReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Read(make([]byte, 3))
+	// NextReader drains the rest of the large message through the
+	// decompressor.
+	if _, p, err := rc.ReadMessage(); err != nil || string(p) != "next" {
+		t.Fatalf("ReadMessage() = %q, %v, want %q", p, err, "next")
+	}
+}
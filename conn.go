@@ -9,8 +9,10 @@ package websocket
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
@@ -18,8 +20,11 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
+
+	"github.com/cloudwego/hertz/pkg/app"
 )
 
 const (
@@ -189,6 +194,22 @@ func newMaskKey() [4]byte {
 	return [4]byte{byte(n), byte(n >> 8), byte(n >> 16), byte(n >> 24)}
 }
 
+// setReadErr records err from the underlying connection as the permanent
+// error reported by the read methods.
+func (c *Conn) setReadErr(err error) {
+	if err == nil || c.readErr != nil {
+		return
+	}
+	if c.keepalive != nil && c.keepalive.isExpired() {
+		err = ErrKeepaliveTimeout
+	}
+	c.readErr = hideTempErr(err)
+	if e, ok := err.(*CloseError); !ok || e.Code == CloseAbnormalClosure {
+		c.setState(StateClosed)
+	}
+	close(c.readDone)
+}
+
 func hideTempErr(err error) error {
 	if e, ok := err.(net.Error); ok && e.Temporary() {
 		err = &netError{msg: e.Error(), timeout: e.Timeout()}
@@ -242,9 +263,17 @@ type writePoolData struct{ buf []byte }
 
 // The Conn type represents a WebSocket connection.
 type Conn struct {
+	stats connStats // first for the alignment of the atomic counters
+
 	conn        net.Conn
 	isServer    bool
 	subprotocol string
+	codec       Codec // nil selects JSONCodec
+
+	interceptors []Interceptor
+
+	idOnce sync.Once
+	id     string // assigned by ID
 
 	// Write fields
 	mu            chan struct{} // used as mutex to protect write to conn
@@ -258,9 +287,16 @@ type Conn struct {
 	writeErrMu sync.Mutex
 	writeErr   error
 
+	writeInterrupted  int32       // set while a canceled context interrupts writes
+	writeQueue        *writeQueue // nil unless EnableWriteQueue was called
+	keepalive         *keepalive  // nil unless keepalive is enabled
+	validateWriteUTF8 bool        // whether outgoing text messages are validated
+
 	enableWriteCompression bool
 	compressionLevel       int
-	newCompressionWriter   func(io.WriteCloser, int) io.WriteCloser
+	extensions             []NegotiatedExtension
+	extensionRSV           byte               // reserved bits used by the extensions
+	deflate                *perMessageDeflate // nil unless permessage-deflate was negotiated
 
 	// Read fields
 	reader  io.ReadCloser // the current reader returned to the application
@@ -271,7 +307,9 @@ type Conn struct {
 	readRemaining int64
 	readFinal     bool  // true the current message has more frames.
 	readLength    int64 // Message size.
+	readConsumed  int64 // Message payload bytes read from the connection.
 	readLimit     int64 // Maximum message size.
+	readRatio     int64 // Maximum ratio of decompressed to compressed size.
 	readMaskPos   int
 	readMaskKey   [4]byte
 	handlePong    func(string) error
@@ -279,9 +317,23 @@ type Conn struct {
 	handleClose   func(int, string) error
 	readErrCount  int
 	messageReader *messageReader // the current low-level reader
+	readDeadline  time.Time
+	readSem       chan struct{} // held by the goroutine reading the connection
+	validateUTF8  bool          // whether incoming text messages are validated
+	readDone      chan struct{} // closed when readErr is set
+
+	// handshake timeout bounding the read of the first frame, zero once the
+	// first frame is read or the application sets a read deadline.
+	handshakeTimeout time.Duration
+
+	state int32 // ConnState
 
-	readDecompress         bool // whether last read frame had RSV1 set
-	newDecompressionReader func(io.Reader) io.ReadCloser
+	readRSV byte // reserved bits of the last read frame
+
+	pings pings // pings sent by Ping
+
+	// snapshot of the upgraded request, nil for client connections.
+	reqCtx *app.RequestContext
 
 	// keep reference to the resp to make sure the underlying conn will not be closed.
 	// see: https://github.com/cloudwego/hertz/pull/1214 for the details.
@@ -315,6 +367,8 @@ func newConn(conn net.Conn, isServer bool, readBufferSize, writeBufferSize int,
 		br:                     br,
 		conn:                   conn,
 		mu:                     mu,
+		readSem:                make(chan struct{}, 1),
+		readDone:               make(chan struct{}),
 		readFinal:              true,
 		writeBuf:               writeBuf,
 		writePool:              writeBufferPool,
@@ -328,6 +382,80 @@ func newConn(conn net.Conn, isServer bool, readBufferSize, writeBufferSize int,
 	return c
 }
 
+// ConnConfig specifies the options for a connection created with NewConn.
+type ConnConfig struct {
+	// IsServer specifies if the connection is the server side of the
+	// connection. Clients mask the frames they send; servers do not.
+	IsServer bool
+
+	// ReadBufferSize and WriteBufferSize specify I/O buffer sizes in bytes. If
+	// a buffer size is zero, then a default size is used. The I/O buffer
+	// sizes do not limit the size of the messages that can be sent or
+	// received.
+	ReadBufferSize, WriteBufferSize int
+
+	// WriteBufferPool is a pool of buffers for write operations. If the value
+	// is not set, then write buffers are allocated to the connection for the
+	// lifetime of the connection.
+	WriteBufferPool BufferPool
+
+	// Reader, if not nil, is the buffered reader of the network connection.
+	// Pass the reader used for the opening handshake so that data the peer
+	// sent after the handshake is not lost. ReadBufferSize is ignored when
+	// Reader is set.
+	Reader *bufio.Reader
+
+	// Subprotocol is the subprotocol negotiated in the opening handshake.
+	Subprotocol string
+
+	// Codec is the codec used by WriteValue and ReadValue. If nil, JSONCodec
+	// is used.
+	Codec Codec
+
+	// Compression, if not nil, enables the permessage-deflate extension with
+	// the parameters negotiated in the opening handshake.
+	Compression *CompressionParams
+
+	// Extensions are the other extensions negotiated in the opening
+	// handshake, in the order of the Sec-WebSocket-Extensions response
+	// header. permessage-deflate, if enabled, precedes them.
+	Extensions []NegotiatedExtension
+
+	// ValidateUTF8 and ValidateWriteUTF8 specify if received and written text
+	// messages are checked for valid UTF-8. See HertzUpgrader.ValidateUTF8.
+	ValidateUTF8, ValidateWriteUTF8 bool
+
+	// Interceptors are called for every data message read from and written
+	// to the connection. See Interceptor.
+	Interceptors []Interceptor
+
+	// Keepalive specifies the pings sent to detect an unresponsive peer. The
+	// zero value disables keepalive.
+	Keepalive KeepaliveConfig
+}
+
+// NewConn returns a WebSocket connection over conn. The opening handshake
+// must already be complete; NewConn only runs the WebSocket framing. Use it
+// with transports other than Hertz, such as net.Pipe, Unix sockets, or
+// connections upgraded by another server.
+func NewConn(conn net.Conn, config ConnConfig) *Conn {
+	c := newConn(conn, config.IsServer, config.ReadBufferSize, config.WriteBufferSize, config.WriteBufferPool, config.Reader, nil)
+	c.subprotocol = config.Subprotocol
+	c.codec = config.Codec
+	extensions := config.Extensions
+	if config.Compression != nil {
+		extensions = append([]NegotiatedExtension{newPerMessageDeflate(*config.Compression, config.IsServer)}, extensions...)
+	}
+	if len(extensions) > 0 {
+		c.setExtensions(extensions)
+	}
+	c.validateUTF8 = config.ValidateUTF8
+	c.validateWriteUTF8 = config.ValidateWriteUTF8
+	c.interceptors = config.Interceptors
+	c.startKeepalive(config.Keepalive)
+	return c
+}
+
 // setReadRemaining tracks the number of bytes remaining on the connection. If n
 // overflows, an ErrReadLimit is returned.
 func (c *Conn) setReadRemaining(n int64) error {
@@ -344,12 +472,152 @@ func (c *Conn) Subprotocol() string {
 	return c.subprotocol
 }
 
+// RequestContext returns a copy of the request context of the HTTP request
+// that was upgraded to this connection. The copy holds the request headers,
+// query arguments, cookies, route parameters and the keys set by Hertz
+// middleware, and is safe to use for the lifetime of the connection. It must
+// not be used to write a response.
+//
+// RequestContext returns nil for client connections.
+func (c *Conn) RequestContext() *app.RequestContext {
+	return c.reqCtx
+}
+
 // Close closes the underlying network connection without sending or waiting
-// for a close message.
+// for a close message. Messages in the write queue are reported as failed with
+// ErrWriteQueueClosed.
 func (c *Conn) Close() error {
+	if c.writeQueue != nil {
+		c.writeQueue.stop(ErrWriteQueueClosed)
+	}
+	c.stopKeepalive()
+	c.setState(StateClosed)
 	return c.conn.Close()
 }
 
+// ConnState describes the progress of closing a connection.
+type ConnState int32
+
+const (
+	// StateOpen means that the connection can be used for reading and
+	// writing.
+	StateOpen ConnState = iota
+
+	// StateClosing means that a close message was sent to or received from
+	// the peer.
+	StateClosing
+
+	// StateClosed means that the connection was closed or failed and can no
+	// longer be used.
+	StateClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateOpen:
+		return "open"
+	case StateClosing:
+		return "closing"
+	case StateClosed:
+		return "closed"
+	}
+	return "ConnState(" + strconv.Itoa(int(s)) + ")"
+}
+
+// State returns the state of the connection. It is safe to call State
+// concurrently with the other methods.
+func (c *Conn) State() ConnState {
+	return ConnState(atomic.LoadInt32(&c.state))
+}
+
+// setState advances the state of the connection to s. The state never moves
+// backwards.
+func (c *Conn) setState(s ConnState) {
+	for {
+		old := atomic.LoadInt32(&c.state)
+		if old >= int32(s) || atomic.CompareAndSwapInt32(&c.state, old, int32(s)) {
+			return
+		}
+	}
+}
+
+// maxCloseReasonLength is the maximum length of the reason in a close message.
+const maxCloseReasonLength = maxControlFramePayloadSize - 2
+
+var (
+	errInvalidCloseCode = errors.New("websocket: invalid close code")
+	errInvalidCloseText = errors.New("websocket: invalid utf8 close reason")
+	errCloseTimeout     = &netError{msg: "websocket: close handshake timeout", timeout: true}
+)
+
+// truncateCloseReason truncates reason to fit in a close message without
+// splitting a UTF-8 sequence.
+func truncateCloseReason(reason string) string {
+	if len(reason) <= maxCloseReasonLength {
+		return reason
+	}
+	i := maxCloseReasonLength
+	for i > 0 && !utf8.RuneStart(reason[i]) {
+		i--
+	}
+	return reason[:i]
+}
+
+// CloseGracefully performs the closing handshake specified in RFC 6455: it
+// sends a close message with the given code and reason, waits for the close
+// message from the peer and closes the underlying network connection. Reasons
+// longer than 123 bytes are truncated. Use CloseNoStatusReceived to send a
+// close message without a status code.
+//
+// The peer's close message is received by the goroutine reading the
+// connection, if any. Otherwise, CloseGracefully reads and discards messages
+// until the close message arrives. The handshake is abandoned after timeout.
+//
+// CloseGracefully returns nil if the peer answered the close message. The
+// connection is closed in all cases, except when code or reason is invalid.
+func (c *Conn) CloseGracefully(code int, reason string, timeout time.Duration) error {
+	if code != CloseNoStatusReceived && !isValidReceivedCloseCode(code) {
+		return errInvalidCloseCode
+	}
+	if !utf8.ValidString(reason) {
+		return errInvalidCloseText
+	}
+	defer c.Close()
+
+	deadline := time.Now().Add(timeout)
+	err := c.WriteControl(CloseMessage, FormatCloseMessage(code, truncateCloseReason(reason)), deadline)
+	if err != nil && err != ErrCloseSent {
+		return err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-c.readDone:
+	case c.readSem <- struct{}{}:
+		// No other goroutine is reading the connection.
+		interrupt := time.AfterFunc(time.Until(deadline), c.interruptRead)
+		c.reader = nil // skip decompressing the rest of the current message
+		for {
+			if _, _, err := c.nextReader(); err != nil {
+				break
+			}
+		}
+		interrupt.Stop()
+		<-c.readSem
+	case <-timer.C:
+		return errCloseTimeout
+	}
+
+	if e, ok := c.readErr.(*CloseError); ok && e.Code != CloseAbnormalClosure {
+		return nil
+	}
+	if time.Now().After(deadline) {
+		return errCloseTimeout
+	}
+	return c.readErr
+}
+
 // LocalAddr returns the local network address.
 func (c *Conn) LocalAddr() net.Addr {
 	return c.conn.LocalAddr()
@@ -364,6 +632,11 @@ func (c *Conn) RemoteAddr() net.Addr {
 
 func (c *Conn) writeFatal(err error) error {
 	err = hideTempErr(err)
+	if err == ErrCloseSent {
+		c.setState(StateClosing)
+	} else {
+		c.setState(StateClosed)
+	}
 	c.writeErrMu.Lock()
 	if c.writeErr == nil {
 		c.writeErr = err
@@ -382,7 +655,7 @@ func (c *Conn) read(n int) ([]byte, error) {
 }
 
 func (c *Conn) write(frameType int, deadline time.Time, buf0, buf1 []byte) error {
-	<-c.mu
+	c.lockWrite()
 	defer func() { c.mu <- struct{}{} }()
 
 	c.writeErrMu.Lock()
@@ -393,6 +666,9 @@ func (c *Conn) write(frameType int, deadline time.Time, buf0, buf1 []byte) error
 	}
 
 	c.conn.SetWriteDeadline(deadline)
+	if atomic.LoadInt32(&c.writeInterrupted) != 0 {
+		c.conn.SetWriteDeadline(aLongTimeAgo)
+	}
 	if len(buf1) == 0 {
 		_, err = c.conn.Write(buf0)
 	} else {
@@ -401,6 +677,7 @@ func (c *Conn) write(frameType int, deadline time.Time, buf0, buf1 []byte) error
 	if err != nil {
 		return c.writeFatal(err)
 	}
+	c.stats.frameWritten(frameType, len(buf0)+len(buf1))
 	if frameType == CloseMessage {
 		c.writeFatal(ErrCloseSent)
 	}
@@ -449,12 +726,18 @@ func (c *Conn) WriteControl(messageType int, data []byte, deadline time.Time) er
 		}
 	}
 
-	timer := time.NewTimer(d)
 	select {
 	case <-c.mu:
-		timer.Stop()
-	case <-timer.C:
-		return errWriteTimeout
+	default:
+		start := time.Now()
+		timer := time.NewTimer(d)
+		select {
+		case <-c.mu:
+			timer.Stop()
+		case <-timer.C:
+			return errWriteTimeout
+		}
+		c.stats.stalled(time.Since(start))
 	}
 	defer func() { c.mu <- struct{}{} }()
 
@@ -466,10 +749,14 @@ func (c *Conn) WriteControl(messageType int, data []byte, deadline time.Time) er
 	}
 
 	c.conn.SetWriteDeadline(deadline)
+	if atomic.LoadInt32(&c.writeInterrupted) != 0 {
+		c.conn.SetWriteDeadline(aLongTimeAgo)
+	}
 	_, err = c.conn.Write(buf)
 	if err != nil {
 		return c.writeFatal(err)
 	}
+	c.stats.frameWritten(messageType, len(buf))
 	if messageType == CloseMessage {
 		c.writeFatal(ErrCloseSent)
 	}
@@ -521,25 +808,43 @@ func (c *Conn) beginMessage(mw *messageWriter, messageType int) error {
 // All message types (TextMessage, BinaryMessage, CloseMessage, PingMessage and
 // PongMessage) are supported.
 func (c *Conn) NextWriter(messageType int) (io.WriteCloser, error) {
+	if c.interceptors != nil && isData(messageType) {
+		return &interceptedWriter{c: c, messageType: messageType}, nil
+	}
+	return c.nextWriter(messageType, messageType == TextMessage && c.validateWriteUTF8)
+}
+
+func (c *Conn) nextWriter(messageType int, validateUTF8 bool) (io.WriteCloser, error) {
 	var mw messageWriter
 	if err := c.beginMessage(&mw, messageType); err != nil {
 		return nil, err
 	}
 	c.writer = &mw
-	if c.newCompressionWriter != nil && c.enableWriteCompression && isData(messageType) {
-		w := c.newCompressionWriter(c.writer, c.compressionLevel)
-		mw.compress = true
-		c.writer = w
+	if isData(messageType) {
+		for i := len(c.extensions) - 1; i >= 0; i-- {
+			w, rsv := c.extensions[i].NewWriter(c.writer, messageType)
+			mw.rsv |= rsv
+			if rsv != 0 && c.deflate != nil && c.extensions[i] == NegotiatedExtension(c.deflate) {
+				w = uncompressedCounter{w: w, s: &c.stats}
+				mw.compressed = true
+			}
+			c.writer = w
+		}
+	}
+	if validateUTF8 {
+		c.writer = &utf8Writer{mw: &mw, w: c.writer}
 	}
 	return c.writer, nil
 }
 
 type messageWriter struct {
 	c         *Conn
-	compress  bool // whether next call to flushFrame should set RSV1
+	rsv       byte // reserved bits to set in the next call to flushFrame
 	pos       int  // end of data in writeBuf.
 	frameType int  // type of the current frame.
 	err       error
+
+	compressed bool // whether the message is compressed with permessage-deflate
 }
 
 func (w *messageWriter) endMessage(err error) error {
@@ -572,10 +877,8 @@ func (w *messageWriter) flushFrame(final bool, extra []byte) error {
 	if final {
 		b0 |= finalBit
 	}
-	if w.compress {
-		b0 |= rsv1Bit
-	}
-	w.compress = false
+	b0 |= w.rsv
+	w.rsv = 0
 
 	b1 := byte(0)
 	if !c.isServer {
@@ -633,8 +936,14 @@ func (w *messageWriter) flushFrame(final bool, extra []byte) error {
 	if err != nil {
 		return w.endMessage(err)
 	}
+	if w.compressed {
+		atomic.AddInt64(&c.stats.compressedWritten, int64(length))
+	}
 
 	if final {
+		if !isControl(w.frameType) {
+			atomic.AddInt64(&c.stats.messagesWritten, 1)
+		}
 		w.endMessage(errWriteClosed)
 		return nil
 	}
@@ -738,9 +1047,21 @@ func (w *messageWriter) Close() error {
 
 // WritePreparedMessage writes prepared message into connection.
 func (c *Conn) WritePreparedMessage(pm *PreparedMessage) error {
+	if c.interceptors != nil && isData(pm.messageType) {
+		// The interceptors may transform the message.
+		return c.WriteMessage(pm.messageType, pm.data)
+	}
+	if pm.messageType == TextMessage && c.validateWriteUTF8 && !utf8.Valid(pm.data) {
+		return ErrInvalidUTF8
+	}
+	if !c.onlyDeflate() {
+		// The prepared frames are not processed by the other extensions.
+		return c.WriteMessage(pm.messageType, pm.data)
+	}
+	compress := c.deflate != nil && c.enableWriteCompression && isData(pm.messageType)
 	frameType, frameData, err := pm.frame(prepareKey{
 		isServer:         c.isServer,
-		compress:         c.newCompressionWriter != nil && c.enableWriteCompression && isData(pm.messageType),
+		compress:         compress,
 		compressionLevel: c.compressionLevel,
 	})
 	if err != nil {
@@ -755,13 +1076,40 @@ func (c *Conn) WritePreparedMessage(pm *PreparedMessage) error {
 		panic("concurrent write to websocket connection")
 	}
 	c.isWriting = false
+	if err == nil && isData(frameType) {
+		atomic.AddInt64(&c.stats.messagesWritten, 1)
+		if compress {
+			atomic.AddInt64(&c.stats.uncompressedWritten, int64(len(pm.data)))
+			atomic.AddInt64(&c.stats.compressedWritten, int64(len(frameData)-frameHeaderSize(frameData[1])))
+		}
+	}
+	if c.deflate != nil && c.deflate.writeCtx != nil && c.enableWriteCompression && isData(frameType) {
+		// The prepared frame is compressed without context takeover. The
+		// peer's sliding window now contains data our compressor has not seen,
+		// so start the next message with an empty window.
+		c.deflate.writeCtx.reset = true
+	}
 	return err
 }
 
 // WriteMessage is a helper method for getting a writer using NextWriter,
 // writing the message and closing the writer.
 func (c *Conn) WriteMessage(messageType int, data []byte) error {
-	if c.isServer && (c.newCompressionWriter == nil || !c.enableWriteCompression) {
+	if c.interceptors != nil && isData(messageType) {
+		var err error
+		messageType, data, err = c.interceptWrite(messageType, data)
+		if err == ErrDropMessage {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if messageType == TextMessage && c.validateWriteUTF8 && !utf8.Valid(data) {
+		return ErrInvalidUTF8
+	}
+
+	if c.isServer && !c.writeExtended(messageType) {
 		// Fast path with no allocations and single frame.
 
 		var mw messageWriter
@@ -774,7 +1122,7 @@ func (c *Conn) WriteMessage(messageType int, data []byte) error {
 		return mw.flushFrame(true, data)
 	}
 
-	w, err := c.NextWriter(messageType)
+	w, err := c.nextWriter(messageType, false)
 	if err != nil {
 		return err
 	}
@@ -811,32 +1159,38 @@ func (c *Conn) advanceFrame() (int, error) {
 	var errors []string
 
 	p, err := c.read(2)
+	if c.handshakeTimeout > 0 {
+		if isTimeout(err) {
+			err = &HandshakeTimeoutError{Duration: c.handshakeTimeout, Err: err}
+		}
+		c.clearHandshakeTimeout()
+	}
 	if err != nil {
 		return noFrame, err
 	}
 
 	frameType := int(p[0] & 0xf)
+	headerSize := frameHeaderSize(p[1])
 	final := p[0]&finalBit != 0
-	rsv1 := p[0]&rsv1Bit != 0
-	rsv2 := p[0]&rsv2Bit != 0
-	rsv3 := p[0]&rsv3Bit != 0
+	c.readRSV = p[0] & (rsv1Bit | rsv2Bit | rsv3Bit)
 	mask := p[1]&maskBit != 0
 	c.setReadRemaining(int64(p[1] & 0x7f))
 
-	c.readDecompress = false
-	if rsv1 {
-		if c.newDecompressionReader != nil {
-			c.readDecompress = true
-		} else {
-			errors = append(errors, "RSV1 set")
-		}
+	// Reserved bits are allowed if used by a negotiated extension, and only
+	// on the first frame of a data message (RFC 7692, section 6).
+	rsv := c.readRSV
+	if frameType == TextMessage || frameType == BinaryMessage {
+		rsv &^= c.extensionRSV
+	}
+	if rsv&rsv1Bit != 0 {
+		errors = append(errors, "RSV1 set")
 	}
 
-	if rsv2 {
+	if rsv&rsv2Bit != 0 {
 		errors = append(errors, "RSV2 set")
 	}
 
-	if rsv3 {
+	if rsv&rsv3Bit != 0 {
 		errors = append(errors, "RSV3 set")
 	}
 
@@ -870,51 +1224,14 @@ func (c *Conn) advanceFrame() (int, error) {
 		return noFrame, c.handleProtocolError(strings.Join(errors, ", "))
 	}
 
-	// 3. Read and parse frame length as per
-	// https://tools.ietf.org/html/rfc6455#section-5.2
-	//
-	// The length of the "Payload data", in bytes: if 0-125, that is the payload
-	// length.
-	// - If 126, the following 2 bytes interpreted as a 16-bit unsigned
-	// integer are the payload length.
-	// - If 127, the following 8 bytes interpreted as
-	// a 64-bit unsigned integer (the most significant bit MUST be 0) are the
-	// payload length. Multibyte length quantities are expressed in network byte
-	// order.
-
-	switch c.readRemaining {
-	case 126:
-		p, err := c.read(2)
-		if err != nil {
-			return noFrame, err
-		}
-
-		if err := c.setReadRemaining(int64(binary.BigEndian.Uint16(p))); err != nil {
-			return noFrame, err
-		}
-	case 127:
-		p, err := c.read(8)
-		if err != nil {
-			return noFrame, err
-		}
-
-		if err := c.setReadRemaining(int64(binary.BigEndian.Uint64(p))); err != nil {
-			return noFrame, err
-		}
-	}
-
-	// 4. Handle frame masking.
+	// 3. Read frame length and masking key.
 
-	if mask {
-		c.readMaskPos = 0
-		p, err := c.read(len(c.readMaskKey))
-		if err != nil {
-			return noFrame, err
-		}
-		copy(c.readMaskKey[:], p)
+	if err := c.readFrameLength(mask); err != nil {
+		return noFrame, err
 	}
+	c.stats.frameRead(frameType, int64(headerSize)+c.readRemaining)
 
-	// 5. For text and binary messages, enforce read limit and return.
+	// 4. For text and binary messages, enforce read limit and return.
 
 	if frameType == continuationFrame || frameType == TextMessage || frameType == BinaryMessage {
 
@@ -933,7 +1250,7 @@ func (c *Conn) advanceFrame() (int, error) {
 		return frameType, nil
 	}
 
-	// 6. Read control frame payload.
+	// 5. Read control frame payload.
 
 	var payload []byte
 	if c.readRemaining > 0 {
@@ -947,10 +1264,11 @@ func (c *Conn) advanceFrame() (int, error) {
 		}
 	}
 
-	// 7. Process control frame payload.
+	// 6. Process control frame payload.
 
 	switch frameType {
 	case PongMessage:
+		c.pong(string(payload))
 		if err := c.handlePong(string(payload)); err != nil {
 			return noFrame, err
 		}
@@ -971,6 +1289,7 @@ func (c *Conn) advanceFrame() (int, error) {
 				return noFrame, c.handleProtocolError("invalid utf8 payload in close frame")
 			}
 		}
+		c.setState(StateClosing)
 		if err := c.handleClose(closeCode, closeText); err != nil {
 			return noFrame, err
 		}
@@ -980,6 +1299,55 @@ func (c *Conn) advanceFrame() (int, error) {
 	return frameType, nil
 }
 
+// readFrameLength reads the extended payload length and the masking key of a
+// frame header. The 7 bit payload length is in c.readRemaining.
+func (c *Conn) readFrameLength(mask bool) error {
+	// Read and parse frame length as per
+	// https://tools.ietf.org/html/rfc6455#section-5.2
+	//
+	// The length of the "Payload data", in bytes: if 0-125, that is the payload
+	// length.
+	// - If 126, the following 2 bytes interpreted as a 16-bit unsigned
+	// integer are the payload length.
+	// - If 127, the following 8 bytes interpreted as
+	// a 64-bit unsigned integer (the most significant bit MUST be 0) are the
+	// payload length. Multibyte length quantities are expressed in network byte
+	// order.
+
+	switch c.readRemaining {
+	case 126:
+		p, err := c.read(2)
+		if err != nil {
+			return err
+		}
+
+		if err := c.setReadRemaining(int64(binary.BigEndian.Uint16(p))); err != nil {
+			return err
+		}
+	case 127:
+		p, err := c.read(8)
+		if err != nil {
+			return err
+		}
+
+		if err := c.setReadRemaining(int64(binary.BigEndian.Uint64(p))); err != nil {
+			return err
+		}
+	}
+
+	// Handle frame masking.
+
+	if mask {
+		c.readMaskPos = 0
+		p, err := c.read(len(c.readMaskKey))
+		if err != nil {
+			return err
+		}
+		copy(c.readMaskKey[:], p)
+	}
+	return nil
+}
+
 func (c *Conn) handleProtocolError(message string) error {
 	data := FormatCloseMessage(CloseProtocolError, message)
 	if len(data) > maxControlFramePayloadSize {
@@ -1000,7 +1368,16 @@ func (c *Conn) handleProtocolError(message string) error {
 // permanent. Once this method returns a non-nil error, all subsequent calls to
 // this method return the same error.
 func (c *Conn) NextReader() (messageType int, r io.Reader, err error) {
-	// Close previous reader, only relevant for decompression.
+	if c.interceptors != nil {
+		return c.nextInterceptedReader()
+	}
+	c.readSem <- struct{}{}
+	defer func() { <-c.readSem }()
+	return c.nextReader()
+}
+
+func (c *Conn) nextReader() (messageType int, r io.Reader, err error) {
+	// Close previous reader, only relevant for extensions.
 	if c.reader != nil {
 		c.reader.Close()
 		c.reader = nil
@@ -1008,21 +1385,35 @@ func (c *Conn) NextReader() (messageType int, r io.Reader, err error) {
 
 	c.messageReader = nil
 	c.readLength = 0
+	c.readConsumed = 0
 
 	for c.readErr == nil {
 		frameType, err := c.advanceFrame()
 		if err != nil {
-			c.readErr = hideTempErr(err)
+			c.setReadErr(err)
 			break
 		}
 
 		if frameType == TextMessage || frameType == BinaryMessage {
 			c.messageReader = &messageReader{c}
 			c.reader = c.messageReader
-			if c.readDecompress {
-				c.reader = c.newDecompressionReader(c.reader)
+			er := c.newExtensionReader(heldMessageReader{c.messageReader})
+			validate := frameType == TextMessage && c.validateUTF8
+			if er == nil && !validate {
+				return frameType, c.reader, nil
+			}
+			switch {
+			case er == nil:
+				c.reader = heldMessageReader{c.messageReader}
+			case c.readLimit > 0 || c.readRatio > 0:
+				c.reader = &decompressionLimitReader{c: c, r: er}
+			default:
+				c.reader = er
+			}
+			if validate {
+				c.reader = &utf8Reader{c: c, r: c.reader}
 			}
-			return frameType, c.reader, nil
+			return frameType, &lockedReader{c: c, r: c.reader}, nil
 		}
 	}
 
@@ -1040,6 +1431,37 @@ func (c *Conn) NextReader() (messageType int, r io.Reader, err error) {
 type messageReader struct{ c *Conn }
 
 func (r *messageReader) Read(b []byte) (int, error) {
+	r.c.readSem <- struct{}{}
+	defer func() { <-r.c.readSem }()
+	return r.read(b)
+}
+
+// heldMessageReader reads from a messageReader on behalf of a caller that
+// already holds readSem.
+type heldMessageReader struct{ r *messageReader }
+
+func (r heldMessageReader) Read(b []byte) (int, error) {
+	return r.r.read(b)
+}
+
+func (r heldMessageReader) Close() error {
+	return nil
+}
+
+// lockedReader holds readSem while reading from a reader built on a
+// heldMessageReader.
+type lockedReader struct {
+	c *Conn
+	r io.Reader
+}
+
+func (r *lockedReader) Read(b []byte) (int, error) {
+	r.c.readSem <- struct{}{}
+	defer func() { <-r.c.readSem }()
+	return r.r.Read(b)
+}
+
+func (r *messageReader) read(b []byte) (int, error) {
 	c := r.c
 	if c.messageReader != r {
 		return 0, io.EOF
@@ -1052,16 +1474,17 @@ func (r *messageReader) Read(b []byte) (int, error) {
 				b = b[:c.readRemaining]
 			}
 			n, err := c.br.Read(b)
-			c.readErr = hideTempErr(err)
 			if c.isServer {
 				c.readMaskPos = maskBytes(c.readMaskKey, c.readMaskPos, b[:n])
 			}
+			c.readConsumed += int64(n)
 			rem := c.readRemaining
 			rem -= int64(n)
 			c.setReadRemaining(rem)
-			if c.readRemaining > 0 && c.readErr == io.EOF {
-				c.readErr = errUnexpectedEOF
+			if c.readRemaining > 0 && err == io.EOF {
+				err = errUnexpectedEOF
 			}
+			c.setReadErr(err)
 			return n, c.readErr
 		}
 
@@ -1073,9 +1496,9 @@ func (r *messageReader) Read(b []byte) (int, error) {
 		frameType, err := c.advanceFrame()
 		switch {
 		case err != nil:
-			c.readErr = hideTempErr(err)
+			c.setReadErr(err)
 		case frameType == TextMessage || frameType == BinaryMessage:
-			c.readErr = errors.New("websocket: internal error, unexpected text or binary in Reader")
+			c.setReadErr(errors.New("websocket: internal error, unexpected text or binary in Reader"))
 		}
 	}
 
@@ -1107,16 +1530,163 @@ func (c *Conn) ReadMessage() (messageType int, p []byte, err error) {
 // all future reads will return an error. A zero value for t means reads will
 // not time out.
 func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.clearHandshakeTimeout()
+	c.readDeadline = t
 	return c.conn.SetReadDeadline(t)
 }
 
+// setHandshakeTimeout bounds the read of the first frame by the remaining
+// time d of the handshake timeout.
+func (c *Conn) setHandshakeTimeout(timeout, d time.Duration) {
+	if rc, ok := c.conn.(interface{ SetReadTimeout(time.Duration) error }); ok {
+		c.handshakeTimeout = timeout
+		rc.SetReadTimeout(d)
+	}
+}
+
+func (c *Conn) clearHandshakeTimeout() {
+	if c.handshakeTimeout > 0 {
+		c.handshakeTimeout = 0
+		c.conn.(interface{ SetReadTimeout(time.Duration) error }).SetReadTimeout(0)
+	}
+}
+
 // SetReadLimit sets the maximum size in bytes for a message read from the peer. If a
 // message exceeds the limit, the connection sends a close message to the peer
-// and returns ErrReadLimit to the application.
+// and returns ErrReadLimit to the application. The limit applies to the
+// decompressed size of compressed messages.
 func (c *Conn) SetReadLimit(limit int64) {
 	c.readLimit = limit
 }
 
+// SetCompressionRatioLimit sets the maximum ratio between the decompressed and
+// the compressed size of a message read from the peer. If a message exceeds
+// the ratio, the connection sends a close message to the peer and returns
+// ErrReadLimit to the application. The ratio is only checked once a message
+// has decompressed to more than 64KB. Zero means no limit.
+func (c *Conn) SetCompressionRatioLimit(ratio int64) {
+	c.readRatio = ratio
+}
+
+// Context methods
+
+// aLongTimeAgo is a non-zero time, far in the past, used to interrupt
+// blocking network operations immediately.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// interruptRead unblocks a read in progress. Connections that do not support
+// deadlines, such as netpoll connections, are closed instead.
+func (c *Conn) interruptRead() {
+	if err := c.conn.SetReadDeadline(aLongTimeAgo); err != nil {
+		c.conn.Close()
+	}
+}
+
+// interruptWrite unblocks a write in progress and the writes that follow
+// until the interrupt is cleared. Connections that do not support deadlines
+// are closed instead.
+func (c *Conn) interruptWrite() {
+	atomic.StoreInt32(&c.writeInterrupted, 1)
+	if err := c.conn.SetWriteDeadline(aLongTimeAgo); err != nil {
+		c.conn.Close()
+	}
+}
+
+// watchContext calls interrupt when ctx is done. The returned function stops
+// watching and reports whether interrupt was called.
+func watchContext(ctx context.Context, interrupt func()) (stop func() bool) {
+	if ctx.Done() == nil {
+		return func() bool { return false }
+	}
+	done := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			interrupt()
+			interrupted <- true
+		case <-done:
+			interrupted <- false
+		}
+	}()
+	return func() bool {
+		close(done)
+		return <-interrupted
+	}
+}
+
+// readContext runs the read operation f and interrupts it when ctx is done.
+func (c *Conn) readContext(ctx context.Context, f func() error) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("websocket: read canceled: %w", err)
+	}
+	stop := watchContext(ctx, c.interruptRead)
+	err := f()
+	if stop() {
+		if err != nil {
+			return fmt.Errorf("websocket: read canceled: %w", ctx.Err())
+		}
+		// The read completed before it was interrupted.
+		c.conn.SetReadDeadline(c.readDeadline)
+	}
+	return err
+}
+
+// writeContext runs the write operation f and interrupts it when ctx is done.
+func (c *Conn) writeContext(ctx context.Context, f func() error) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("websocket: write canceled: %w", err)
+	}
+	stop := watchContext(ctx, c.interruptWrite)
+	err := f()
+	if stop() {
+		atomic.StoreInt32(&c.writeInterrupted, 0)
+		if err != nil {
+			return fmt.Errorf("websocket: write canceled: %w", ctx.Err())
+		}
+	}
+	return err
+}
+
+// NextReaderContext is like NextReader, but aborts waiting for the next
+// message when ctx is done. The context only applies to this call; reads from
+// the returned reader are not canceled by ctx.
+//
+// If ctx is done before a message arrives, NextReaderContext returns an error
+// wrapping ctx.Err(). As with a read timeout, the connection state is then
+// corrupt and all future reads return an error.
+func (c *Conn) NextReaderContext(ctx context.Context) (messageType int, r io.Reader, err error) {
+	messageType = noFrame
+	err = c.readContext(ctx, func() error {
+		var err error
+		messageType, r, err = c.NextReader()
+		return err
+	})
+	return messageType, r, err
+}
+
+// ReadMessageContext is like ReadMessage, but aborts the read when ctx is
+// done. See NextReaderContext for details about cancellation.
+func (c *Conn) ReadMessageContext(ctx context.Context) (messageType int, p []byte, err error) {
+	messageType = noFrame
+	err = c.readContext(ctx, func() error {
+		var err error
+		messageType, p, err = c.ReadMessage()
+		return err
+	})
+	return messageType, p, err
+}
+
+// WriteMessageContext is like WriteMessage, but aborts the write when ctx is
+// done. If ctx is done before the message is written, WriteMessageContext
+// returns an error wrapping ctx.Err(). As with a write timeout, the connection
+// state is then corrupt and all future writes return an error.
+func (c *Conn) WriteMessageContext(ctx context.Context, messageType int, data []byte) error {
+	return c.writeContext(ctx, func() error {
+		return c.WriteMessage(messageType, data)
+	})
+}
+
 // CloseHandler returns the current close handler
 func (c *Conn) CloseHandler() func(code int, text string) error {
 	return c.handleClose
@@ -1214,6 +1784,22 @@ func (c *Conn) EnableWriteCompression(enable bool) {
 	c.enableWriteCompression = enable
 }
 
+// CompressionParams returns the permessage-deflate parameters negotiated
+// with the peer. The boolean result is false if compression was not
+// negotiated.
+func (c *Conn) CompressionParams() (CompressionParams, bool) {
+	if c.deflate == nil {
+		return CompressionParams{}, false
+	}
+	return c.deflate.params, true
+}
+
+// setCompression sets permessage-deflate with the given parameters as the
+// only extension of the connection.
+func (c *Conn) setCompression(params CompressionParams) {
+	c.setExtensions([]NegotiatedExtension{newPerMessageDeflate(params, c.isServer)})
+}
+
 // SetCompressionLevel sets the flate compression level for subsequent text and
 // binary messages. This function is a noop if compression was not negotiated
 // with the peer. See the compress/flate package for a description of
@@ -64,8 +64,7 @@ func (b *broadcastBench) makeConns(numConns int) {
 	for i := 0; i < numConns; i++ {
 		c := newTestConn(nil, b.w, true)
 		if b.compression {
-			c.enableWriteCompression = true
-			c.newCompressionWriter = compressNoContextTakeover
+			c.setCompression(CompressionParams{ServerNoContextTakeover: true, ClientNoContextTakeover: true})
 		}
 		conns[i] = newBroadcastConn(c)
 		go func(c *broadcastConn) {
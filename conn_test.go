@@ -10,16 +10,19 @@ package websocket
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"testing/iotest"
 	"time"
+	"unicode/utf8"
 )
 
 var _ net.Error = errWriteTimeout
@@ -98,8 +101,8 @@ func TestFraming(t *testing.T) {
 				wc := newTestConn(nil, &connBuf, isServer)
 				rc := newTestConn(chunker.f(&connBuf), nil, !isServer)
 				if compress {
-					wc.newCompressionWriter = compressNoContextTakeover
-					rc.newDecompressionReader = decompressNoContextTakeover
+					wc.setCompression(CompressionParams{ServerNoContextTakeover: true, ClientNoContextTakeover: true})
+					rc.setCompression(CompressionParams{ServerNoContextTakeover: true, ClientNoContextTakeover: true})
 				}
 				for _, n := range frameSizes {
 					for _, writer := range writers {
@@ -706,3 +709,238 @@ func TestFailedConnectionReadPanic(t *testing.T) {
 	}
 	t.Fatal("should not get here")
 }
+
+func newPipeConns() (server, client *Conn) {
+	p1, p2 := net.Pipe()
+	return newConn(p1, true, 1024, 1024, nil, nil, nil), newConn(p2, false, 1024, 1024, nil, nil, nil)
+}
+
+func TestReadMessageContext(t *testing.T) {
+	server, client := newPipeConns()
+	defer server.Close()
+	defer client.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- client.WriteMessage(TextMessage, []byte("hello")) }()
+	_, p, err := server.ReadMessageContext(context.Background())
+	<-done
+	if err != nil || string(p) != "hello" {
+		t.Fatalf("ReadMessageContext() = %q, %v, want %q, nil", p, err, "hello")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := server.ReadMessageContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("ReadMessageContext() with canceled context returned %v, want %v", err, context.Canceled)
+	}
+
+	// A canceled context does not affect completed reads.
+	go func() { done <- client.WriteMessage(TextMessage, []byte("world")) }()
+	ctx, cancel = context.WithCancel(context.Background())
+	_, p, err = server.ReadMessageContext(ctx)
+	cancel()
+	<-done
+	if err != nil || string(p) != "world" {
+		t.Fatalf("ReadMessageContext() = %q, %v, want %q, nil", p, err, "world")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := server.ReadMessageContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("ReadMessageContext() returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if _, _, err := server.ReadMessage(); err == nil {
+		t.Fatal("ReadMessage() after canceled read returned nil error")
+	}
+}
+
+func TestWriteMessageContext(t *testing.T) {
+	server, client := newPipeConns()
+	defer server.Close()
+	defer client.Close()
+
+	go client.ReadMessage()
+	if err := server.WriteMessageContext(context.Background(), TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody reads the second message.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := server.WriteMessageContext(ctx, TextMessage, []byte("world")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("WriteMessageContext() returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := server.WriteMessage(TextMessage, []byte("again")); err == nil {
+		t.Fatal("WriteMessage() after canceled write returned nil error")
+	}
+}
+
+// noDeadlineConn is a connection that does not support deadlines.
+type noDeadlineConn struct {
+	net.Conn
+}
+
+func (c noDeadlineConn) SetReadDeadline(t time.Time) error  { return errors.New("unsupported") }
+func (c noDeadlineConn) SetWriteDeadline(t time.Time) error { return errors.New("unsupported") }
+
+func TestReadJSONContextWithoutDeadlines(t *testing.T) {
+	p1, p2 := net.Pipe()
+	defer p2.Close()
+	c := newConn(noDeadlineConn{p1}, true, 1024, 1024, nil, nil, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var v interface{}
+	if err := c.ReadJSONContext(ctx, &v); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("ReadJSONContext() returned %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func readUntilError(c *Conn) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	return done
+}
+
+func TestCloseGracefully(t *testing.T) {
+	server, client := newPipeConns()
+	defer client.Close()
+	clientErr := readUntilError(client)
+
+	if s := server.State(); s != StateOpen {
+		t.Fatalf("State() = %v, want %v", s, StateOpen)
+	}
+	if err := server.CloseGracefully(CloseNormalClosure, "bye", time.Second); err != nil {
+		t.Fatalf("CloseGracefully() returned %v", err)
+	}
+	if s := server.State(); s != StateClosed {
+		t.Errorf("State() = %v, want %v", s, StateClosed)
+	}
+	if err := <-clientErr; !IsCloseError(err, CloseNormalClosure) || err.(*CloseError).Text != "bye" {
+		t.Errorf("client read returned %v, want close error %d bye", err, CloseNormalClosure)
+	}
+	if s := client.State(); s != StateClosing {
+		t.Errorf("client State() = %v, want %v", s, StateClosing)
+	}
+}
+
+func TestCloseGracefullyConcurrentReader(t *testing.T) {
+	server, client := newPipeConns()
+	defer client.Close()
+	readUntilError(client)
+	serverErr := readUntilError(server)
+
+	if err := server.CloseGracefully(CloseGoingAway, "", time.Second); err != nil {
+		t.Fatalf("CloseGracefully() returned %v", err)
+	}
+	if err := <-serverErr; !IsCloseError(err, CloseGoingAway) {
+		t.Errorf("server read returned %v, want close error %d", err, CloseGoingAway)
+	}
+}
+
+func TestCloseGracefullyTimeout(t *testing.T) {
+	server, client := newPipeConns()
+	defer client.Close()
+
+	// The client does not answer the close message.
+	client.SetCloseHandler(func(int, string) error { return nil })
+	readUntilError(client)
+
+	err := server.CloseGracefully(CloseNormalClosure, "", 50*time.Millisecond)
+	if err != errCloseTimeout {
+		t.Fatalf("CloseGracefully() returned %v, want %v", err, errCloseTimeout)
+	}
+	if s := server.State(); s != StateClosed {
+		t.Errorf("State() = %v, want %v", s, StateClosed)
+	}
+}
+
+func TestCloseGracefullyInvalid(t *testing.T) {
+	server, client := newPipeConns()
+	defer server.Close()
+	defer client.Close()
+	if err := server.CloseGracefully(CloseAbnormalClosure, "", time.Second); err != errInvalidCloseCode {
+		t.Errorf("CloseGracefully(%d) returned %v, want %v", CloseAbnormalClosure, err, errInvalidCloseCode)
+	}
+	if err := server.CloseGracefully(CloseNormalClosure, "\xff", time.Second); err != errInvalidCloseText {
+		t.Errorf("CloseGracefully() with invalid reason returned %v, want %v", err, errInvalidCloseText)
+	}
+	if s := server.State(); s != StateOpen {
+		t.Errorf("State() = %v, want %v", s, StateOpen)
+	}
+}
+
+func TestTruncateCloseReason(t *testing.T) {
+	for _, reason := range []string{
+		"",
+		"short",
+		strings.Repeat("a", 200),
+		strings.Repeat("é", 100),
+		strings.Repeat("€", 100),
+	} {
+		r := truncateCloseReason(reason)
+		if len(r) > maxCloseReasonLength || !utf8.ValidString(r) || !strings.HasPrefix(reason, r) {
+			t.Errorf("truncateCloseReason(%q) = %q", reason, r)
+		}
+		if len(reason) > maxCloseReasonLength && len(r) < maxCloseReasonLength-utf8.UTFMax {
+			t.Errorf("truncateCloseReason(%q) = %q, too short", reason, r)
+		}
+	}
+}
+
+func TestNewConn(t *testing.T) {
+	p1, p2 := net.Pipe()
+
+	// The reader of the server's handshake has buffered the first message.
+	var early bytes.Buffer
+	newTestConn(nil, &early, false).WriteMessage(TextMessage, []byte("early"))
+
+	params := CompressionParams{ServerNoContextTakeover: true}
+	server := NewConn(p1, ConnConfig{
+		IsServer:    true,
+		Reader:      bufio.NewReader(io.MultiReader(&early, p1)),
+		Subprotocol: "chat",
+		Compression: &params,
+	})
+	client := NewConn(p2, ConnConfig{Subprotocol: "chat", Compression: &params})
+	defer server.Close()
+	defer client.Close()
+
+	if server.Subprotocol() != "chat" {
+		t.Errorf("Subprotocol() = %q, want %q", server.Subprotocol(), "chat")
+	}
+	if p, ok := server.CompressionParams(); !ok || p != params {
+		t.Errorf("CompressionParams() = %+v, %v, want %+v, true", p, ok, params)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		if err := client.WriteMessage(TextMessage, []byte("hello")); err != nil {
+			done <- err
+			return
+		}
+		_, p, err := client.ReadMessage()
+		if err == nil && string(p) != "world" {
+			err = fmt.Errorf("client read %q, want %q", p, "world")
+		}
+		done <- err
+	}()
+	for _, want := range []string{"early", "hello"} {
+		if _, p, err := server.ReadMessage(); err != nil || string(p) != want {
+			t.Fatalf("ReadMessage() = %q, %v, want %q", p, err, want)
+		}
+	}
+	if err := server.WriteMessage(TextMessage, []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
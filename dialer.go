@@ -0,0 +1,231 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package websocket
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app/client"
+	"github.com/cloudwego/hertz/pkg/common/config"
+	"github.com/cloudwego/hertz/pkg/network"
+	"github.com/cloudwego/hertz/pkg/network/standard"
+	"github.com/cloudwego/hertz/pkg/protocol"
+)
+
+var (
+	errMalformedURL    = errors.New("malformed ws or wss URL")
+	errDuplicateHeader = errors.New("websocket: duplicate header not allowed")
+)
+
+// Dialer contains options for connecting to a WebSocket server.
+//
+// It is safe to call Dialer's methods concurrently.
+type Dialer struct {
+	// ClientUpgrader specifies the handshake and connection options.
+	ClientUpgrader
+
+	// Proxy specifies a function to return a proxy for a given request. The
+	// request URL has the scheme http for ws URLs and https for wss URLs. If
+	// the function returns a non-nil error, the dial is aborted with the
+	// provided error. If Proxy is nil or returns a nil *URL, no proxy is used.
+	//
+	// The connection is tunneled with HTTP CONNECT for proxy URLs with the
+	// scheme http and through SOCKS5 for the schemes socks5 and socks5h. With
+	// socks5 the host is resolved by the client, with socks5h by the proxy.
+	// User information in the proxy URL is sent as basic authentication or as
+	// the SOCKS5 username and password.
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// TLSConfig specifies the TLS configuration to use with wss URLs. If nil,
+	// the default configuration is used.
+	TLSConfig *tls.Config
+
+	// ClientOptions specifies additional options for the Hertz client that
+	// sends the handshake request. The client uses the standard network
+	// library unless an option overrides the dialer.
+	//
+	// The client is created on the first call to Dial; changes to Proxy,
+	// TLSConfig and ClientOptions after that have no effect.
+	ClientOptions []config.ClientOption
+
+	once      sync.Once
+	client    *client.Client
+	clientErr error
+}
+
+// DefaultDialer is a dialer with all fields set to the default values. It
+// uses the proxies specified by the HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+// environment variables.
+var DefaultDialer = &Dialer{
+	Proxy: http.ProxyFromEnvironment,
+	ClientUpgrader: ClientUpgrader{
+		HandshakeTimeout: 45 * time.Second,
+	},
+}
+
+func (d *Dialer) hertzClient() (*client.Client, error) {
+	d.once.Do(func() {
+		var dialer network.Dialer = standard.NewDialer()
+		if d.Proxy != nil {
+			dialer = &proxyDialer{dialer: dialer, proxy: d.Proxy}
+		}
+		// WithTLSConfig replaces the dialer, so it must come first.
+		opts := []config.ClientOption{
+			client.WithTLSConfig(d.TLSConfig),
+			client.WithDialer(dialer),
+		}
+		opts = append(opts, d.ClientOptions...)
+		d.client, d.clientErr = client.NewClient(opts...)
+	})
+	return d.client, d.clientErr
+}
+
+// Dial creates a new client connection. Use requestHeader to specify the
+// origin (Origin), subprotocols (Sec-WebSocket-Protocol) and cookies (Cookie).
+// Use the response.Header to get the selected subprotocol
+// (Sec-WebSocket-Protocol) and cookies (Set-Cookie).
+//
+// The context is used for the whole handshake. If the context expires or is
+// canceled before the handshake completes, Dial returns the context error.
+//
+// If the WebSocket handshake fails, ErrBadHandshake is returned along with a
+// non-nil *protocol.Response so that callers can handle redirects,
+// authentication, etcetera. The response body may not contain the entire
+// response and does not need to be closed by the application.
+func (d *Dialer) Dial(ctx context.Context, urlStr string, requestHeader http.Header) (*Conn, *protocol.Response, error) {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	default:
+		return nil, nil, errMalformedURL
+	}
+
+	var auth string
+	if u.User != nil {
+		// User name and password are not allowed in websocket URIs, send them
+		// as basic authentication instead.
+		password, _ := u.User.Password()
+		auth = "Basic " + basicAuth(u.User.Username(), password)
+		u.User = nil
+	}
+
+	cli, err := d.hertzClient()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req := &protocol.Request{}
+	resp := &protocol.Response{}
+	req.SetRequestURI(u.String())
+	req.SetMethod("GET")
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+
+	for k, vs := range requestHeader {
+		switch {
+		case k == "Host":
+			if len(vs) > 0 {
+				req.SetHost(vs[0])
+			}
+		case k == "Upgrade" ||
+			k == "Connection" ||
+			k == "Sec-Websocket-Key" ||
+			k == "Sec-Websocket-Version" ||
+			k == "Sec-Websocket-Extensions" ||
+			(k == "Sec-Websocket-Protocol" && len(d.Subprotocols) > 0):
+			return nil, nil, fmt.Errorf("%w: %s", errDuplicateHeader, k)
+		default:
+			for i, v := range vs {
+				if i == 0 {
+					req.Header.Set(k, v)
+				} else {
+					req.Header.Add(k, v)
+				}
+			}
+		}
+	}
+
+	upgrader := d.ClientUpgrader
+	ctxTimeout := false
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			return nil, nil, context.DeadlineExceeded
+		}
+		if upgrader.HandshakeTimeout == 0 || timeout < upgrader.HandshakeTimeout {
+			upgrader.HandshakeTimeout = timeout
+			ctxTimeout = true
+		}
+	}
+
+	conn, err := d.handshake(ctx, &upgrader, cli, req, resp)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, nil, ctxErr
+		}
+		var te *HandshakeTimeoutError
+		if ctxTimeout && errors.As(err, &te) {
+			return nil, nil, context.DeadlineExceeded
+		}
+		if errors.Is(err, ErrBadHandshake) {
+			return nil, resp, err
+		}
+		return nil, nil, err
+	}
+	return conn, resp, nil
+}
+
+// handshake runs the handshake and gives up waiting for it when ctx is done.
+// A connection established after ctx is done is closed.
+func (d *Dialer) handshake(ctx context.Context, upgrader *ClientUpgrader, cli *client.Client, req *protocol.Request, resp *protocol.Response) (*Conn, error) {
+	if ctx.Done() == nil {
+		return upgrader.Handshake(ctx, cli, req, resp)
+	}
+
+	type result struct {
+		conn *Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := upgrader.Handshake(ctx, cli, req, resp)
+		ch <- result{conn, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-ch; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+func basicAuth(username, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+}
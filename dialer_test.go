@@ -0,0 +1,178 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package websocket
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/server"
+	"github.com/cloudwego/hertz/pkg/network/standard"
+)
+
+var dialerTestAddr = freeAddr()
+
+func init() {
+	runServer(dialerTestAddr)
+}
+
+// newTestCertificate returns a self-signed certificate for localhost.
+func newTestCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func dialEcho(t *testing.T, d *Dialer, url string) {
+	conn, resp, err := d.Dial(context.Background(), url, http.Header{"Origin": {"http://" + dialerTestAddr}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if resp.StatusCode() != 101 {
+		t.Fatalf("status = %d, want 101", resp.StatusCode())
+	}
+	if err := conn.WriteMessage(TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	_, p, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p) != "hello" {
+		t.Fatalf("got %q, want %q", p, "hello")
+	}
+}
+
+func TestDial(t *testing.T) {
+	time.Sleep(50 * time.Millisecond) // await server running
+	dialEcho(t, &Dialer{}, "ws://"+dialerTestAddr+testpath)
+}
+
+func TestDialTLS(t *testing.T) {
+	addr := freeAddr()
+	cert := newTestCertificate(t)
+	h := server.New(
+		server.WithHostPorts(addr),
+		server.WithTLS(&tls.Config{Certificates: []tls.Certificate{cert}}),
+		server.WithTransport(standard.NewTransporter),
+	)
+	h.NoHijackConnPool = true
+	h.GET(testpath, func(_ context.Context, c *app.RequestContext) {
+		err := (&HertzUpgrader{CheckOrigin: func(*app.RequestContext) bool { return true }}).Upgrade(c, func(conn *Conn) {
+			mt, p, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(mt, p)
+		})
+		if err != nil {
+			log.Print("upgrade:", err)
+		}
+	})
+	go h.Spin()
+	time.Sleep(50 * time.Millisecond) // await server running
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	dialEcho(t, &Dialer{TLSConfig: &tls.Config{RootCAs: roots}}, "wss://"+addr+testpath)
+
+	// Tunnel the TLS connection through a proxy.
+	p := newTestProxy("", "")
+	defer p.ln.Close()
+	go http.Serve(p.ln, p)
+	proxy := http.ProxyURL(&url.URL{Scheme: "http", Host: p.addr()})
+	dialEcho(t, &Dialer{TLSConfig: &tls.Config{RootCAs: roots}, Proxy: proxy}, "wss://"+addr+testpath)
+	if target := p.lastTarget(); target != addr {
+		t.Errorf("proxy target = %q, want %q", target, addr)
+	}
+}
+
+func TestDialBadHandshake(t *testing.T) {
+	time.Sleep(50 * time.Millisecond) // await server running
+	_, resp, err := (&Dialer{}).Dial(context.Background(), "ws://"+dialerTestAddr+"/not-found", nil)
+	if !errors.Is(err, ErrBadHandshake) {
+		t.Fatalf("Dial() returned %v, want ErrBadHandshake", err)
+	}
+	if resp == nil || resp.StatusCode() != 404 {
+		t.Fatalf("Dial() returned response %v, want 404", resp)
+	}
+}
+
+func TestDialErrors(t *testing.T) {
+	d := &Dialer{}
+	if _, _, err := d.Dial(context.Background(), "http://"+dialerTestAddr+testpath, nil); err != errMalformedURL {
+		t.Errorf("Dial(http) returned %v, want %v", err, errMalformedURL)
+	}
+	header := http.Header{"Sec-Websocket-Key": {"key"}}
+	if _, _, err := d.Dial(context.Background(), "ws://"+dialerTestAddr+testpath, header); err == nil {
+		t.Errorf("Dial() with duplicate header returned nil error")
+	}
+}
+
+func TestDialContextTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		// Accept connections but never respond to the handshake.
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err = (&Dialer{}).Dial(ctx, "ws://"+ln.Addr().String()+testpath, nil)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Dial() returned %v, want %v", err, context.DeadlineExceeded)
+	}
+}
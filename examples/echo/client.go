@@ -11,6 +11,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"net/url"
@@ -18,7 +19,7 @@ import (
 	"os/signal"
 	"time"
 
-	"github.com/gorilla/websocket"
+	"github.com/hertz-contrib/websocket"
 )
 
 var addr = flag.String("addr", "localhost:8080", "http service address")
@@ -33,7 +34,7 @@ func main() {
 	u := url.URL{Scheme: "ws", Host: *addr, Path: "/echo"}
 	log.Printf("connecting to %s", u.String())
 
-	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	c, _, err := websocket.DefaultDialer.Dial(context.Background(), u.String(), nil)
 	if err != nil {
 		log.Fatal("dial:", err)
 	}
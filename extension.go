@@ -0,0 +1,228 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package websocket
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The reserved bits of the frame header that extensions use to mark the
+// messages they process.
+const (
+	RSV1 byte = rsv1Bit
+	RSV2 byte = rsv2Bit
+	RSV3 byte = rsv3Bit
+)
+
+// Extension is a WebSocket extension negotiated with the
+// Sec-WebSocket-Extensions header as specified in RFC 6455, section 9.
+// Applications add extensions to HertzUpgrader.Extensions and
+// ClientUpgrader.Extensions.
+type Extension interface {
+	// Name returns the extension name used in the Sec-WebSocket-Extensions
+	// header.
+	Name() string
+
+	// Offer returns the offer a client sends for the extension, an element of
+	// the Sec-WebSocket-Extensions header such as "x-ext; param=1".
+	Offer() string
+
+	// Accept is called by a server with the parameters of an offer of the
+	// extension from the client. It returns the response element and the
+	// extension for the connection, or false to decline the offer.
+	Accept(params map[string]string) (response string, ext NegotiatedExtension, ok bool)
+
+	// Confirm is called by a client with the parameters of the server's
+	// response. It returns the extension for the connection, or an error if
+	// the response does not match the offer.
+	Confirm(params map[string]string) (NegotiatedExtension, error)
+}
+
+// NegotiatedExtension processes the data messages of a connection on which
+// an extension was negotiated. The methods are called by the goroutines
+// reading and writing the connection.
+type NegotiatedExtension interface {
+	// RSV returns the reserved bits used by the extension, a combination of
+	// RSV1, RSV2 and RSV3. Frames with reserved bits that no extension uses
+	// fail the connection.
+	RSV() byte
+
+	// NewReader returns a reader for a received message that has some of the
+	// extension's reserved bits set on its first frame; rsv holds the bits
+	// of that frame. The connection closes the returned reader when the
+	// application is done with the message. The reader must not close r.
+	NewReader(r io.Reader, rsv byte) io.ReadCloser
+
+	// NewWriter returns a writer for a text or binary message and the
+	// reserved bits to set on the first frame of the message. Closing the
+	// writer must close w. NewWriter returns w and zero to leave the message
+	// alone.
+	NewWriter(w io.WriteCloser, messageType int) (io.WriteCloser, byte)
+}
+
+// negotiateExtensions accepts the offers in a client's
+// Sec-WebSocket-Extensions header in the client's order of preference. Each
+// extension is accepted at most once and only if its reserved bits are not
+// used by an extension accepted before. It returns the value of the response
+// header and the extensions for the connection in the order of the response.
+func negotiateExtensions(header []byte, extensions []Extension) (string, []NegotiatedExtension) {
+	var (
+		response   []string
+		negotiated []NegotiatedExtension
+		accepted   = make([]bool, len(extensions))
+		rsv        byte
+	)
+	for _, offer := range parseDataHeader(header) {
+		name, params, ok := parseExtension(b2s(offer))
+		if !ok {
+			continue
+		}
+		for i, ext := range extensions {
+			if accepted[i] || !strings.EqualFold(ext.Name(), name) {
+				continue
+			}
+			resp, ne, ok := ext.Accept(params)
+			if ok && ne.RSV()&rsv == 0 {
+				accepted[i] = true
+				rsv |= ne.RSV()
+				response = append(response, resp)
+				negotiated = append(negotiated, ne)
+			}
+			break
+		}
+	}
+	return strings.Join(response, ", "), negotiated
+}
+
+// confirmExtensions checks the extensions accepted in a server's
+// Sec-WebSocket-Extensions header against the extensions offered in the
+// client's header. The server must not accept an extension that was not
+// offered (RFC 6455, section 4.1). Offered extensions that the client does
+// not know, such as extensions the application offered itself, are ignored.
+func confirmExtensions(offer, header []byte, extensions []Extension) ([]NegotiatedExtension, error) {
+	var (
+		negotiated []NegotiatedExtension
+		confirmed  = make([]bool, len(extensions))
+		rsv        byte
+	)
+	offered := make(map[string]bool)
+	for _, elem := range parseDataHeader(offer) {
+		if name, _, ok := parseExtension(b2s(elem)); ok {
+			offered[strings.ToLower(name)] = true
+		}
+	}
+	for _, elem := range parseDataHeader(header) {
+		name, params, ok := parseExtension(b2s(elem))
+		if !ok {
+			return nil, fmt.Errorf("%w: malformed Sec-WebSocket-Extensions header", ErrBadHandshake)
+		}
+		if !offered[strings.ToLower(name)] {
+			return nil, fmt.Errorf("%w: server accepted %s extension that was not offered", ErrBadHandshake, name)
+		}
+		for i, ext := range extensions {
+			if !strings.EqualFold(ext.Name(), name) {
+				continue
+			}
+			if confirmed[i] {
+				return nil, fmt.Errorf("%w: duplicate %s extension", ErrBadHandshake, name)
+			}
+			ne, err := ext.Confirm(params)
+			if err != nil {
+				return nil, err
+			}
+			if ne.RSV()&rsv != 0 {
+				return nil, fmt.Errorf("%w: %s extension uses reserved bits of another extension", ErrBadHandshake, name)
+			}
+			confirmed[i] = true
+			rsv |= ne.RSV()
+			negotiated = append(negotiated, ne)
+			break
+		}
+	}
+	return negotiated, nil
+}
+
+// setExtensions sets the extensions negotiated for the connection.
+func (c *Conn) setExtensions(extensions []NegotiatedExtension) {
+	c.extensions = extensions
+	c.extensionRSV = 0
+	c.deflate = nil
+	for _, ext := range extensions {
+		c.extensionRSV |= ext.RSV()
+		if d, ok := ext.(*perMessageDeflate); ok {
+			d.c = c
+			c.deflate = d
+		}
+	}
+}
+
+// onlyDeflate reports whether permessage-deflate is the only extension, if
+// any, negotiated for the connection. Prepared messages and the allocation
+// free write path are only used for such connections.
+func (c *Conn) onlyDeflate() bool {
+	return len(c.extensions) == 0 || (len(c.extensions) == 1 && c.deflate != nil)
+}
+
+// writeExtended reports whether an extension may process a message of the
+// given type written to the connection.
+func (c *Conn) writeExtended(messageType int) bool {
+	return isData(messageType) && (!c.onlyDeflate() || (c.deflate != nil && c.enableWriteCompression))
+}
+
+// newExtensionReader returns the reader for the message read by r as
+// processed by the extensions, or nil if no extension applies to the message.
+func (c *Conn) newExtensionReader(r io.Reader) *extensionReader {
+	var er *extensionReader
+	for i := len(c.extensions) - 1; i >= 0; i-- {
+		ext := c.extensions[i]
+		if c.readRSV&ext.RSV() == 0 {
+			continue
+		}
+		if er == nil {
+			er = &extensionReader{}
+		}
+		rc := ext.NewReader(r, c.readRSV)
+		er.readers = append(er.readers, rc)
+		r = rc
+	}
+	if er != nil {
+		er.Reader = r
+	}
+	return er
+}
+
+// extensionReader reads a message through the readers of the extensions that
+// apply to it.
+type extensionReader struct {
+	io.Reader
+	readers []io.ReadCloser // innermost first
+}
+
+// Close closes the readers of the extensions, starting with the outermost.
+func (r *extensionReader) Close() error {
+	var err error
+	for i := len(r.readers) - 1; i >= 0; i-- {
+		if e := r.readers[i].Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// keepsContext reports whether a reader must consume the rest of the message
+// on Close to stay in sync with the peer.
+func (r *extensionReader) keepsContext() bool {
+	for _, rc := range r.readers {
+		if _, ok := rc.(*flateContextReadWrapper); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,272 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package websocket
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
+)
+
+// xorExtension is a test extension that XORs message payloads with a key
+// negotiated in the handshake.
+type xorExtension struct {
+	name string
+	rsv  byte
+	key  byte
+}
+
+func (e xorExtension) Name() string { return e.name }
+
+func (e xorExtension) Offer() string { return fmt.Sprintf("%s; key=%d", e.name, e.key) }
+
+func (e xorExtension) Accept(params map[string]string) (string, NegotiatedExtension, bool) {
+	key, err := strconv.ParseUint(params["key"], 10, 8)
+	if err != nil {
+		return "", nil, false
+	}
+	return fmt.Sprintf("%s; key=%d", e.name, key), xorNegotiated{e.rsv, byte(key)}, true
+}
+
+func (e xorExtension) Confirm(params map[string]string) (NegotiatedExtension, error) {
+	key, err := strconv.ParseUint(params["key"], 10, 8)
+	if err != nil || byte(key) != e.key {
+		return nil, errors.New("bad key")
+	}
+	return xorNegotiated{e.rsv, e.key}, nil
+}
+
+type xorNegotiated struct {
+	rsv byte
+	key byte
+}
+
+func (e xorNegotiated) RSV() byte { return e.rsv }
+
+func (e xorNegotiated) NewReader(r io.Reader, rsv byte) io.ReadCloser {
+	return &xorReader{r, e.key}
+}
+
+func (e xorNegotiated) NewWriter(w io.WriteCloser, messageType int) (io.WriteCloser, byte) {
+	return &xorWriter{w, e.key}, e.rsv
+}
+
+type xorReader struct {
+	r   io.Reader
+	key byte
+}
+
+func (r *xorReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	for i := range p[:n] {
+		p[i] ^= r.key
+	}
+	return n, err
+}
+
+func (r *xorReader) Close() error { return nil }
+
+type xorWriter struct {
+	w   io.WriteCloser
+	key byte
+}
+
+func (w *xorWriter) Write(p []byte) (int, error) {
+	q := make([]byte, len(p))
+	for i, b := range p {
+		q[i] = b ^ w.key
+	}
+	return w.w.Write(q)
+}
+
+func (w *xorWriter) Close() error { return w.w.Close() }
+
+func TestNegotiateExtensions(t *testing.T) {
+	xor := xorExtension{name: "x-xor", rsv: RSV2}
+	other := xorExtension{name: "x-other", rsv: RSV2}
+	deflate := deflateExtension{server: &HertzUpgrader{}}
+	tests := []struct {
+		offer      string
+		extensions []Extension
+		resp       string
+		n          int
+	}{
+		{"", []Extension{xor}, "", 0},
+		{"x-xor; key=1", nil, "", 0},
+		{"x-xor; key=1", []Extension{xor}, "x-xor; key=1", 1},
+		{"X-XOR; key=1", []Extension{xor}, "x-xor; key=1", 1},
+		{"x-xor", []Extension{xor}, "", 0},
+		{"x-xor; key=1, x-xor; key=2", []Extension{xor}, "x-xor; key=1", 1},
+		{"x-xor; key=300, x-xor; key=2", []Extension{xor}, "x-xor; key=2", 1},
+		{"x-xor; key=1, permessage-deflate", []Extension{deflate, xor}, "x-xor; key=1, permessage-deflate; server_no_context_takeover; client_no_context_takeover", 2},
+		{"x-other; key=1, x-xor; key=2", []Extension{xor, other}, "x-other; key=1", 1},
+		{"unknown, x-xor; key=1", []Extension{xor}, "x-xor; key=1", 1},
+	}
+	for _, tt := range tests {
+		resp, negotiated := negotiateExtensions([]byte(tt.offer), tt.extensions)
+		if resp != tt.resp || len(negotiated) != tt.n {
+			t.Errorf("negotiateExtensions(%q) = %q, %d extensions, want %q, %d", tt.offer, resp, len(negotiated), tt.resp, tt.n)
+		}
+	}
+}
+
+func TestConfirmExtensions(t *testing.T) {
+	xor := xorExtension{name: "x-xor", rsv: RSV2, key: 1}
+	other := xorExtension{name: "x-other", rsv: RSV2, key: 1}
+	deflate := deflateExtension{client: &ClientUpgrader{}}
+	const offer = "permessage-deflate, x-xor; key=1, X-Other; key=1, unknown"
+	tests := []struct {
+		offer string
+		resp  string
+		n     int
+		ok    bool
+	}{
+		{offer, "", 0, true},
+		{offer, "x-xor; key=1", 1, true},
+		{offer, "x-xor; key=1, permessage-deflate", 2, true},
+		{offer, "unknown, x-xor; key=1", 1, true},
+		{offer, "x-xor; key=2", 0, false},
+		{offer, "x-xor; key=1, x-xor; key=1", 0, false},
+		{offer, "x-xor; key=1, x-other; key=1", 0, false},
+		{offer, "; key=1", 0, false},
+		{"x-xor; key=1", "permessage-deflate", 0, false},
+		{"x-xor; key=1", "x-xor; key=1, unknown", 0, false},
+		{"", "x-xor; key=1", 0, false},
+	}
+	for _, tt := range tests {
+		negotiated, err := confirmExtensions([]byte(tt.offer), []byte(tt.resp), []Extension{deflate, xor, other})
+		if (err == nil) != tt.ok || len(negotiated) != tt.n {
+			t.Errorf("confirmExtensions(%q, %q) = %d extensions, %v, want %d, ok=%v", tt.offer, tt.resp, len(negotiated), err, tt.n, tt.ok)
+		}
+	}
+
+	// An extension the client did not offer fails the handshake.
+	_, err := confirmExtensions([]byte("x-xor; key=1"), []byte("permessage-deflate"), []Extension{deflate, xor})
+	if !errors.Is(err, ErrBadHandshake) {
+		t.Errorf("confirmExtensions() returned %v, want ErrBadHandshake", err)
+	}
+}
+
+func TestExtensionReadWrite(t *testing.T) {
+	xor := xorNegotiated{RSV2, 0x5a}
+	for _, compress := range []bool{false, true} {
+		config := ConnConfig{IsServer: true, Extensions: []NegotiatedExtension{xor}}
+		if compress {
+			config.Compression = &CompressionParams{}
+		}
+		var connBuf bytes.Buffer
+		wc := NewConn(fakeNetConn{Writer: &connBuf}, config)
+		messages := textMessages(10)
+		for _, m := range messages {
+			if err := wc.WriteMessage(TextMessage, m); err != nil {
+				t.Fatalf("compress=%v: WriteMessage() returned %v", compress, err)
+			}
+		}
+		if err := wc.WriteControl(PingMessage, []byte("ping"), time.Time{}); err != nil {
+			t.Fatalf("compress=%v: WriteControl() returned %v", compress, err)
+		}
+		raw := connBuf.Bytes()
+
+		// The frames are marked with the reserved bits of the extensions.
+		fc := newTestConn(bytes.NewReader(raw), nil, false)
+		for i := range messages {
+			f, err := fc.NextFrame()
+			if err != nil {
+				t.Fatalf("compress=%v: NextFrame() returned %v", compress, err)
+			}
+			if !f.Rsv2 || f.Rsv1 != compress || f.Rsv3 {
+				t.Errorf("compress=%v: frame %d has rsv %v %v %v", compress, i, f.Rsv1, f.Rsv2, f.Rsv3)
+			}
+			if bytes.Equal(f.Payload, messages[i]) {
+				t.Errorf("compress=%v: frame %d not transformed", compress, i)
+			}
+		}
+		if f, err := fc.NextFrame(); err != nil || f.Rsv1 || f.Rsv2 || string(f.Payload) != "ping" {
+			t.Errorf("compress=%v: control frame = %+v, %v", compress, f, err)
+		}
+
+		config.IsServer = false
+		rc := NewConn(fakeNetConn{Reader: bytes.NewReader(raw), Writer: ioutil.Discard}, config)
+		for i, m := range messages {
+			_, p, err := rc.ReadMessage()
+			if err != nil || !bytes.Equal(p, m) {
+				t.Fatalf("compress=%v: message %d = %q, %v, want %q", compress, i, p, err, m)
+			}
+		}
+	}
+}
+
+func TestExtensionRejectsUnknownRSV(t *testing.T) {
+	var connBuf bytes.Buffer
+	wc := newTestConn(nil, &connBuf, true)
+	wc.setExtensions([]NegotiatedExtension{xorNegotiated{RSV2, 1}})
+	wc.WriteMessage(BinaryMessage, []byte("hello"))
+
+	rc := newTestConn(&connBuf, &bytes.Buffer{}, false)
+	rc.setExtensions([]NegotiatedExtension{xorNegotiated{RSV3, 1}})
+	if _, _, err := rc.NextReader(); err == nil {
+		t.Fatal("NextReader() accepted a frame with an unknown reserved bit")
+	}
+}
+
+func TestUpgradeExtensions(t *testing.T) {
+	addr := freeAddr()
+	runServerWithUpgrader(addr, &HertzUpgrader{
+		EnableCompression: true,
+		Extensions:        []Extension{xorExtension{name: "x-xor", rsv: RSV2}},
+	})
+	time.Sleep(50 * time.Millisecond) // await server running
+
+	conn, err := dialTestServer(addr, &ClientUpgrader{
+		EnableCompression: true,
+		Extensions:        []Extension{xorExtension{name: "x-xor", rsv: RSV2, key: 42}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if len(conn.extensions) != 2 || conn.deflate == nil || conn.extensionRSV != RSV1|RSV2 {
+		t.Fatalf("negotiated %d extensions with rsv %#x", len(conn.extensions), conn.extensionRSV)
+	}
+	for _, m := range textMessages(10) {
+		if err := conn.WriteMessage(TextMessage, m); err != nil {
+			t.Fatal(err)
+		}
+		_, p, err := conn.ReadMessage()
+		if err != nil || !bytes.Equal(p, m) {
+			t.Fatalf("ReadMessage() = %q, %v, want %q", p, err, m)
+		}
+	}
+}
+
+func TestUpgradeApplicationExtensionsHeader(t *testing.T) {
+	u := HertzUpgrader{
+		EnableCompression: true,
+		Extensions:        []Extension{xorExtension{name: "x-xor", rsv: RSV2}},
+	}
+	ctx := newUpgradeRequestContext()
+	ctx.Request.Header.Set("Sec-WebSocket-Extensions", "permessage-deflate, x-xor; key=1")
+	ctx.Response.Header.Set("Sec-WebSocket-Extensions", "x-app")
+	if err := u.Upgrade(ctx, func(*Conn) {}); err != nil {
+		t.Fatalf("Upgrade() returned %v", err)
+	}
+	if ctx.Response.StatusCode() != consts.StatusSwitchingProtocols {
+		t.Errorf("status = %d, want %d", ctx.Response.StatusCode(), consts.StatusSwitchingProtocols)
+	}
+	if got := string(ctx.Response.Header.Peek("Sec-WebSocket-Extensions")); got != "x-app" {
+		t.Errorf("Sec-WebSocket-Extensions = %q, want %q", got, "x-app")
+	}
+}
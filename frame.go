@@ -0,0 +1,197 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package websocket
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+)
+
+// ContinuationFrame is the opcode of a frame that continues a fragmented
+// message.
+const ContinuationFrame = continuationFrame
+
+// Frame is a single WebSocket frame as defined in RFC 6455, section 5.2.
+type Frame struct {
+	// Opcode is the frame opcode: ContinuationFrame, TextMessage,
+	// BinaryMessage, CloseMessage, PingMessage or PongMessage.
+	Opcode int
+
+	// Fin reports whether the frame is the final fragment of a message.
+	Fin bool
+
+	// Rsv1, Rsv2 and Rsv3 are the bits reserved for extensions.
+	Rsv1, Rsv2, Rsv3 bool
+
+	// Payload is the unmasked frame payload.
+	Payload []byte
+}
+
+// NextFrame returns the next frame received from the peer. Unlike
+// NextReader, NextFrame does not reassemble fragmented messages, does not
+// decompress payloads and does not call the ping, pong and close handlers.
+// Reserved bits and opcodes are returned as received so that the application
+// can implement extensions; only the masking and the control frame rules of
+// RFC 6455 are checked. The read limit applies to the payload of each frame.
+// Received pongs still answer Ping and keepalive pings, and the frames are
+// counted by Stats.
+//
+// The application must not mix NextFrame with the other read methods within
+// a message. Errors returned from this method are permanent.
+func (c *Conn) NextFrame() (Frame, error) {
+	c.readSem <- struct{}{}
+	defer func() { <-c.readSem }()
+
+	c.reader = nil
+	c.messageReader = nil
+
+	if c.readErr != nil {
+		return Frame{}, c.readErr
+	}
+	f, err := c.readFrame()
+	if err != nil {
+		c.setReadErr(err)
+		return Frame{}, c.readErr
+	}
+	return f, nil
+}
+
+func (c *Conn) readFrame() (Frame, error) {
+	if c.readRemaining > 0 {
+		if _, err := io.CopyN(ioutil.Discard, c.br, c.readRemaining); err != nil {
+			return Frame{}, err
+		}
+		c.setReadRemaining(0)
+	}
+
+	p, err := c.read(2)
+	if err != nil {
+		return Frame{}, err
+	}
+	f := Frame{
+		Opcode: int(p[0] & 0xf),
+		Fin:    p[0]&finalBit != 0,
+		Rsv1:   p[0]&rsv1Bit != 0,
+		Rsv2:   p[0]&rsv2Bit != 0,
+		Rsv3:   p[0]&rsv3Bit != 0,
+	}
+	mask := p[1]&maskBit != 0
+	headerSize := frameHeaderSize(p[1])
+	c.setReadRemaining(int64(p[1] & 0x7f))
+
+	if mask != c.isServer {
+		return Frame{}, c.handleProtocolError("bad MASK")
+	}
+	if isControl(f.Opcode) {
+		if c.readRemaining > maxControlFramePayloadSize {
+			return Frame{}, c.handleProtocolError("len > 125 for control")
+		}
+		if !f.Fin {
+			return Frame{}, c.handleProtocolError("FIN not set on control")
+		}
+	}
+
+	if err := c.readFrameLength(mask); err != nil {
+		return Frame{}, err
+	}
+	c.stats.frameRead(f.Opcode, int64(headerSize)+c.readRemaining)
+	if c.readLimit > 0 && c.readRemaining > c.readLimit {
+		c.WriteControl(CloseMessage, FormatCloseMessage(CloseMessageTooBig, ""), time.Now().Add(writeWait))
+		return Frame{}, ErrReadLimit
+	}
+
+	f.Payload = make([]byte, c.readRemaining)
+	if _, err := io.ReadFull(c.br, f.Payload); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = errUnexpectedEOF
+		}
+		return Frame{}, err
+	}
+	c.setReadRemaining(0)
+	if mask {
+		maskBytes(c.readMaskKey, 0, f.Payload)
+	}
+
+	switch f.Opcode {
+	case TextMessage, BinaryMessage, continuationFrame:
+		c.readFinal = f.Fin
+	case PongMessage:
+		c.pong(string(f.Payload))
+	case CloseMessage:
+		c.setState(StateClosing)
+	}
+	return f, nil
+}
+
+// WriteFrame writes a single frame to the peer. The payload is masked if the
+// connection is a client; f.Payload is not modified.
+//
+// WriteFrame does not check that the frames form valid messages or that the
+// reserved bits were negotiated. The application must not mix WriteFrame
+// with the other write methods within a message.
+func (c *Conn) WriteFrame(f Frame) error {
+	if f.Opcode < 0 || f.Opcode > 0xf {
+		return errBadWriteOpCode
+	}
+	if isControl(f.Opcode) && (!f.Fin || len(f.Payload) > maxControlFramePayloadSize) {
+		return errInvalidControlFrame
+	}
+
+	b0 := byte(f.Opcode)
+	if f.Fin {
+		b0 |= finalBit
+	}
+	if f.Rsv1 {
+		b0 |= rsv1Bit
+	}
+	if f.Rsv2 {
+		b0 |= rsv2Bit
+	}
+	if f.Rsv3 {
+		b0 |= rsv3Bit
+	}
+	b1 := byte(0)
+	if !c.isServer {
+		b1 |= maskBit
+	}
+
+	header := make([]byte, 2, maxFrameHeaderSize)
+	header[0] = b0
+	switch length := len(f.Payload); {
+	case length >= 65536:
+		header[1] = b1 | 127
+		header = append(header, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	case length > 125:
+		header[1] = b1 | 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header[1] = b1 | byte(length)
+	}
+
+	payload := f.Payload
+	if !c.isServer {
+		key := newMaskKey()
+		header = append(header, key[:]...)
+		payload = make([]byte, len(f.Payload))
+		copy(payload, f.Payload)
+		maskBytes(key, 0, payload)
+	}
+
+	if err := c.write(f.Opcode, c.writeDeadline, header, payload); err != nil {
+		return err
+	}
+	if f.Fin && !isControl(f.Opcode) {
+		atomic.AddInt64(&c.stats.messagesWritten, 1)
+	}
+	return nil
+}
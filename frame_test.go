@@ -0,0 +1,119 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package websocket
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	frames := []Frame{
+		{Opcode: TextMessage, Payload: []byte("hel")},
+		{Opcode: PingMessage, Fin: true, Payload: []byte("ping")},
+		{Opcode: ContinuationFrame, Fin: true, Payload: []byte("lo")},
+		{Opcode: BinaryMessage, Fin: true, Rsv2: true, Rsv3: true, Payload: make([]byte, 126)},
+		{Opcode: BinaryMessage, Fin: true, Rsv1: true, Payload: bytes.Repeat([]byte("x"), 65536)},
+		{Opcode: 3, Fin: true, Payload: []byte{}},
+		{Opcode: CloseMessage, Fin: true, Payload: FormatCloseMessage(CloseNormalClosure, "bye")},
+	}
+	for _, isServer := range []bool{false, true} {
+		var buf bytes.Buffer
+		wc := newTestConn(nil, &buf, isServer)
+		rc := newTestConn(&buf, nil, !isServer)
+		for _, f := range frames {
+			payload := append([]byte(nil), f.Payload...)
+			if err := wc.WriteFrame(f); err != nil {
+				t.Fatalf("server=%v: WriteFrame(%d) returned %v", isServer, f.Opcode, err)
+			}
+			if !bytes.Equal(f.Payload, payload) {
+				t.Fatalf("server=%v: WriteFrame(%d) modified the payload", isServer, f.Opcode)
+			}
+		}
+		if err := wc.WriteFrame(Frame{Opcode: TextMessage, Fin: true}); err != ErrCloseSent {
+			t.Errorf("server=%v: WriteFrame() after close returned %v, want %v", isServer, err, ErrCloseSent)
+		}
+		for _, want := range frames {
+			f, err := rc.NextFrame()
+			if err != nil {
+				t.Fatalf("server=%v: NextFrame() returned %v", isServer, err)
+			}
+			if !reflect.DeepEqual(f, want) {
+				t.Fatalf("server=%v: NextFrame() = {%d %v %d bytes}, want {%d %v %d bytes}",
+					isServer, f.Opcode, f.Fin, len(f.Payload), want.Opcode, want.Fin, len(want.Payload))
+			}
+		}
+		if s := rc.State(); s != StateClosing {
+			t.Errorf("server=%v: State() after close frame = %v, want %v", isServer, s, StateClosing)
+		}
+	}
+}
+
+func TestFramesToMessages(t *testing.T) {
+	var buf bytes.Buffer
+	wc := newTestConn(nil, &buf, false)
+	rc := newTestConn(&buf, nil, true)
+
+	var pings []string
+	rc.SetPingHandler(func(s string) error {
+		pings = append(pings, s)
+		return nil
+	})
+	wc.WriteFrame(Frame{Opcode: TextMessage, Payload: []byte("hel")})
+	wc.WriteFrame(Frame{Opcode: PingMessage, Fin: true, Payload: []byte("ping")})
+	wc.WriteFrame(Frame{Opcode: ContinuationFrame, Fin: true, Payload: []byte("lo")})
+	if _, p, err := rc.ReadMessage(); err != nil || string(p) != "hello" {
+		t.Fatalf("ReadMessage() = %q, %v, want %q", p, err, "hello")
+	}
+	if len(pings) != 1 || pings[0] != "ping" {
+		t.Errorf("pings = %q, want [ping]", pings)
+	}
+
+	// Compressed messages are returned with RSV1 set.
+	wc.setCompression(CompressionParams{ServerNoContextTakeover: true, ClientNoContextTakeover: true})
+	wc.WriteMessage(TextMessage, []byte(strings.Repeat("hello", 100)))
+	f, err := rc.NextFrame()
+	if err != nil || f.Opcode != TextMessage || !f.Fin || !f.Rsv1 || len(f.Payload) >= 500 {
+		t.Errorf("NextFrame() = {%d %v %v %d bytes}, %v, want compressed text frame", f.Opcode, f.Fin, f.Rsv1, len(f.Payload), err)
+	}
+}
+
+func TestFrameErrors(t *testing.T) {
+	var buf bytes.Buffer
+	wc := newTestConn(nil, &buf, true)
+	for _, f := range []Frame{
+		{Opcode: PingMessage, Payload: []byte("not final")},
+		{Opcode: PongMessage, Fin: true, Payload: make([]byte, 126)},
+	} {
+		if err := wc.WriteFrame(f); err != errInvalidControlFrame {
+			t.Errorf("WriteFrame(%d) returned %v, want %v", f.Opcode, err, errInvalidControlFrame)
+		}
+	}
+	if err := wc.WriteFrame(Frame{Opcode: 16, Fin: true}); err != errBadWriteOpCode {
+		t.Errorf("WriteFrame(16) returned %v, want %v", err, errBadWriteOpCode)
+	}
+
+	// A server expects masked frames.
+	wc.WriteFrame(Frame{Opcode: TextMessage, Fin: true, Payload: []byte("hello")})
+	rc := newTestConn(&buf, &bytes.Buffer{}, true)
+	if _, err := rc.NextFrame(); err == nil || !strings.Contains(err.Error(), "bad MASK") {
+		t.Errorf("NextFrame() returned %v, want bad MASK error", err)
+	}
+
+	wc.WriteFrame(Frame{Opcode: TextMessage, Fin: true, Payload: []byte("hello")})
+	rc = newTestConn(&buf, &bytes.Buffer{}, false)
+	rc.SetReadLimit(4)
+	if _, err := rc.NextFrame(); err != ErrReadLimit {
+		t.Errorf("NextFrame() returned %v, want %v", err, ErrReadLimit)
+	}
+	if _, err := rc.NextFrame(); err != ErrReadLimit {
+		t.Errorf("NextFrame() after error returned %v, want %v", err, ErrReadLimit)
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package hub
+
+import (
+	"sync"
+)
+
+// BrokerHandler receives the messages delivered by a broker.
+type BrokerHandler func(topic string, messageType int, data []byte)
+
+// Broker relays published messages between the nodes of a cluster. A hub
+// configured with a broker publishes through the broker and delivers the
+// messages the broker relays to its local subscribers, so a message
+// published on one node reaches the subscribers connected to any node.
+//
+// Topics and patterns use the syntax described in the package
+// documentation. Implementations must be safe for concurrent use.
+type Broker interface {
+	// Publish sends a message to the subscribers of topic on all nodes,
+	// including the publishing node.
+	Publish(topic string, messageType int, data []byte) error
+
+	// Subscribe calls handler for each message published to a topic
+	// matching pattern until the subscription is canceled. Handlers may be
+	// called concurrently and should not block; they must not modify the
+	// data.
+	Subscribe(pattern string, handler BrokerHandler) (Subscription, error)
+
+	// Close releases the resources of the broker.
+	Close() error
+}
+
+// Subscription is a subscription to a broker.
+type Subscription interface {
+	// Unsubscribe cancels the subscription.
+	Unsubscribe() error
+}
+
+// subscription is the Subscription of the brokers in this package.
+type subscription struct {
+	pattern string
+	handler BrokerHandler
+	cancel  func(*subscription)
+	once    sync.Once
+}
+
+func (s *subscription) Unsubscribe() error {
+	s.once.Do(func() { s.cancel(s) })
+	return nil
+}
+
+// MemoryBroker is a Broker for the hubs of a single process, for example to
+// test a cluster of hubs without a network.
+type MemoryBroker struct {
+	mu     sync.RWMutex
+	subs   map[*subscription]struct{}
+	closed bool
+}
+
+// NewMemoryBroker returns a broker without subscriptions.
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{subs: make(map[*subscription]struct{})}
+}
+
+// Publish calls the handlers of the subscriptions matching topic before it
+// returns.
+func (b *MemoryBroker) Publish(topic string, messageType int, data []byte) error {
+	if wildcard, err := parsePattern(topic); err != nil || wildcard {
+		return ErrInvalidPattern
+	}
+	b.mu.RLock()
+	if b.closed {
+		b.mu.RUnlock()
+		return ErrClosed
+	}
+	var handlers []BrokerHandler
+	for s := range b.subs {
+		if match(s.pattern, topic) {
+			handlers = append(handlers, s.handler)
+		}
+	}
+	b.mu.RUnlock()
+
+	for _, h := range handlers {
+		h(topic, messageType, data)
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Subscribe(pattern string, handler BrokerHandler) (Subscription, error) {
+	if _, err := parsePattern(pattern); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrClosed
+	}
+	s := &subscription{pattern: pattern, handler: handler, cancel: b.unsubscribe}
+	b.subs[s] = struct{}{}
+	return s, nil
+}
+
+func (b *MemoryBroker) unsubscribe(s *subscription) {
+	b.mu.Lock()
+	delete(b.subs, s)
+	b.mu.Unlock()
+}
+
+// Close cancels all subscriptions.
+func (b *MemoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	b.closed = true
+	b.subs = nil
+	return nil
+}
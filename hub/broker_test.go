@@ -0,0 +1,279 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package hub
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/hertz-contrib/websocket"
+)
+
+type brokerMessage struct {
+	topic string
+	data  string
+}
+
+func collect(ch chan brokerMessage) BrokerHandler {
+	return func(topic string, messageType int, data []byte) {
+		ch <- brokerMessage{topic, string(data)}
+	}
+}
+
+func receive(t *testing.T, ch chan brokerMessage) brokerMessage {
+	t.Helper()
+	select {
+	case m := <-ch:
+		return m
+	case <-time.After(time.Second):
+		t.Fatal("no message received")
+		return brokerMessage{}
+	}
+}
+
+func expectNone(t *testing.T, ch chan brokerMessage) {
+	t.Helper()
+	select {
+	case m := <-ch:
+		t.Fatalf("unexpected message %+v", m)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+// testBroker checks a broker for each of two nodes of a cluster.
+func testBroker(t *testing.T, b1, b2 Broker) {
+	ch1 := make(chan brokerMessage, 10)
+	ch2 := make(chan brokerMessage, 10)
+	sub1, err := b1.Subscribe("news.*", collect(ch1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b2.Subscribe("news.>", collect(ch2)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b1.Subscribe("news..", collect(ch1)); err != ErrInvalidPattern {
+		t.Errorf("Subscribe() returned %v, want %v", err, ErrInvalidPattern)
+	}
+
+	if err := b1.Publish("news.sports", websocket.TextMessage, []byte("goal")); err != nil {
+		t.Fatal(err)
+	}
+	if m := receive(t, ch1); m != (brokerMessage{"news.sports", "goal"}) {
+		t.Errorf("node 1 received %+v", m)
+	}
+	if m := receive(t, ch2); m != (brokerMessage{"news.sports", "goal"}) {
+		t.Errorf("node 2 received %+v", m)
+	}
+
+	b2.Publish("news.sports.live", websocket.TextMessage, []byte("live"))
+	if m := receive(t, ch2); m.data != "live" {
+		t.Errorf("node 2 received %+v", m)
+	}
+	expectNone(t, ch1)
+
+	sub1.Unsubscribe()
+	b2.Publish("news.weather", websocket.TextMessage, []byte("rain"))
+	if m := receive(t, ch2); m.data != "rain" {
+		t.Errorf("node 2 received %+v", m)
+	}
+	expectNone(t, ch1)
+}
+
+func TestMemoryBroker(t *testing.T) {
+	b := NewMemoryBroker()
+	testBroker(t, b, b)
+	b.Close()
+	if err := b.Publish("news.x", websocket.TextMessage, nil); err != ErrClosed {
+		t.Errorf("Publish() after Close returned %v, want %v", err, ErrClosed)
+	}
+}
+
+func newTestBrokerServer(t *testing.T) *BrokerServer {
+	s, err := ListenBroker("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func dialTestBroker(t *testing.T, s *BrokerServer) *TCPBroker {
+	b, err := DialBroker(s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func TestTCPBroker(t *testing.T) {
+	s := newTestBrokerServer(t)
+	testBroker(t, dialTestBroker(t, s), dialTestBroker(t, s))
+}
+
+func TestTCPBrokerServerClose(t *testing.T) {
+	s := newTestBrokerServer(t)
+	b := dialTestBroker(t, s)
+	s.Close()
+	<-b.done
+	if err := b.Publish("x", websocket.TextMessage, nil); err == nil {
+		t.Error("Publish() succeeded after the server closed")
+	}
+	if err := b.Close(); err != nil {
+		t.Errorf("Close() returned %v", err)
+	}
+	if err := b.Close(); err != ErrClosed {
+		t.Errorf("second Close() returned %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestTCPBrokerSubscribeWhileRelaying(t *testing.T) {
+	s := newTestBrokerServer(t)
+	b := dialTestBroker(t, s)
+
+	// The handler stalls the reader until release is closed, so the server
+	// blocks relaying the node's own messages back to it and the node
+	// blocks publishing them.
+	const n = 32
+	release := make(chan struct{})
+	received := make(chan struct{}, n)
+	if _, err := b.Subscribe("a", func(topic string, messageType int, data []byte) {
+		<-release
+		received <- struct{}{}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		data := make([]byte, 1<<20)
+		for i := 0; i < n; i++ {
+			if err := b.Publish("a", websocket.BinaryMessage, data); err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(50 * time.Millisecond) // await the publishes blocking
+
+	subscribed := make(chan error, 1)
+	go func() {
+		_, err := b.Subscribe("b", collect(make(chan brokerMessage)))
+		subscribed <- err
+	}()
+	time.Sleep(20 * time.Millisecond) // await Subscribe blocking
+	close(release)
+
+	timeout := time.After(5 * time.Second)
+	for i := 0; i < n; i++ {
+		select {
+		case <-received:
+		case <-timeout:
+			t.Fatalf("received %d of %d messages", i, n)
+		}
+	}
+	select {
+	case err := <-subscribed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-timeout:
+		t.Fatal("Subscribe did not return")
+	}
+}
+
+func TestHubCluster(t *testing.T) {
+	s := newTestBrokerServer(t)
+	h1 := New(Config{Broker: dialTestBroker(t, s)})
+	h2 := New(Config{Broker: dialTestBroker(t, s)})
+	defer h1.Close()
+	defer h2.Close()
+
+	s1, c1 := newSubscriber(t)
+	s2, c2 := newSubscriber(t)
+	h1.Subscribe(s1, "rooms.lobby")
+	h2.Subscribe(s2, "rooms.*")
+	// A connection subscribed with two matching patterns receives a message
+	// once.
+	h2.Subscribe(s2, "rooms.>")
+
+	// A message published on one node reaches the subscribers of both.
+	if _, err := h1.Publish("rooms.lobby", websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, c1); got != "hello" {
+		t.Errorf("node 1 subscriber received %q", got)
+	}
+	if got := readString(t, c2); got != "hello" {
+		t.Errorf("node 2 subscriber received %q", got)
+	}
+	h1.Publish("rooms.lobby", websocket.TextMessage, []byte("again"))
+	if got := readString(t, c2); got != "again" {
+		t.Errorf("node 2 subscriber received %q", got)
+	}
+
+	// Prepared messages stay on the node.
+	pm, _ := websocket.NewPreparedMessage(websocket.TextMessage, []byte("local"))
+	if n, err := h2.PublishPrepared("rooms.lobby", pm); n != 1 || err != nil {
+		t.Errorf("PublishPrepared() = %d, %v, want 1", n, err)
+	}
+	if got := readString(t, c2); got != "local" {
+		t.Errorf("node 2 subscriber received %q", got)
+	}
+}
+
+func TestHubBrokerSubscribeError(t *testing.T) {
+	b := NewMemoryBroker()
+	b.Close()
+	h := New(Config{Broker: b})
+	s, _ := newSubscriber(t)
+	if err := h.Subscribe(s, "x"); err != ErrClosed {
+		t.Errorf("Subscribe() returned %v, want %v", err, ErrClosed)
+	}
+	if _, err := h.Publish("x", websocket.TextMessage, nil); err != ErrClosed {
+		t.Errorf("Publish() returned %v, want %v", err, ErrClosed)
+	}
+}
+
+// brokerPatterns returns the patterns subscribed to on b.
+func brokerPatterns(b *MemoryBroker) []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	var patterns []string
+	for s := range b.subs {
+		patterns = append(patterns, s.pattern)
+	}
+	sort.Strings(patterns)
+	return patterns
+}
+
+func TestHubBrokerPatterns(t *testing.T) {
+	b := NewMemoryBroker()
+	h := New(Config{Broker: b})
+	s1, _ := newSubscriber(t)
+	s2, _ := newSubscriber(t)
+
+	// The hub subscribes to each pattern with local subscribers once.
+	h.Subscribe(s1, "a")
+	h.Subscribe(s2, "a")
+	h.Subscribe(s1, "b.*")
+	if got, want := brokerPatterns(b), []string{"a", "b.*"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("broker patterns = %q, want %q", got, want)
+	}
+	h.Unsubscribe(s1, "a")
+	if got, want := brokerPatterns(b), []string{"a", "b.*"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("broker patterns after Unsubscribe = %q, want %q", got, want)
+	}
+	h.Leave(s2)
+	if got, want := brokerPatterns(b), []string{"b.*"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("broker patterns after Leave = %q, want %q", got, want)
+	}
+	h.Close()
+	if got := brokerPatterns(b); len(got) != 0 {
+		t.Errorf("broker patterns after Close = %q", got)
+	}
+}
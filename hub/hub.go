@@ -0,0 +1,460 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+// Package hub implements publish/subscribe fan-out of messages to WebSocket
+// connections.
+//
+// Connections subscribe to topics or topic patterns. Topics are made of
+// segments separated by dots, such as "rooms.lobby". In a pattern, the
+// segment "*" matches any one segment and a final segment ">" matches one or
+// more segments: "rooms.*" matches "rooms.lobby" and "rooms.>" matches
+// "rooms.lobby" and "rooms.lobby.typing".
+//
+// Published messages are encoded once with websocket.NewPreparedMessage and
+// written to each subscriber through the connection's write queue, so a slow
+// subscriber never blocks the others.
+//
+// Hubs on several nodes form a cluster through a Broker: MemoryBroker
+// connects the hubs of one process and DialBroker connects hubs to a
+// BrokerServer over TCP.
+package hub
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/hertz-contrib/websocket"
+)
+
+// ErrClosed is returned by the methods of a hub or broker that is closed.
+var ErrClosed = errors.New("hub: closed")
+
+// ErrInvalidPattern is returned for malformed topics and patterns.
+var ErrInvalidPattern = errors.New("hub: invalid topic pattern")
+
+// Config specifies the options of a hub.
+type Config struct {
+	// Queue configures the write queue the hub enables on a connection when
+	// it first subscribes. Queue.Overflow is the eviction policy for slow
+	// subscribers: websocket.OverflowDropOldest or OverflowDropNewest drop
+	// messages and websocket.OverflowClose disconnects the subscriber. A slow
+	// subscriber must not hold up Publish, so websocket.OverflowBlock, the
+	// zero value, is replaced with OverflowDropOldest. The queue of a
+	// connection on which the application already enabled one is used as
+	// is.
+	Queue websocket.WriteQueueConfig
+
+	// Broker, if not nil, relays the published messages to the hubs on all
+	// nodes of a cluster. The hub subscribes to each pattern of the broker
+	// while it has local subscribers to the pattern, so a node only
+	// receives the messages it delivers. The hub does not close the broker.
+	Broker Broker
+}
+
+// Hub delivers published messages to the connections subscribed to their
+// topic. A Hub is safe for concurrent use.
+type Hub struct {
+	config Config
+
+	mu          sync.RWMutex
+	err         error                                   // ErrClosed once closed
+	exact       map[string]map[*websocket.Conn]struct{} // subscribers by topic
+	wildcard    map[string]map[*websocket.Conn]struct{} // subscribers by pattern
+	subscribers map[*websocket.Conn]map[string]struct{} // patterns by subscriber
+	closed      chan struct{}
+
+	// brokerMu serializes the changes to the broker subscriptions. It is
+	// not held by the broker handlers, which may be called while a change
+	// waits for the broker.
+	brokerMu   sync.Mutex
+	brokerSubs map[string]Subscription // by pattern
+}
+
+// New returns a hub with the given configuration.
+func New(config Config) *Hub {
+	if config.Queue.Overflow == websocket.OverflowBlock {
+		config.Queue.Overflow = websocket.OverflowDropOldest
+	}
+	h := &Hub{
+		config:      config,
+		exact:       make(map[string]map[*websocket.Conn]struct{}),
+		wildcard:    make(map[string]map[*websocket.Conn]struct{}),
+		subscribers: make(map[*websocket.Conn]map[string]struct{}),
+		closed:      make(chan struct{}),
+		brokerSubs:  make(map[string]Subscription),
+	}
+	return h
+}
+
+// syncBroker subscribes the hub to pattern on the broker while pattern has
+// local subscribers and unsubscribes it otherwise.
+func (h *Hub) syncBroker(pattern string) error {
+	if h.config.Broker == nil {
+		return nil
+	}
+	h.brokerMu.Lock()
+	defer h.brokerMu.Unlock()
+	h.mu.RLock()
+	wanted := h.err == nil && (h.exact[pattern] != nil || h.wildcard[pattern] != nil)
+	h.mu.RUnlock()
+	sub := h.brokerSubs[pattern]
+	switch {
+	case wanted && sub == nil:
+		sub, err := h.config.Broker.Subscribe(pattern, h.deliverer(pattern))
+		if err != nil {
+			return err
+		}
+		h.brokerSubs[pattern] = sub
+	case !wanted && sub != nil:
+		delete(h.brokerSubs, pattern)
+		return sub.Unsubscribe()
+	}
+	return nil
+}
+
+// deliverer returns the broker handler of pattern, which sends the messages
+// relayed by the broker to the local subscribers of pattern.
+func (h *Hub) deliverer(pattern string) BrokerHandler {
+	return func(topic string, messageType int, data []byte) {
+		conns := h.owners(pattern, topic)
+		if len(conns) == 0 {
+			return
+		}
+		if pm, err := websocket.NewPreparedMessage(messageType, data); err == nil {
+			h.send(conns, pm)
+		}
+	}
+}
+
+// owners returns the subscribers of pattern for which pattern is the least
+// of their patterns matching topic. The broker calls the handler of every
+// matching pattern, so a connection subscribed with several matching
+// patterns receives a message from the handler of one of them only.
+func (h *Hub) owners(pattern, topic string) []*websocket.Conn {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	set := h.exact[pattern]
+	if set == nil {
+		set = h.wildcard[pattern]
+	}
+	var conns []*websocket.Conn
+next:
+	for c := range set {
+		for p := range h.subscribers[c] {
+			if p < pattern && match(p, topic) {
+				continue next
+			}
+		}
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// parsePattern checks pattern and reports whether it contains wildcards.
+func parsePattern(pattern string) (wildcard bool, err error) {
+	segments := strings.Split(pattern, ".")
+	for i, s := range segments {
+		switch {
+		case s == "":
+			return false, ErrInvalidPattern
+		case s == "*":
+			wildcard = true
+		case s == ">" && i == len(segments)-1:
+			wildcard = true
+		case strings.ContainsAny(s, "*>"):
+			return false, ErrInvalidPattern
+		}
+	}
+	return wildcard, nil
+}
+
+// match reports whether topic matches pattern.
+func match(pattern, topic string) bool {
+	for {
+		p, prest, pmore := cut(pattern)
+		t, trest, tmore := cut(topic)
+		switch {
+		case p == ">":
+			return true
+		case p != "*" && p != t:
+			return false
+		case !pmore || !tmore:
+			return pmore == tmore
+		}
+		pattern, topic = prest, trest
+	}
+}
+
+func cut(s string) (before, after string, found bool) {
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		return s[:i], s[i+1:], true
+	}
+	return s, "", false
+}
+
+// Subscribe subscribes c to the topics matching pattern. The first
+// subscription of a connection enables its write queue; from then on, the
+// application must write to c only with the queue methods or WriteControl.
+//
+// With a Broker, Subscribe returns once the hub is subscribed to pattern on
+// the broker. If subscribing to the broker fails, c is not subscribed and
+// Subscribe returns the error.
+//
+// The application calls Leave when the connection's handler returns.
+func (h *Hub) Subscribe(c *websocket.Conn, pattern string) error {
+	wildcard, err := parsePattern(pattern)
+	if err != nil {
+		return err
+	}
+	if err := h.subscribe(c, pattern, wildcard); err != nil {
+		return err
+	}
+	if err := h.syncBroker(pattern); err != nil {
+		h.Unsubscribe(c, pattern)
+		return err
+	}
+	return nil
+}
+
+func (h *Hub) subscribe(c *websocket.Conn, pattern string, wildcard bool) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.err != nil {
+		return h.err
+	}
+	patterns := h.subscribers[c]
+	if patterns == nil {
+		c.EnableWriteQueue(h.config.Queue)
+		patterns = make(map[string]struct{})
+		h.subscribers[c] = patterns
+	}
+	patterns[pattern] = struct{}{}
+
+	index := h.exact
+	if wildcard {
+		index = h.wildcard
+	}
+	conns := index[pattern]
+	if conns == nil {
+		conns = make(map[*websocket.Conn]struct{})
+		index[pattern] = conns
+	}
+	conns[c] = struct{}{}
+	return nil
+}
+
+// Unsubscribe removes the subscription of c to pattern.
+func (h *Hub) Unsubscribe(c *websocket.Conn, pattern string) {
+	h.mu.Lock()
+	last := h.unsubscribe(c, pattern)
+	h.mu.Unlock()
+	if last {
+		h.syncBroker(pattern)
+	}
+}
+
+// unsubscribe removes the subscription of c to pattern and reports whether
+// it was the last subscription to pattern.
+func (h *Hub) unsubscribe(c *websocket.Conn, pattern string) (last bool) {
+	patterns := h.subscribers[c]
+	if _, ok := patterns[pattern]; !ok {
+		return false
+	}
+	delete(patterns, pattern)
+	if len(patterns) == 0 {
+		delete(h.subscribers, c)
+	}
+	for _, index := range []map[string]map[*websocket.Conn]struct{}{h.exact, h.wildcard} {
+		if conns := index[pattern]; conns != nil {
+			delete(conns, c)
+			if len(conns) == 0 {
+				delete(index, pattern)
+				last = true
+			}
+		}
+	}
+	return last
+}
+
+// Leave removes all subscriptions of c.
+func (h *Hub) Leave(c *websocket.Conn) {
+	h.mu.Lock()
+	released := h.leave(c)
+	h.mu.Unlock()
+	for _, pattern := range released {
+		h.syncBroker(pattern)
+	}
+}
+
+// leave removes all subscriptions of c and returns the patterns that have
+// no subscribers left.
+func (h *Hub) leave(c *websocket.Conn) (released []string) {
+	for pattern := range h.subscribers[c] {
+		if h.unsubscribe(c, pattern) {
+			released = append(released, pattern)
+		}
+	}
+	return released
+}
+
+// Subscriptions returns the patterns c is subscribed to.
+func (h *Hub) Subscriptions(c *websocket.Conn) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	patterns := make([]string, 0, len(h.subscribers[c]))
+	for pattern := range h.subscribers[c] {
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+// Publish sends a message to the connections subscribed to topic and
+// returns the number of connections it was queued to. A connection
+// subscribed with several matching patterns receives the message once.
+//
+// With a Broker, Publish hands the message to the broker and returns zero;
+// the message reaches the local subscribers when the broker relays it back.
+func (h *Hub) Publish(topic string, messageType int, data []byte) (int, error) {
+	if wildcard, err := parsePattern(topic); err != nil || wildcard {
+		return 0, ErrInvalidPattern
+	}
+	if h.config.Broker != nil {
+		h.mu.RLock()
+		err := h.err
+		h.mu.RUnlock()
+		if err != nil {
+			return 0, err
+		}
+		return 0, h.config.Broker.Publish(topic, messageType, data)
+	}
+	pm, err := websocket.NewPreparedMessage(messageType, data)
+	if err != nil {
+		return 0, err
+	}
+	return h.publishLocal(topic, pm)
+}
+
+// PublishPrepared is like Publish but sends a prepared message. The message
+// is sent to the subscribers connected to this hub only, even if the hub has
+// a Broker.
+func (h *Hub) PublishPrepared(topic string, pm *websocket.PreparedMessage) (int, error) {
+	if wildcard, err := parsePattern(topic); err != nil || wildcard {
+		return 0, ErrInvalidPattern
+	}
+	return h.publishLocal(topic, pm)
+}
+
+func (h *Hub) publishLocal(topic string, pm *websocket.PreparedMessage) (int, error) {
+	conns, err := h.match(topic)
+	if err != nil {
+		return 0, err
+	}
+	return h.send(conns, pm)
+}
+
+// send queues pm to conns and returns the number of connections it was
+// queued to. Connections that can no longer be written to leave the hub.
+func (h *Hub) send(conns []*websocket.Conn, pm *websocket.PreparedMessage) (int, error) {
+	var gone []*websocket.Conn
+	n := 0
+	for _, c := range conns {
+		select {
+		case <-h.closed:
+			return n, ErrClosed
+		default:
+		}
+		done := c.QueuePreparedMessage(pm)
+		select {
+		case err := <-done:
+			// The message was written already, dropped by the queue, or
+			// the connection can no longer be written to.
+			switch err {
+			case nil:
+				n++
+			case websocket.ErrWriteQueueFull:
+			default:
+				gone = append(gone, c)
+			}
+		default:
+			n++
+		}
+	}
+	if len(gone) > 0 {
+		var released []string
+		h.mu.Lock()
+		for _, c := range gone {
+			released = append(released, h.leave(c)...)
+		}
+		h.mu.Unlock()
+		if len(released) > 0 {
+			// send may run in a broker handler, which must not wait for
+			// the broker.
+			go func() {
+				for _, pattern := range released {
+					h.syncBroker(pattern)
+				}
+			}()
+		}
+	}
+	return n, nil
+}
+
+// match returns the subscribers of topic.
+func (h *Hub) match(topic string) ([]*websocket.Conn, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.err != nil {
+		return nil, h.err
+	}
+	var conns []*websocket.Conn
+	seen := make(map[*websocket.Conn]struct{})
+	add := func(set map[*websocket.Conn]struct{}) {
+		for c := range set {
+			if _, ok := seen[c]; !ok {
+				seen[c] = struct{}{}
+				conns = append(conns, c)
+			}
+		}
+	}
+	add(h.exact[topic])
+	for pattern, set := range h.wildcard {
+		if match(pattern, topic) {
+			add(set)
+		}
+	}
+	return conns, nil
+}
+
+// Close shuts the hub down: it removes all subscriptions and unsubscribes
+// from the broker. Publishes in progress stop queuing their message and
+// return ErrClosed; Close does not wait for a publish blocked on the full
+// queue of a connection whose application enabled the queue with
+// websocket.OverflowBlock. Messages already queued are still written. The
+// connections are not closed. Subsequent calls to Subscribe and Publish
+// return ErrClosed.
+func (h *Hub) Close() error {
+	h.mu.Lock()
+	if h.err == ErrClosed {
+		h.mu.Unlock()
+		return ErrClosed
+	}
+	h.err = ErrClosed
+	h.exact = make(map[string]map[*websocket.Conn]struct{})
+	h.wildcard = make(map[string]map[*websocket.Conn]struct{})
+	h.subscribers = make(map[*websocket.Conn]map[string]struct{})
+	close(h.closed)
+	h.mu.Unlock()
+
+	h.brokerMu.Lock()
+	for pattern, sub := range h.brokerSubs {
+		sub.Unsubscribe()
+		delete(h.brokerSubs, pattern)
+	}
+	h.brokerMu.Unlock()
+	return nil
+}
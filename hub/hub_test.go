@@ -0,0 +1,297 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package hub
+
+import (
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/hertz-contrib/websocket"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern, topic string
+		match          bool
+	}{
+		{"a", "a", true},
+		{"a", "b", false},
+		{"a.b", "a.b", true},
+		{"a.b", "a", false},
+		{"a", "a.b", false},
+		{"a.*", "a.b", true},
+		{"a.*", "a", false},
+		{"a.*", "a.b.c", false},
+		{"*.b", "a.b", true},
+		{"*.*", "a.b", true},
+		{"a.>", "a.b", true},
+		{"a.>", "a.b.c", true},
+		{"a.>", "a", false},
+		{">", "a.b", true},
+		{"a.*.c", "a.b.c", true},
+		{"a.*.c", "a.b.d", false},
+	}
+	for _, tt := range tests {
+		if got := match(tt.pattern, tt.topic); got != tt.match {
+			t.Errorf("match(%q, %q) = %v, want %v", tt.pattern, tt.topic, got, tt.match)
+		}
+	}
+}
+
+func TestParsePattern(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		wildcard bool
+		ok       bool
+	}{
+		{"a", false, true},
+		{"a.b", false, true},
+		{"a.*", true, true},
+		{"a.>", true, true},
+		{"", false, false},
+		{"a.", false, false},
+		{"a..b", false, false},
+		{"a.>.b", false, false},
+		{"a*", false, false},
+	}
+	for _, tt := range tests {
+		wildcard, err := parsePattern(tt.pattern)
+		if wildcard != tt.wildcard || (err == nil) != tt.ok {
+			t.Errorf("parsePattern(%q) = %v, %v, want %v, ok=%v", tt.pattern, wildcard, err, tt.wildcard, tt.ok)
+		}
+	}
+}
+
+// newSubscriber returns a server connection and the client connection
+// reading from it.
+func newSubscriber(t *testing.T) (server, client *websocket.Conn) {
+	p1, p2 := net.Pipe()
+	server = websocket.NewConn(p1, websocket.ConnConfig{IsServer: true})
+	client = websocket.NewConn(p2, websocket.ConnConfig{})
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return server, client
+}
+
+func readString(t *testing.T, c *websocket.Conn) string {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	_, p, err := c.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage() returned %v", err)
+	}
+	return string(p)
+}
+
+func TestPublish(t *testing.T) {
+	h := New(Config{})
+	s1, c1 := newSubscriber(t)
+	s2, c2 := newSubscriber(t)
+
+	for _, sub := range []struct {
+		c       *websocket.Conn
+		pattern string
+	}{
+		{s1, "rooms.lobby"},
+		{s1, "rooms.*"},
+		{s2, "rooms.>"},
+	} {
+		if err := h.Subscribe(sub.c, sub.pattern); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.Subscribe(s1, "rooms..x"); err != ErrInvalidPattern {
+		t.Errorf("Subscribe() returned %v, want %v", err, ErrInvalidPattern)
+	}
+	patterns := h.Subscriptions(s1)
+	sort.Strings(patterns)
+	if len(patterns) != 2 || patterns[0] != "rooms.*" || patterns[1] != "rooms.lobby" {
+		t.Errorf("Subscriptions() = %v", patterns)
+	}
+
+	// s1 matches twice but receives the message once.
+	if n, err := h.Publish("rooms.lobby", websocket.TextMessage, []byte("hello")); n != 2 || err != nil {
+		t.Errorf("Publish() = %d, %v, want 2", n, err)
+	}
+	if n, _ := h.Publish("rooms.lobby.typing", websocket.TextMessage, []byte("typing")); n != 1 {
+		t.Errorf("Publish() = %d, want 1", n)
+	}
+	if _, err := h.Publish("rooms.*", websocket.TextMessage, nil); err != ErrInvalidPattern {
+		t.Errorf("Publish() to a pattern returned %v, want %v", err, ErrInvalidPattern)
+	}
+	if got := readString(t, c1); got != "hello" {
+		t.Errorf("c1 received %q", got)
+	}
+	if got := readString(t, c2); got != "hello" {
+		t.Errorf("c2 received %q", got)
+	}
+	if got := readString(t, c2); got != "typing" {
+		t.Errorf("c2 received %q", got)
+	}
+
+	h.Unsubscribe(s1, "rooms.lobby")
+	h.Leave(s2)
+	if n, _ := h.Publish("rooms.lobby", websocket.TextMessage, []byte("again")); n != 1 {
+		t.Errorf("Publish() after unsubscribe = %d, want 1", n)
+	}
+	if got := readString(t, c1); got != "again" {
+		t.Errorf("c1 received %q", got)
+	}
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	h := New(Config{Queue: websocket.WriteQueueConfig{Size: 2, Overflow: websocket.OverflowDropNewest}})
+	const n = 20
+	fast, fastClient := newSubscriber(t)
+	slow, slowClient := newSubscriber(t)
+	// The queue of a connection that has one already is kept.
+	fast.EnableWriteQueue(websocket.WriteQueueConfig{Size: n})
+	h.Subscribe(fast, "t")
+	h.Subscribe(slow, "t")
+
+	// The slow subscriber does not read while the messages are published,
+	// so its queue fills and drops the newest messages. The fast subscriber
+	// receives all messages.
+	done := make(chan int)
+	go func() {
+		fastClient.SetReadDeadline(time.Now().Add(time.Second))
+		i := 0
+		for ; i < n; i++ {
+			if _, _, err := fastClient.ReadMessage(); err != nil {
+				break
+			}
+		}
+		done <- i
+	}()
+	for i := 0; i < n; i++ {
+		if _, err := h.Publish("t", websocket.BinaryMessage, []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if received := <-done; received != n {
+		t.Errorf("fast subscriber received %d of %d messages", received, n)
+	}
+
+	received := 0
+	slowClient.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	for {
+		if _, _, err := slowClient.ReadMessage(); err != nil {
+			break
+		}
+		received++
+	}
+	if received == 0 || received >= n {
+		t.Errorf("slow subscriber received %d of %d messages", received, n)
+	}
+}
+
+func TestDefaultOverflow(t *testing.T) {
+	h := New(Config{Queue: websocket.WriteQueueConfig{Size: 2}})
+	s, c := newSubscriber(t)
+	h.Subscribe(s, "t")
+
+	// The subscriber does not read while the messages are published. The
+	// default policy drops the oldest messages instead of blocking Publish.
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 20; i++ {
+			if _, err := h.Publish("t", websocket.BinaryMessage, []byte{byte(i)}); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Publish blocked on a slow subscriber")
+	}
+
+	// The last message published is kept.
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		_, p, err := c.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p[0] == 19 {
+			break
+		}
+	}
+}
+
+func TestClosedSubscriberRemoved(t *testing.T) {
+	h := New(Config{})
+	s, _ := newSubscriber(t)
+	h.Subscribe(s, "t")
+	s.Close()
+	// The write queue stops when the connection is closed.
+	time.Sleep(10 * time.Millisecond)
+
+	h.Publish("t", websocket.TextMessage, []byte("x"))
+	if patterns := h.Subscriptions(s); len(patterns) != 0 {
+		t.Errorf("closed connection still subscribed to %v", patterns)
+	}
+}
+
+func TestClose(t *testing.T) {
+	h := New(Config{})
+	s, c := newSubscriber(t)
+	h.Subscribe(s, "t")
+	h.Publish("t", websocket.TextMessage, []byte("before close"))
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Messages queued before Close are still delivered.
+	if got := readString(t, c); got != "before close" {
+		t.Errorf("received %q", got)
+	}
+	if _, err := h.Publish("t", websocket.TextMessage, nil); err != ErrClosed {
+		t.Errorf("Publish() after Close returned %v, want %v", err, ErrClosed)
+	}
+	if err := h.Subscribe(s, "t"); err != ErrClosed {
+		t.Errorf("Subscribe() after Close returned %v, want %v", err, ErrClosed)
+	}
+	if err := h.Close(); err != ErrClosed {
+		t.Errorf("second Close() returned %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestCloseBlockedPublish(t *testing.T) {
+	h := New(Config{})
+	s, _ := newSubscriber(t)
+	// The application enabled a blocking queue and the client never reads:
+	// the first message is being written, the second fills the queue and
+	// the third blocks Publish.
+	s.EnableWriteQueue(websocket.WriteQueueConfig{Size: 1, Overflow: websocket.OverflowBlock})
+	h.Subscribe(s, "t")
+	for i := 0; i < 2; i++ {
+		h.Publish("t", websocket.TextMessage, []byte("x"))
+	}
+	go h.Publish("t", websocket.TextMessage, []byte("blocked"))
+	time.Sleep(20 * time.Millisecond) // await the publish blocking
+
+	done := make(chan error, 1)
+	go func() { done <- h.Close() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked on a blocked publish")
+	}
+}
@@ -0,0 +1,484 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package hub
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// The TCP broker protocol exchanges frames of the form
+//
+//	op (1 byte) | topic length (2 bytes) | topic | message type (1 byte) | data length (4 bytes) | data
+//
+// with integers in network byte order. Nodes send opSubscribe and
+// opUnsubscribe with a pattern as topic, and opPublish. The server answers
+// each opSubscribe and opUnsubscribe with an opAck once the subscriptions of
+// the node are updated, and relays opPublish frames to every node with a
+// matching subscription.
+const (
+	opSubscribe byte = iota + 1
+	opUnsubscribe
+	opPublish
+	opAck
+)
+
+// maxBrokerData is the maximum size of a message relayed by the TCP broker.
+const maxBrokerData = 64 << 20
+
+var errBrokerFrame = errors.New("hub: malformed broker frame")
+
+type brokerFrame struct {
+	op          byte
+	topic       string
+	messageType int
+	data        []byte
+}
+
+func writeBrokerFrame(w *bufio.Writer, f brokerFrame) error {
+	if len(f.topic) > 0xffff || len(f.data) > maxBrokerData {
+		return errBrokerFrame
+	}
+	var header [3]byte
+	header[0] = f.op
+	binary.BigEndian.PutUint16(header[1:], uint16(len(f.topic)))
+	w.Write(header[:])
+	w.WriteString(f.topic)
+	var trailer [5]byte
+	trailer[0] = byte(f.messageType)
+	binary.BigEndian.PutUint32(trailer[1:], uint32(len(f.data)))
+	w.Write(trailer[:])
+	w.Write(f.data)
+	return w.Flush()
+}
+
+func readBrokerFrame(r *bufio.Reader) (brokerFrame, error) {
+	var header [3]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return brokerFrame{}, err
+	}
+	topic := make([]byte, binary.BigEndian.Uint16(header[1:]))
+	if _, err := io.ReadFull(r, topic); err != nil {
+		return brokerFrame{}, err
+	}
+	var trailer [5]byte
+	if _, err := io.ReadFull(r, trailer[:]); err != nil {
+		return brokerFrame{}, err
+	}
+	n := binary.BigEndian.Uint32(trailer[1:])
+	if n > maxBrokerData {
+		return brokerFrame{}, errBrokerFrame
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return brokerFrame{}, err
+	}
+	f := brokerFrame{op: header[0], topic: string(topic), messageType: int(trailer[0]), data: data}
+	if _, err := parsePattern(f.topic); err != nil {
+		return brokerFrame{}, errBrokerFrame
+	}
+	return f, nil
+}
+
+// BrokerServer relays the messages published by the nodes connected with
+// DialBroker. It is a reference implementation: it keeps no state besides
+// the subscriptions of the connected nodes and a slow node delays the
+// delivery to the nodes after it.
+type BrokerServer struct {
+	ln net.Listener
+
+	mu     sync.Mutex
+	nodes  map[*brokerNode]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+type brokerNode struct {
+	conn     net.Conn
+	patterns map[string]struct{} // guarded by BrokerServer.mu
+
+	mu sync.Mutex
+	w  *bufio.Writer
+}
+
+// ListenBroker starts a broker server listening on the TCP address addr.
+// Use "127.0.0.1:0" to run a server in process for tests.
+func ListenBroker(addr string) (*BrokerServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &BrokerServer{ln: ln, nodes: make(map[*brokerNode]struct{})}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the address the server listens on.
+func (s *BrokerServer) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+func (s *BrokerServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		n := &brokerNode{conn: conn, patterns: make(map[string]struct{}), w: bufio.NewWriter(conn)}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.nodes[n] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serveNode(n)
+	}
+}
+
+func (s *BrokerServer) serveNode(n *brokerNode) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.nodes, n)
+		s.mu.Unlock()
+		n.conn.Close()
+	}()
+	r := bufio.NewReader(n.conn)
+	for {
+		f, err := readBrokerFrame(r)
+		if err != nil {
+			return
+		}
+		switch f.op {
+		case opSubscribe, opUnsubscribe:
+			s.mu.Lock()
+			if f.op == opSubscribe {
+				n.patterns[f.topic] = struct{}{}
+			} else {
+				delete(n.patterns, f.topic)
+			}
+			s.mu.Unlock()
+			n.mu.Lock()
+			err := writeBrokerFrame(n.w, brokerFrame{op: opAck, topic: f.topic})
+			n.mu.Unlock()
+			if err != nil {
+				return
+			}
+		case opPublish:
+			s.relay(f)
+		default:
+			return
+		}
+	}
+}
+
+// relay sends a published message to the nodes subscribed to its topic.
+func (s *BrokerServer) relay(f brokerFrame) {
+	s.mu.Lock()
+	var targets []*brokerNode
+	for n := range s.nodes {
+		for pattern := range n.patterns {
+			if match(pattern, f.topic) {
+				targets = append(targets, n)
+				break
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	for _, n := range targets {
+		n.mu.Lock()
+		err := writeBrokerFrame(n.w, f)
+		n.mu.Unlock()
+		if err != nil {
+			n.conn.Close()
+		}
+	}
+}
+
+// Close stops the server and disconnects the nodes.
+func (s *BrokerServer) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	s.closed = true
+	err := s.ln.Close()
+	for n := range s.nodes {
+		n.conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// TCPBroker is a Broker connected to a BrokerServer.
+//
+// Subscribe returns once the server acknowledged the subscription, so a
+// message published by any node after Subscribe returns reaches the handler.
+// Handlers run on the goroutine that reads from the server and must not call
+// Subscribe.
+//
+// If the connection to the server fails, Publish and Subscribe return the
+// error and the subscriptions receive no more messages; the application
+// dials a new broker to recover.
+type TCPBroker struct {
+	conn net.Conn
+
+	wmu sync.Mutex
+	w   *bufio.Writer
+
+	mu       sync.Mutex
+	subs     map[*subscription]struct{}
+	patterns map[string]*brokerPattern
+	acks     []chan struct{} // closed by the acks of the frames in flight, in order
+	err      error
+	closed   bool
+	done     chan struct{}
+}
+
+// brokerPattern is a pattern a TCPBroker subscribed to on the server.
+type brokerPattern struct {
+	n     int           // number of subscriptions
+	acked chan struct{} // closed when the server acknowledges opSubscribe
+	err   error         // set before acked is closed if opSubscribe was not written
+}
+
+// DialBroker connects to the broker server at the TCP address addr.
+func DialBroker(addr string) (*TCPBroker, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	b := &TCPBroker{
+		conn:     conn,
+		w:        bufio.NewWriter(conn),
+		subs:     make(map[*subscription]struct{}),
+		patterns: make(map[string]*brokerPattern),
+		done:     make(chan struct{}),
+	}
+	go b.read()
+	return b, nil
+}
+
+func (b *TCPBroker) read() {
+	defer close(b.done)
+	r := bufio.NewReader(b.conn)
+	for {
+		f, err := readBrokerFrame(r)
+		if err == nil && f.op == opAck {
+			err = b.ack()
+			if err == nil {
+				continue
+			}
+		}
+		if err == nil && f.op != opPublish {
+			err = errBrokerFrame
+		}
+		if err != nil {
+			b.fail(err)
+			return
+		}
+		b.mu.Lock()
+		var handlers []BrokerHandler
+		for s := range b.subs {
+			if match(s.pattern, f.topic) {
+				handlers = append(handlers, s.handler)
+			}
+		}
+		b.mu.Unlock()
+		for _, h := range handlers {
+			h(f.topic, f.messageType, f.data)
+		}
+	}
+}
+
+// ack completes the oldest subscription change in flight.
+func (b *TCPBroker) ack() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.acks) == 0 {
+		return errBrokerFrame
+	}
+	close(b.acks[0])
+	b.acks[0] = nil
+	b.acks = b.acks[1:]
+	return nil
+}
+
+func (b *TCPBroker) fail(err error) {
+	b.mu.Lock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.mu.Unlock()
+	b.conn.Close()
+}
+
+// write sends f to the server. On a connection error, the broker fails.
+// write must not be called with b.mu held.
+func (b *TCPBroker) write(f brokerFrame) error {
+	b.wmu.Lock()
+	err := writeBrokerFrame(b.w, f)
+	b.wmu.Unlock()
+	if err != nil && err != errBrokerFrame {
+		b.fail(err)
+	}
+	return err
+}
+
+func (b *TCPBroker) Publish(topic string, messageType int, data []byte) error {
+	if wildcard, err := parsePattern(topic); err != nil || wildcard {
+		return ErrInvalidPattern
+	}
+	b.mu.Lock()
+	err := b.err
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return b.write(brokerFrame{op: opPublish, topic: topic, messageType: messageType, data: data})
+}
+
+func (b *TCPBroker) Subscribe(pattern string, handler BrokerHandler) (Subscription, error) {
+	if _, err := parsePattern(pattern); err != nil {
+		return nil, err
+	}
+	s := &subscription{pattern: pattern, handler: handler, cancel: b.unsubscribe}
+	// The subscription frames are written with b.wmu held from before their
+	// acks are queued, so that they reach the server, and their acks come
+	// back, in the order of b.acks. b.mu is not held during the write: the
+	// reader needs it to dispatch the messages the server may be blocked
+	// relaying to us.
+	b.wmu.Lock()
+	b.mu.Lock()
+	err := b.err
+	p := b.patterns[pattern]
+	subscribe := false
+	if err == nil {
+		if p == nil {
+			p = &brokerPattern{acked: make(chan struct{})}
+			b.patterns[pattern] = p
+			b.acks = append(b.acks, p.acked)
+			subscribe = true
+		}
+		p.n++
+		b.subs[s] = struct{}{}
+	}
+	b.mu.Unlock()
+	if subscribe {
+		if err = writeBrokerFrame(b.w, brokerFrame{op: opSubscribe, topic: pattern}); err != nil {
+			b.mu.Lock()
+			p.err = err
+			if b.patterns[pattern] == p {
+				delete(b.patterns, pattern)
+			}
+			b.removeAck(p.acked)
+			close(p.acked)
+			b.mu.Unlock()
+		}
+	}
+	b.wmu.Unlock()
+	if err != nil {
+		if subscribe && err != errBrokerFrame {
+			b.fail(err)
+		}
+		b.mu.Lock()
+		delete(b.subs, s)
+		b.mu.Unlock()
+		return nil, err
+	}
+
+	select {
+	case <-p.acked:
+		err = p.err
+	case <-b.done:
+		b.mu.Lock()
+		err = b.err
+		b.mu.Unlock()
+	}
+	if err != nil {
+		b.mu.Lock()
+		delete(b.subs, s)
+		b.mu.Unlock()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (b *TCPBroker) unsubscribe(s *subscription) {
+	// See Subscribe for the locking.
+	b.wmu.Lock()
+	b.mu.Lock()
+	delete(b.subs, s)
+	unsubscribe := false
+	if p := b.patterns[s.pattern]; p != nil {
+		p.n--
+		if p.n == 0 {
+			delete(b.patterns, s.pattern)
+			if b.err == nil {
+				// The handler is no longer called, so the ack need not
+				// be awaited.
+				b.acks = append(b.acks, make(chan struct{}))
+				unsubscribe = true
+			}
+		}
+	}
+	b.mu.Unlock()
+	var err error
+	if unsubscribe {
+		err = writeBrokerFrame(b.w, brokerFrame{op: opUnsubscribe, topic: s.pattern})
+	}
+	b.wmu.Unlock()
+	if err != nil && err != errBrokerFrame {
+		b.fail(err)
+	}
+}
+
+// removeAck removes the ack channel of a frame that could not be written.
+// b.mu must be held.
+func (b *TCPBroker) removeAck(ch chan struct{}) {
+	for i, c := range b.acks {
+		if c == ch {
+			b.acks = append(b.acks[:i], b.acks[i+1:]...)
+			return
+		}
+	}
+}
+
+// Close disconnects from the server.
+func (b *TCPBroker) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrClosed
+	}
+	b.closed = true
+	failed := b.err != nil
+	if !failed {
+		b.err = ErrClosed
+	}
+	b.mu.Unlock()
+	err := b.conn.Close()
+	<-b.done
+	if failed {
+		// The connection was closed when the broker failed.
+		return nil
+	}
+	return err
+}
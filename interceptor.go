@@ -0,0 +1,145 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package websocket
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// ErrDropMessage is returned by an interceptor to discard a message without
+// an error. A dropped inbound message is skipped by the read methods and a
+// dropped outbound message is reported as written.
+var ErrDropMessage = errors.New("websocket: message dropped by interceptor")
+
+// Direction is the direction of an intercepted message.
+type Direction int
+
+const (
+	// Inbound messages are received from the peer.
+	Inbound Direction = iota + 1
+
+	// Outbound messages are written to the peer.
+	Outbound
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Inbound:
+		return "inbound"
+	case Outbound:
+		return "outbound"
+	}
+	return "unknown"
+}
+
+// InterceptedMessage is a data message passed to the interceptors of a
+// connection.
+type InterceptedMessage struct {
+	// Conn is the connection of the message. Use its ID, Subprotocol and
+	// RequestContext methods to identify the peer.
+	Conn *Conn
+
+	Direction Direction
+
+	// Type is TextMessage or BinaryMessage.
+	Type int
+
+	// Data is the payload of the message. Interceptors transform a message
+	// by setting Type and Data. The data of an outbound message belongs to
+	// the application and must not be modified in place.
+	Data []byte
+}
+
+// Interceptor inspects a data message received from or written to the peer.
+// The interceptors of a connection are called in order for every data
+// message in both directions, after decompression for inbound messages and
+// before compression for outbound messages. Control messages are not
+// intercepted.
+//
+// If an interceptor returns an error, the remaining interceptors are not
+// called and the message is rejected: the read or write method returns the
+// error, or nothing if the error is ErrDropMessage. A rejected inbound message
+// has been read in full, so the application may continue reading. Rejected
+// outbound messages are not written.
+//
+// Interceptors run on the goroutine reading or writing the connection and
+// buffer messages read with NextReader and written with NextWriter in
+// memory.
+type Interceptor func(m *InterceptedMessage) error
+
+// intercept runs the interceptors of c on m.
+func (c *Conn) intercept(m *InterceptedMessage) error {
+	for _, f := range c.interceptors {
+		if err := f(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nextInterceptedReader reads the next data message in full and returns a
+// reader of the message produced by the interceptors.
+func (c *Conn) nextInterceptedReader() (messageType int, r io.Reader, err error) {
+	for {
+		c.readSem <- struct{}{}
+		messageType, r, err = c.nextReader()
+		<-c.readSem
+		if err != nil {
+			return messageType, nil, err
+		}
+		p, err := ioutil.ReadAll(r)
+		if err != nil {
+			return noFrame, nil, err
+		}
+		m := &InterceptedMessage{Conn: c, Direction: Inbound, Type: messageType, Data: p}
+		switch err := c.intercept(m); err {
+		case nil:
+			return m.Type, bytes.NewReader(m.Data), nil
+		case ErrDropMessage:
+		default:
+			return noFrame, nil, err
+		}
+	}
+}
+
+// interceptWrite runs the interceptors on an outbound message. It returns
+// ErrDropMessage if the message must not be written.
+func (c *Conn) interceptWrite(messageType int, data []byte) (int, []byte, error) {
+	m := &InterceptedMessage{Conn: c, Direction: Outbound, Type: messageType, Data: data}
+	if err := c.intercept(m); err != nil {
+		return noFrame, nil, err
+	}
+	return m.Type, m.Data, nil
+}
+
+// interceptedWriter buffers a message written with NextWriter until Close
+// passes it to the interceptors.
+type interceptedWriter struct {
+	c           *Conn
+	messageType int
+	buf         bytes.Buffer
+	closed      bool
+}
+
+func (w *interceptedWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errWriteClosed
+	}
+	return w.buf.Write(p)
+}
+
+func (w *interceptedWriter) Close() error {
+	if w.closed {
+		return errWriteClosed
+	}
+	w.closed = true
+	return w.c.WriteMessage(w.messageType, w.buf.Bytes())
+}
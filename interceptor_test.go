@@ -0,0 +1,157 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package websocket
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInterceptors(t *testing.T) {
+	errForbidden := errors.New("forbidden")
+	var (
+		mu  sync.Mutex
+		log []string
+	)
+	interceptors := []Interceptor{
+		func(m *InterceptedMessage) error {
+			mu.Lock()
+			log = append(log, fmt.Sprintf("%s %d %d", m.Direction, m.Type, len(m.Data)))
+			mu.Unlock()
+			return nil
+		},
+		func(m *InterceptedMessage) error {
+			switch {
+			case m.Direction == Inbound && string(m.Data) == "secret":
+				m.Data = []byte("[redacted]")
+			case m.Direction == Inbound && string(m.Data) == "forbidden":
+				return errForbidden
+			case m.Direction == Outbound && string(m.Data) == "drop":
+				return ErrDropMessage
+			case m.Direction == Outbound:
+				m.Data = bytes.ToUpper(m.Data)
+			}
+			return nil
+		},
+	}
+	p1, p2 := net.Pipe()
+	server := NewConn(p1, ConnConfig{IsServer: true, Interceptors: interceptors})
+	client := NewConn(p2, ConnConfig{})
+	defer server.Close()
+	defer client.Close()
+
+	go func() {
+		for _, s := range []string{"hello", "secret", "forbidden", "world"} {
+			client.WriteMessage(TextMessage, []byte(s))
+		}
+	}()
+	for _, want := range []struct {
+		data string
+		err  error
+	}{
+		{"hello", nil},
+		{"[redacted]", nil},
+		{"", errForbidden},
+		{"world", nil},
+	} {
+		server.SetReadDeadline(time.Now().Add(time.Second))
+		_, p, err := server.ReadMessage()
+		if string(p) != want.data || err != want.err {
+			t.Errorf("ReadMessage() = %q, %v, want %q, %v", p, err, want.data, want.err)
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- func() error {
+			if err := server.WriteMessage(TextMessage, []byte("a")); err != nil {
+				return err
+			}
+			if err := server.WriteMessage(TextMessage, []byte("drop")); err != nil {
+				return err
+			}
+			w, err := server.NextWriter(BinaryMessage)
+			if err != nil {
+				return err
+			}
+			w.Write([]byte("b"))
+			if err := w.Close(); err != nil {
+				return err
+			}
+			pm, _ := NewPreparedMessage(TextMessage, []byte("c"))
+			return server.WritePreparedMessage(pm)
+		}()
+	}()
+	for _, want := range []string{"A", "B", "C"} {
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		if _, p, err := client.ReadMessage(); err != nil || string(p) != want {
+			t.Errorf("client ReadMessage() = %q, %v, want %q", p, err, want)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"inbound 1 5", "inbound 1 6", "inbound 1 9", "inbound 1 5",
+		"outbound 1 1", "outbound 1 4", "outbound 2 1", "outbound 1 1",
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(log, want) {
+		t.Errorf("intercepted %q, want %q", log, want)
+	}
+}
+
+func TestUpgradeInterceptors(t *testing.T) {
+	addr := freeAddr()
+	serverID := make(chan string, 1)
+	runServerWithUpgrader(addr, &HertzUpgrader{
+		Interceptors: []Interceptor{func(m *InterceptedMessage) error {
+			if m.Direction == Outbound {
+				serverID <- m.Conn.ID()
+				m.Data = append([]byte("echo: "), m.Data...)
+			}
+			return nil
+		}},
+	})
+	time.Sleep(50 * time.Millisecond) // await server running
+
+	var inbound []string
+	conn, err := dialTestServer(addr, &ClientUpgrader{
+		Interceptors: []Interceptor{func(m *InterceptedMessage) error {
+			if m.Direction == Inbound {
+				inbound = append(inbound, string(m.Data))
+			}
+			return nil
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteMessage(TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, p, err := conn.ReadMessage(); err != nil || string(p) != "echo: hello" {
+		t.Fatalf("ReadMessage() = %q, %v", p, err)
+	}
+	if len(inbound) != 1 || inbound[0] != "echo: hello" {
+		t.Errorf("client intercepted %q", inbound)
+	}
+	if id := <-serverID; id == "" || id == conn.ID() {
+		t.Errorf("server connection ID %q", id)
+	}
+}
@@ -8,6 +8,7 @@
 package websocket
 
 import (
+	"context"
 	"io"
 
 	"github.com/bytedance/sonic"
@@ -47,3 +48,19 @@ func (c *Conn) ReadJSON(v interface{}) error {
 	}
 	return err
 }
+
+// WriteJSONContext is like WriteJSON, but aborts the write when ctx is done.
+// See WriteMessageContext for details about cancellation.
+func (c *Conn) WriteJSONContext(ctx context.Context, v interface{}) error {
+	return c.writeContext(ctx, func() error {
+		return c.WriteJSON(v)
+	})
+}
+
+// ReadJSONContext is like ReadJSON, but aborts the read when ctx is done. See
+// NextReaderContext for details about cancellation.
+func (c *Conn) ReadJSONContext(ctx context.Context, v interface{}) error {
+	return c.readContext(ctx, func() error {
+		return c.ReadJSON(v)
+	})
+}
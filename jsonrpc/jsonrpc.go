@@ -0,0 +1,535 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+// Package jsonrpc implements JSON-RPC 2.0 over WebSocket connections.
+//
+// A Conn is symmetric: either peer can register methods in a Server and call
+// the methods of the other peer, so a server can call its clients over the
+// same connection. Every JSON-RPC message is sent as one text message.
+package jsonrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bytedance/sonic"
+	"github.com/hertz-contrib/websocket"
+)
+
+const version = "2.0"
+
+// Error codes defined by the JSON-RPC 2.0 specification.
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+)
+
+// CodeServerBusy is the code of the error sent in response to a request that
+// arrives while a connection already runs Server.MaxConcurrency handlers. It
+// is in the range reserved for implementation-defined server errors.
+const CodeServerBusy = -32000
+
+// ErrClosed is returned by calls on a connection that is no longer running.
+var ErrClosed = errors.New("jsonrpc: connection closed")
+
+// Error is a JSON-RPC error object. Handlers return an *Error to send it to
+// the caller as is; other errors are sent with CodeInternalError. Calls
+// return an *Error when the peer responds with an error.
+type Error struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("jsonrpc: %s (%d)", e.Message, e.Code)
+}
+
+// message is a JSON-RPC request, notification or response.
+type message struct {
+	Version string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+var null = json.RawMessage("null")
+
+// Handler handles a call of a method. params is the raw "params" member of
+// the request, nil if absent. The result is encoded as JSON; it is ignored
+// for notifications. A panic in a handler is recovered and sent to the caller
+// as an error with CodeInternalError. Use ConnFromContext to call the peer
+// from a handler.
+type Handler func(ctx context.Context, params json.RawMessage) (result interface{}, err error)
+
+// Server is a set of methods served to the peers of one or more connections.
+type Server struct {
+	// MaxConcurrency is the maximum number of handlers run concurrently for
+	// the requests received on a connection. Requests beyond the limit are
+	// answered with CodeServerBusy and notifications beyond the limit are
+	// dropped. Set it before serving connections. Zero means no limit.
+	MaxConcurrency int
+
+	mu      sync.RWMutex
+	methods map[string]Handler
+}
+
+// NewServer returns a server without methods.
+func NewServer() *Server {
+	return &Server{methods: make(map[string]Handler)}
+}
+
+// Register registers the handler of a method, replacing any handler
+// registered before.
+func (s *Server) Register(method string, h Handler) {
+	s.mu.Lock()
+	s.methods[method] = h
+	s.mu.Unlock()
+}
+
+func (s *Server) handler(method string) Handler {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.methods[method]
+}
+
+// Serve serves the methods of s on ws until reading ws fails. See Conn.Run.
+func (s *Server) Serve(ctx context.Context, ws *websocket.Conn) error {
+	return NewConn(ws, s).Run(ctx)
+}
+
+// Conn is a JSON-RPC connection over a WebSocket connection.
+type Conn struct {
+	ws     *websocket.Conn
+	server *Server
+
+	writeMu sync.Mutex
+
+	seq     uint64
+	mu      sync.Mutex
+	pending map[string]chan *message
+	err     error // set when the connection stops running
+	done    chan struct{}
+
+	sem chan struct{} // held by the running handlers, nil for no limit
+}
+
+// NewConn returns a JSON-RPC connection over ws that serves the methods of
+// server, which may be nil. Calls receive their responses only while Run is
+// running.
+func NewConn(ws *websocket.Conn, server *Server) *Conn {
+	c := &Conn{
+		ws:      ws,
+		server:  server,
+		pending: make(map[string]chan *message),
+		done:    make(chan struct{}),
+	}
+	if server != nil && server.MaxConcurrency > 0 {
+		c.sem = make(chan struct{}, server.MaxConcurrency)
+	}
+	return c
+}
+
+type connKey struct{}
+
+// ConnFromContext returns the connection that received the request handled
+// with ctx.
+func ConnFromContext(ctx context.Context) (*Conn, bool) {
+	c, ok := ctx.Value(connKey{}).(*Conn)
+	return c, ok
+}
+
+// Run reads messages from the connection until reading fails. Requests are
+// handled concurrently, each in its own goroutine, up to the
+// Server.MaxConcurrency limit; responses complete the pending calls. When reading fails, Run cancels the context of the running
+// handlers, waits for them to return, fails the pending calls and returns
+// the read error. Handlers are passed a context derived from ctx; use Close
+// to stop Run.
+func (c *Conn) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(context.WithValue(ctx, connKey{}, c))
+	var wg sync.WaitGroup
+	var err error
+	for {
+		var p []byte
+		if _, p, err = c.ws.ReadMessage(); err != nil {
+			break
+		}
+		c.handle(ctx, &wg, p)
+	}
+	cancel()
+	wg.Wait()
+
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+		close(c.done)
+	}
+	c.mu.Unlock()
+	return err
+}
+
+// Close closes the WebSocket connection, which stops Run.
+func (c *Conn) Close() error {
+	return c.ws.Close()
+}
+
+func (c *Conn) handle(ctx context.Context, wg *sync.WaitGroup, p []byte) {
+	p = bytes.TrimSpace(p)
+	if !json.Valid(p) {
+		c.writeError(null, CodeParseError, "parse error")
+		return
+	}
+	if p[0] != '[' {
+		m, resp := c.decode(p)
+		if m == nil {
+			if resp != nil {
+				c.write(resp)
+			}
+			return
+		}
+		if !c.acquire() {
+			if m.ID != nil {
+				c.writeError(m.ID, CodeServerBusy, "server busy")
+			}
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer c.release()
+			if resp := c.serve(ctx, m); resp != nil {
+				c.write(resp)
+			}
+		}()
+		return
+	}
+
+	var batch []json.RawMessage
+	if err := sonic.Unmarshal(p, &batch); err != nil {
+		c.writeError(null, CodeInvalidRequest, "invalid request")
+		return
+	}
+	if len(batch) == 0 {
+		c.writeError(null, CodeInvalidRequest, "empty batch")
+		return
+	}
+	// The responses are sent by the last of handle and the handlers of the
+	// batch to finish.
+	responses := make([]*message, len(batch))
+	running := int32(1)
+	finish := func() {
+		if atomic.AddInt32(&running, -1) != 0 {
+			return
+		}
+		var batch []*message
+		for _, resp := range responses {
+			if resp != nil {
+				batch = append(batch, resp)
+			}
+		}
+		// No response is sent for a batch of notifications.
+		if len(batch) > 0 {
+			c.write(batch)
+		}
+	}
+	for i, raw := range batch {
+		m, resp := c.decode(raw)
+		if m == nil {
+			responses[i] = resp
+			continue
+		}
+		if !c.acquire() {
+			if m.ID != nil {
+				responses[i] = errorResponse(m.ID, CodeServerBusy, "server busy")
+			}
+			continue
+		}
+		atomic.AddInt32(&running, 1)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer c.release()
+			responses[i] = c.serve(ctx, m)
+			finish()
+		}(i)
+	}
+	finish()
+}
+
+// decode decodes a message that is not a batch. It returns the request to
+// serve, or the error response to send if the message is invalid. Responses
+// complete the pending calls.
+func (c *Conn) decode(p []byte) (req, resp *message) {
+	m := &message{}
+	if len(p) == 0 || p[0] != '{' || sonic.Unmarshal(p, m) != nil {
+		return nil, errorResponse(null, CodeInvalidRequest, "invalid request")
+	}
+	if m.Version == version {
+		switch {
+		case m.Method != "":
+			return m, nil
+		case m.Result != nil || m.Error != nil:
+			c.complete(m)
+			return nil, nil
+		}
+	}
+	return nil, errorResponse(idOrNull(m.ID), CodeInvalidRequest, "invalid request")
+}
+
+// acquire reserves a handler slot, reporting false if the limit is reached.
+func (c *Conn) acquire() bool {
+	if c.sem == nil {
+		return true
+	}
+	select {
+	case c.sem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Conn) release() {
+	if c.sem != nil {
+		<-c.sem
+	}
+}
+
+// serve calls the handler of request m and returns the response, nil for
+// notifications.
+func (c *Conn) serve(ctx context.Context, m *message) *message {
+	h := c.server.handler(m.Method)
+	if m.ID == nil {
+		if h != nil {
+			call(ctx, h, m.Params)
+		}
+		return nil
+	}
+	if h == nil {
+		return errorResponse(m.ID, CodeMethodNotFound, "method not found")
+	}
+	result, err := call(ctx, h, m.Params)
+	if err != nil {
+		var e *Error
+		if !errors.As(err, &e) {
+			e = &Error{Code: CodeInternalError, Message: err.Error()}
+		}
+		return &message{Version: version, ID: m.ID, Error: e}
+	}
+	data, err := sonic.Marshal(result)
+	if err != nil {
+		return errorResponse(m.ID, CodeInternalError, err.Error())
+	}
+	return &message{Version: version, ID: m.ID, Result: data}
+}
+
+// call calls handler h, turning a panic into an error.
+func call(ctx context.Context, h Handler, params json.RawMessage) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return h(ctx, params)
+}
+
+// complete delivers response m to the pending call with its ID. Responses
+// to unknown calls are dropped.
+func (c *Conn) complete(m *message) {
+	c.mu.Lock()
+	ch := c.pending[string(m.ID)]
+	delete(c.pending, string(m.ID))
+	c.mu.Unlock()
+	if ch != nil {
+		ch <- m
+	}
+}
+
+func errorResponse(id json.RawMessage, code int, msg string) *message {
+	return &message{Version: version, ID: id, Error: &Error{Code: code, Message: msg}}
+}
+
+func idOrNull(id json.RawMessage) json.RawMessage {
+	if id == nil {
+		return null
+	}
+	return id
+}
+
+func (c *Conn) writeError(id json.RawMessage, code int, msg string) {
+	c.write(errorResponse(id, code, msg))
+}
+
+// write sends v as a text message. Writes are serialized. The write is not
+// canceled by the context of a call: an interrupted write leaves the
+// WebSocket connection unusable for all calls, so the context only bounds
+// waiting for the response. Use the write deadline of the WebSocket
+// connection to bound writes.
+func (c *Conn) write(v interface{}) error {
+	data, err := sonic.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.ws.WriteMessage(websocket.TextMessage, data)
+}
+
+// newRequest returns a request for method with params, and registers a
+// pending call for it unless notify is set.
+func (c *Conn) newRequest(method string, params interface{}, notify bool) (*message, chan *message, error) {
+	m := &message{Version: version, Method: method}
+	if params != nil {
+		data, err := sonic.Marshal(params)
+		if err != nil {
+			return nil, nil, err
+		}
+		m.Params = data
+	}
+	if notify {
+		return m, nil, nil
+	}
+	m.ID = json.RawMessage(strconv.FormatUint(atomic.AddUint64(&c.seq, 1), 10))
+	ch := make(chan *message, 1)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return nil, nil, ErrClosed
+	}
+	c.pending[string(m.ID)] = ch
+	return m, ch, nil
+}
+
+func (c *Conn) cancel(m *message) {
+	c.mu.Lock()
+	delete(c.pending, string(m.ID))
+	c.mu.Unlock()
+}
+
+// wait waits for the response to request m.
+func (c *Conn) wait(ctx context.Context, m *message, ch chan *message, result interface{}) error {
+	select {
+	case resp := <-ch:
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if result == nil {
+			return nil
+		}
+		return sonic.Unmarshal(resp.Result, result)
+	case <-ctx.Done():
+		c.cancel(m)
+		return ctx.Err()
+	case <-c.done:
+		c.cancel(m)
+		return ErrClosed
+	}
+}
+
+// Call calls method on the peer with params and stores the result in the
+// value pointed to by result. params is encoded as JSON; use a struct, map
+// or slice, or nil for no params. result may be nil to discard the result.
+// If the peer responds with an error, Call returns it as an *Error.
+//
+// ctx bounds waiting for the response. Once the request is being written, it
+// is written in full even if ctx is done, as the connection is shared with
+// the other calls.
+func (c *Conn) Call(ctx context.Context, method string, params, result interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m, ch, err := c.newRequest(method, params, false)
+	if err != nil {
+		return err
+	}
+	if err := c.write(m); err != nil {
+		c.cancel(m)
+		return err
+	}
+	return c.wait(ctx, m, ch, result)
+}
+
+// Notify sends a notification, a call without response, of method with
+// params.
+func (c *Conn) Notify(ctx context.Context, method string, params interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m, _, err := c.newRequest(method, params, true)
+	if err != nil {
+		return err
+	}
+	return c.write(m)
+}
+
+// BatchElem is a call in a batch sent with Conn.Batch.
+type BatchElem struct {
+	Method string
+	Params interface{}
+
+	// Result is the value the result is stored in, nil to discard the
+	// result. Notify sends the element as a notification.
+	Result interface{}
+	Notify bool
+
+	// Error is set by Batch to the error of the call.
+	Error error
+}
+
+// Batch sends the calls in batch as one batch request and waits for their
+// responses. The error of each call is stored in its Error field; Batch only
+// returns an error if the batch could not be sent or ctx is done.
+func (c *Conn) Batch(ctx context.Context, batch []BatchElem) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	msgs := make([]*message, len(batch))
+	chans := make([]chan *message, len(batch))
+	for i := range batch {
+		m, ch, err := c.newRequest(batch[i].Method, batch[i].Params, batch[i].Notify)
+		if err != nil {
+			for _, m := range msgs[:i] {
+				c.cancel(m)
+			}
+			return err
+		}
+		msgs[i], chans[i] = m, ch
+	}
+	if err := c.write(msgs); err != nil {
+		for _, m := range msgs {
+			c.cancel(m)
+		}
+		return err
+	}
+	for i := range batch {
+		if chans[i] == nil {
+			continue
+		}
+		batch[i].Error = c.wait(ctx, msgs[i], chans[i], batch[i].Result)
+		if err := ctx.Err(); err != nil {
+			for _, m := range msgs[i+1:] {
+				c.cancel(m)
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hertz-contrib/websocket"
+)
+
+type addParams struct {
+	A, B int
+}
+
+func newTestServer() *Server {
+	s := NewServer()
+	s.Register("add", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		var p addParams
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, &Error{Code: CodeInvalidParams, Message: err.Error()}
+		}
+		return p.A + p.B, nil
+	})
+	s.Register("fail", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		return nil, errors.New("failed")
+	})
+	s.Register("sleep", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		var d time.Duration
+		json.Unmarshal(params, &d)
+		time.Sleep(d)
+		return d, nil
+	})
+	s.Register("panic", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		panic("boom")
+	})
+	// whoami calls the client back over the same connection.
+	s.Register("whoami", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		c, _ := ConnFromContext(ctx)
+		var name string
+		err := c.Call(ctx, "name", nil, &name)
+		return "you are " + name, err
+	})
+	return s
+}
+
+// newTestConns returns a client connection serving client methods and runs
+// a server connection serving the methods of newTestServer.
+func newTestConns(t *testing.T, client *Server) *Conn {
+	p1, p2 := net.Pipe()
+	sws := websocket.NewConn(p1, websocket.ConnConfig{IsServer: true})
+	cws := websocket.NewConn(p2, websocket.ConnConfig{})
+	go newTestServer().Serve(context.Background(), sws)
+	c := NewConn(cws, client)
+	done := make(chan struct{})
+	go func() {
+		c.Run(context.Background())
+		close(done)
+	}()
+	t.Cleanup(func() {
+		c.Close()
+		<-done
+	})
+	return c
+}
+
+func TestCall(t *testing.T) {
+	client := NewServer()
+	client.Register("name", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		return "client", nil
+	})
+	c := newTestConns(t, client)
+	ctx := context.Background()
+
+	var sum int
+	if err := c.Call(ctx, "add", addParams{1, 2}, &sum); err != nil || sum != 3 {
+		t.Errorf("Call(add) = %d, %v, want 3", sum, err)
+	}
+	var name string
+	if err := c.Call(ctx, "whoami", nil, &name); err != nil || name != "you are client" {
+		t.Errorf("Call(whoami) = %q, %v", name, err)
+	}
+
+	for _, tt := range []struct {
+		method string
+		params interface{}
+		code   int
+	}{
+		{"missing", nil, CodeMethodNotFound},
+		{"add", []int{1}, CodeInvalidParams},
+		{"fail", nil, CodeInternalError},
+		{"panic", nil, CodeInternalError},
+	} {
+		var e *Error
+		if err := c.Call(ctx, tt.method, tt.params, nil); !errors.As(err, &e) || e.Code != tt.code {
+			t.Errorf("Call(%s) returned %v, want code %d", tt.method, err, tt.code)
+		}
+	}
+	if err := c.Notify(ctx, "add", addParams{1, 2}); err != nil {
+		t.Errorf("Notify() returned %v", err)
+	}
+	if err := c.Notify(ctx, "panic", nil); err != nil {
+		t.Errorf("Notify() returned %v", err)
+	}
+	if err := c.Call(ctx, "add", addParams{1, 2}, &sum); err != nil || sum != 3 {
+		t.Errorf("Call(add) after a panic = %d, %v, want 3", sum, err)
+	}
+}
+
+func TestConcurrentCalls(t *testing.T) {
+	c := newTestConns(t, nil)
+
+	// Slow calls do not hold up fast ones, and the responses, which arrive
+	// out of order, reach their callers.
+	var wg sync.WaitGroup
+	for i := 10; i > 0; i-- {
+		wg.Add(1)
+		go func(d time.Duration) {
+			defer wg.Done()
+			var got time.Duration
+			if err := c.Call(context.Background(), "sleep", d, &got); err != nil || got != d {
+				t.Errorf("Call(sleep, %v) = %v, %v", d, got, err)
+			}
+		}(time.Duration(i) * 5 * time.Millisecond)
+	}
+	wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := c.Call(ctx, "sleep", time.Second, nil); err != context.DeadlineExceeded {
+		t.Errorf("Call() returned %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestCallWriteCanceled(t *testing.T) {
+	p1, p2 := net.Pipe()
+	sws := websocket.NewConn(p1, websocket.ConnConfig{IsServer: true})
+	c := NewConn(websocket.NewConn(p2, websocket.ConnConfig{}), nil)
+	go c.Run(context.Background())
+	defer c.Close()
+
+	// The server starts reading only after the context of the first call is
+	// done, while the request is still being written. The request is written
+	// in full and the connection stays usable for other calls.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		newTestServer().Serve(context.Background(), sws)
+	}()
+	if err := c.Call(ctx, "sleep", 100*time.Millisecond, nil); err != context.DeadlineExceeded {
+		t.Errorf("Call() returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	var sum int
+	if err := c.Call(context.Background(), "add", addParams{1, 2}, &sum); err != nil || sum != 3 {
+		t.Errorf("Call(add) after a canceled call = %d, %v, want 3", sum, err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	c := newTestConns(t, nil)
+
+	var sum1, sum2 int
+	batch := []BatchElem{
+		{Method: "add", Params: addParams{1, 2}, Result: &sum1},
+		{Method: "add", Params: addParams{3, 4}, Notify: true},
+		{Method: "missing"},
+		{Method: "add", Params: addParams{5, 6}, Result: &sum2},
+	}
+	if err := c.Batch(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+	if sum1 != 3 || sum2 != 11 || batch[0].Error != nil || batch[1].Error != nil || batch[3].Error != nil {
+		t.Errorf("sums = %d, %d, errors = %v, %v, %v", sum1, sum2, batch[0].Error, batch[1].Error, batch[3].Error)
+	}
+	var e *Error
+	if !errors.As(batch[2].Error, &e) || e.Code != CodeMethodNotFound {
+		t.Errorf("batch[2].Error = %v, want code %d", batch[2].Error, CodeMethodNotFound)
+	}
+}
+
+func TestInvalidMessages(t *testing.T) {
+	p1, p2 := net.Pipe()
+	sws := websocket.NewConn(p1, websocket.ConnConfig{IsServer: true})
+	ws := websocket.NewConn(p2, websocket.ConnConfig{})
+	go newTestServer().Serve(context.Background(), sws)
+	defer ws.Close()
+
+	for _, tt := range []struct {
+		send, want string
+	}{
+		{`{"jsonrpc":`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"parse error"}}`},
+		{`[]`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"empty batch"}}`},
+		{`{"jsonrpc":"1.0","method":"add","id":1}`, `{"jsonrpc":"2.0","id":1,"error":{"code":-32600,"message":"invalid request"}}`},
+		{`[1]`, `[{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"invalid request"}}]`},
+		{`1`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"invalid request"}}`},
+		{`"x"`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"invalid request"}}`},
+		{`null`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"invalid request"}}`},
+		{`{"jsonrpc":"2.0","method":1,"id":2}`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"invalid request"}}`},
+		{`{"method":"add","id":3}`, `{"jsonrpc":"2.0","id":3,"error":{"code":-32600,"message":"invalid request"}}`},
+		{`{"jsonrpc":"2.0","id":4}`, `{"jsonrpc":"2.0","id":4,"error":{"code":-32600,"message":"invalid request"}}`},
+		{`{"jsonrpc":"1.0","result":1,"id":5}`, `{"jsonrpc":"2.0","id":5,"error":{"code":-32600,"message":"invalid request"}}`},
+		{`[{"jsonrpc":"2.0","id":6},{"jsonrpc":"2.0","result":1,"id":7}]`,
+			`[{"jsonrpc":"2.0","id":6,"error":{"code":-32600,"message":"invalid request"}}]`},
+		{`{"jsonrpc":"2.0","method":"add","params":{"A":1,"B":1},"id":"x"}`, `{"jsonrpc":"2.0","id":"x","result":2}`},
+		{`[{"jsonrpc":"2.0","method":"add","params":{"A":1,"B":1}},{"jsonrpc":"2.0","method":"add","params":{"A":2,"B":2},"id":2}]`,
+			`[{"jsonrpc":"2.0","id":2,"result":4}]`},
+	} {
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(tt.send)); err != nil {
+			t.Fatal(err)
+		}
+		_, p, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got, want interface{}
+		json.Unmarshal(p, &got)
+		json.Unmarshal([]byte(tt.want), &want)
+		if gotJSON, _ := json.Marshal(got); string(gotJSON) != mustMarshal(want) {
+			t.Errorf("response to %s = %s, want %s", tt.send, p, tt.want)
+		}
+	}
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	s := newTestServer()
+	s.MaxConcurrency = 1
+	started, release := make(chan struct{}), make(chan struct{})
+	s.Register("block", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		close(started)
+		<-release
+		return nil, nil
+	})
+	p1, p2 := net.Pipe()
+	go s.Serve(context.Background(), websocket.NewConn(p1, websocket.ConnConfig{IsServer: true}))
+	c := NewConn(websocket.NewConn(p2, websocket.ConnConfig{}), nil)
+	go c.Run(context.Background())
+	defer c.Close()
+
+	ctx := context.Background()
+	blocked := make(chan error, 1)
+	go func() { blocked <- c.Call(ctx, "block", nil, nil) }()
+	<-started
+
+	// The connection runs one handler at a time.
+	var e *Error
+	if err := c.Call(ctx, "add", addParams{1, 2}, nil); !errors.As(err, &e) || e.Code != CodeServerBusy {
+		t.Errorf("Call() while a handler runs returned %v, want code %d", err, CodeServerBusy)
+	}
+	batch := []BatchElem{{Method: "add", Params: addParams{1, 2}}}
+	if err := c.Batch(ctx, batch); err != nil || !errors.As(batch[0].Error, &e) || e.Code != CodeServerBusy {
+		t.Errorf("Batch() while a handler runs returned %v, %v, want code %d", err, batch[0].Error, CodeServerBusy)
+	}
+
+	// The slot is released once the response is written, which may be
+	// after the caller receives it.
+	close(release)
+	if err := <-blocked; err != nil {
+		t.Fatal(err)
+	}
+	var sum int
+	for i := 0; ; i++ {
+		err := c.Call(ctx, "add", addParams{1, 2}, &sum)
+		if errors.As(err, &e) && e.Code == CodeServerBusy && i < 100 {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		if err != nil || sum != 3 {
+			t.Errorf("Call(add) after the handler returned = %d, %v, want 3", sum, err)
+		}
+		break
+	}
+}
+
+func mustMarshal(v interface{}) string {
+	p, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return string(p)
+}
+
+func TestCallAfterClose(t *testing.T) {
+	p1, p2 := net.Pipe()
+	sws := websocket.NewConn(p1, websocket.ConnConfig{IsServer: true})
+	c := NewConn(websocket.NewConn(p2, websocket.ConnConfig{}), nil)
+	done := make(chan error, 1)
+	go func() { done <- c.Run(context.Background()) }()
+
+	// The server never responds.
+	go sws.ReadMessage()
+	result := make(chan error, 1)
+	go func() { result <- c.Call(context.Background(), "add", nil, nil) }()
+	time.Sleep(10 * time.Millisecond)
+	sws.Close()
+	<-done
+	if err := <-result; err != ErrClosed {
+		t.Errorf("pending Call() returned %v, want %v", err, ErrClosed)
+	}
+	if err := c.Call(context.Background(), "add", nil, nil); err != ErrClosed {
+		t.Errorf("Call() after close returned %v, want %v", err, ErrClosed)
+	}
+}
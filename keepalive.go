@@ -0,0 +1,163 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package websocket
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrKeepaliveTimeout is returned by the read methods after the connection
+// was closed because the peer did not answer a keepalive ping in time.
+var ErrKeepaliveTimeout = &CloseError{Code: CloseAbnormalClosure, Text: "keepalive timeout"}
+
+// KeepaliveConfig specifies how a connection checks that the peer is alive.
+//
+// Pongs are processed by the read methods, so the application must read the
+// connection for keepalive to work.
+type KeepaliveConfig struct {
+	// PingInterval is the interval between pings. Zero disables keepalive.
+	PingInterval time.Duration
+
+	// PongTimeout is the time to wait for the pong after sending a ping. If
+	// the pong does not arrive in time, the connection is closed and the read
+	// methods return ErrKeepaliveTimeout. The default is PingInterval.
+	PongTimeout time.Duration
+}
+
+type keepalive struct {
+	c        *Conn
+	interval time.Duration
+	timeout  time.Duration
+
+	mu      sync.Mutex
+	payload string // payload of the unanswered ping, empty if none
+	sentAt  time.Time
+
+	rtt     int64 // time.Duration
+	expired int32
+	done    chan struct{}
+	once    sync.Once
+}
+
+// startKeepalive starts sending pings to the peer as specified by config.
+func (c *Conn) startKeepalive(config KeepaliveConfig) {
+	if config.PingInterval <= 0 {
+		return
+	}
+	k := &keepalive{
+		c:        c,
+		interval: config.PingInterval,
+		timeout:  config.PongTimeout,
+		done:     make(chan struct{}),
+	}
+	if k.timeout <= 0 {
+		k.timeout = k.interval
+	}
+	c.keepalive = k
+	go k.run()
+}
+
+// stopKeepalive stops sending pings.
+func (c *Conn) stopKeepalive() {
+	if k := c.keepalive; k != nil {
+		k.once.Do(func() { close(k.done) })
+	}
+}
+
+// RTT returns the round-trip time measured by the last keepalive ping, or
+// zero if no ping has been answered.
+func (c *Conn) RTT() time.Duration {
+	if c.keepalive == nil {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&c.keepalive.rtt))
+}
+
+func (k *keepalive) outstanding() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.payload != ""
+}
+
+// overdue reports whether the pong of the last ping is late.
+func (k *keepalive) overdue() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.payload != "" && time.Since(k.sentAt) >= k.timeout
+}
+
+func (k *keepalive) run() {
+	ticker := time.NewTicker(k.interval)
+	defer ticker.Stop()
+	timer := time.NewTimer(k.timeout)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-k.done:
+			return
+		case <-timer.C:
+			if k.overdue() {
+				k.expire()
+				return
+			}
+		case <-ticker.C:
+			if k.outstanding() {
+				continue
+			}
+			now := time.Now()
+			payload := strconv.FormatInt(now.UnixNano(), 10)
+			k.mu.Lock()
+			k.payload = payload
+			k.sentAt = now
+			k.mu.Unlock()
+			if err := k.c.WriteControl(PingMessage, []byte(payload), now.Add(k.timeout)); err != nil {
+				if e, ok := err.(net.Error); ok && e.Timeout() {
+					k.expire()
+				}
+				return
+			}
+			// The timer of the previous ping may have fired after its pong
+			// arrived; drain it so that it does not expire this ping early.
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(k.timeout)
+		}
+	}
+}
+
+// pong records the answer to the outstanding ping.
+func (k *keepalive) pong(payload string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if payload != "" && payload == k.payload {
+		rtt := int64(time.Since(k.sentAt))
+		atomic.StoreInt64(&k.rtt, rtt)
+		atomic.StoreInt64(&k.c.stats.rtt, rtt)
+		k.payload = ""
+	}
+}
+
+// expire closes the connection of the silent peer.
+func (k *keepalive) expire() {
+	atomic.StoreInt32(&k.expired, 1)
+	k.c.Close()
+}
+
+func (k *keepalive) isExpired() bool {
+	return atomic.LoadInt32(&k.expired) != 0
+}
@@ -0,0 +1,94 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package websocket
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestKeepalive(t *testing.T) {
+	server, client := newPipeConns()
+	defer server.Close()
+	defer client.Close()
+	server.startKeepalive(KeepaliveConfig{PingInterval: 10 * time.Millisecond})
+
+	// The client answers pings while reading.
+	go func() {
+		for {
+			if _, _, err := client.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, _, err := server.ReadMessageContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("ReadMessageContext() returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if rtt := server.RTT(); rtt <= 0 {
+		t.Errorf("RTT() = %v, want positive duration", rtt)
+	}
+}
+
+func TestKeepaliveTimeout(t *testing.T) {
+	server, client := newPipeConns()
+	defer server.Close()
+	defer client.Close()
+	server.startKeepalive(KeepaliveConfig{PingInterval: 10 * time.Millisecond, PongTimeout: 20 * time.Millisecond})
+
+	// The client reads but never answers pings.
+	client.SetPingHandler(func(string) error { return nil })
+	go func() {
+		for {
+			if _, _, err := client.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	_, _, err := server.ReadMessage()
+	if err != ErrKeepaliveTimeout {
+		t.Fatalf("ReadMessage() returned %v, want %v", err, ErrKeepaliveTimeout)
+	}
+	if !IsUnexpectedCloseError(err) {
+		t.Errorf("IsUnexpectedCloseError(%v) = false, want true", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("keepalive timeout detected after %v", d)
+	}
+	if server.RTT() != 0 {
+		t.Errorf("RTT() = %v, want 0", server.RTT())
+	}
+}
+
+func TestClientKeepalive(t *testing.T) {
+	time.Sleep(50 * time.Millisecond) // await server running
+	// The pong timeout defaults to the ping interval, which leaves room for
+	// the scheduling delays of the server.
+	conn, err := dialTestServer(dialerTestAddr, &ClientUpgrader{
+		Keepalive: KeepaliveConfig{PingInterval: 50 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if _, _, err := conn.ReadMessageContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("ReadMessageContext() returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if rtt := conn.RTT(); rtt <= 0 {
+		t.Errorf("RTT() = %v, want positive duration", rtt)
+	}
+}
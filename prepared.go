@@ -88,7 +88,7 @@ func (pm *PreparedMessage) frame(key prepareKey) (int, []byte, error) {
 			writeBuf:               make([]byte, defaultWriteBufferSize+maxFrameHeaderSize),
 		}
 		if key.compress {
-			c.newCompressionWriter = compressNoContextTakeover
+			c.setCompression(CompressionParams{ServerNoContextTakeover: true, ClientNoContextTakeover: true})
 		}
 		err = c.WriteMessage(pm.messageType, pm.data)
 		frame.data = nc.buf.Bytes()
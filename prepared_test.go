@@ -41,7 +41,7 @@ func TestPreparedMessage(t *testing.T) {
 		var buf bytes.Buffer
 		c := newTestConn(nil, &buf, tt.isServer)
 		if tt.enableWriteCompression {
-			c.newCompressionWriter = compressNoContextTakeover
+			c.setCompression(CompressionParams{ServerNoContextTakeover: true, ClientNoContextTakeover: true})
 		}
 		c.SetCompressionLevel(tt.compressionLevel)
 
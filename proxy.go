@@ -0,0 +1,269 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package websocket
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/network"
+	"github.com/cloudwego/hertz/pkg/protocol"
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
+	respI "github.com/cloudwego/hertz/pkg/protocol/http1/resp"
+)
+
+// proxyDialer is a network.Dialer that connects to the target address
+// through the proxy returned by proxy. The Hertz client's own proxy support
+// is not used because it only tunnels HTTPS requests; WebSocket connections
+// are tunneled for both ws and wss URLs.
+type proxyDialer struct {
+	dialer network.Dialer
+	proxy  func(*http.Request) (*url.URL, error)
+}
+
+func (d *proxyDialer) DialConnection(n, addr string, timeout time.Duration, tlsConfig *tls.Config) (network.Conn, error) {
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+	}
+	proxyURL, err := d.proxy(&http.Request{URL: &url.URL{Scheme: scheme, Host: addr}})
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL == nil {
+		return d.dialer.DialConnection(n, addr, timeout, tlsConfig)
+	}
+
+	var setup func(network.Conn, *url.URL, string) error
+	switch proxyURL.Scheme {
+	case "http":
+		setup = httpProxyConnect
+	case "socks5", "socks5h":
+		setup = socks5ProxyConnect
+	default:
+		return nil, errors.New("websocket: unsupported proxy scheme " + proxyURL.Scheme)
+	}
+
+	target := addr
+	if proxyURL.Scheme == "socks5" {
+		// socks5 resolves the host locally, socks5h leaves it to the proxy.
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		target = tcpAddr.String()
+	}
+
+	conn, err := d.dialer.DialConnection(n, proxyHostPort(proxyURL), timeout, nil)
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := setup(conn, proxyURL, target); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if tlsConfig != nil {
+		tlsConn, err := d.dialer.AddTLS(conn, tlsConfig)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		return tlsConn, nil
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (d *proxyDialer) DialTimeout(n, addr string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+	return d.dialer.DialTimeout(n, addr, timeout, tlsConfig)
+}
+
+func (d *proxyDialer) AddTLS(conn network.Conn, tlsConfig *tls.Config) (network.Conn, error) {
+	return d.dialer.AddTLS(conn, tlsConfig)
+}
+
+func proxyHostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "http" {
+		return net.JoinHostPort(u.Hostname(), "80")
+	}
+	return net.JoinHostPort(u.Hostname(), "1080")
+}
+
+// httpProxyConnect asks the HTTP proxy on conn to open a tunnel to addr.
+func httpProxyConnect(conn network.Conn, proxyURL *url.URL, addr string) error {
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if u := proxyURL.User; u != nil {
+		password, _ := u.Password()
+		req += "Proxy-Authorization: Basic " + basicAuth(u.Username(), password) + "\r\n"
+	}
+	req += "\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return err
+	}
+
+	resp := protocol.AcquireResponse()
+	defer protocol.ReleaseResponse(resp)
+	// Skip the body; a successful response is followed by the tunneled data.
+	resp.SkipBody = true
+	if err := respI.Read(resp, conn); err != nil {
+		return err
+	}
+	if resp.StatusCode() != consts.StatusOK {
+		return errors.New("websocket: proxy CONNECT failed: " + strconv.Itoa(resp.StatusCode()) + " " + consts.StatusMessage(resp.StatusCode()))
+	}
+	return nil
+}
+
+const (
+	socks5Version = 5
+
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+
+	socks5CmdConnect = 0x01
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+)
+
+var socks5Replies = []string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// socks5ProxyConnect asks the SOCKS5 proxy on conn to connect to addr as
+// specified in RFC 1928. Username and password authentication (RFC 1929) is
+// offered when proxyURL has user information.
+func socks5ProxyConnect(conn network.Conn, proxyURL *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 0xffff {
+		return errors.New("websocket: socks5 proxy: invalid port " + portStr)
+	}
+
+	methods := []byte{socks5AuthNone}
+	if proxyURL.User != nil {
+		methods = append(methods, socks5AuthPassword)
+	}
+	b := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(b); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return errors.New("websocket: socks5 proxy: unexpected protocol version " + strconv.Itoa(int(reply[0])))
+	}
+	switch reply[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if proxyURL.User == nil {
+			return errors.New("websocket: socks5 proxy: unexpected authentication method")
+		}
+		username := proxyURL.User.Username()
+		password, _ := proxyURL.User.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("websocket: socks5 proxy: username or password too long")
+		}
+		b := []byte{1, byte(len(username))}
+		b = append(b, username...)
+		b = append(b, byte(len(password)))
+		b = append(b, password...)
+		if _, err := conn.Write(b); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("websocket: socks5 proxy: authentication failed")
+		}
+	default:
+		return errors.New("websocket: socks5 proxy: no acceptable authentication methods")
+	}
+
+	b = []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, socks5AddrIPv4)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, socks5AddrIPv6)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return errors.New("websocket: socks5 proxy: host name too long")
+		}
+		b = append(b, socks5AddrDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	b = append(b, byte(port>>8), byte(port))
+	if _, err := conn.Write(b); err != nil {
+		return err
+	}
+
+	var hdr [4]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[0] != socks5Version {
+		return errors.New("websocket: socks5 proxy: unexpected protocol version " + strconv.Itoa(int(hdr[0])))
+	}
+	if hdr[1] != 0 {
+		msg := "unknown error"
+		if int(hdr[1]) < len(socks5Replies) {
+			msg = socks5Replies[hdr[1]]
+		}
+		return errors.New("websocket: socks5 proxy: " + msg)
+	}
+
+	// Discard the bound address and port.
+	var n int
+	switch hdr[3] {
+	case socks5AddrIPv4:
+		n = net.IPv4len
+	case socks5AddrIPv6:
+		n = net.IPv6len
+	case socks5AddrDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return err
+		}
+		n = int(l[0])
+	default:
+		return errors.New("websocket: socks5 proxy: unknown address type " + strconv.Itoa(int(hdr[3])))
+	}
+	_, err = io.ReadFull(conn, make([]byte, n+2))
+	return err
+}
@@ -0,0 +1,359 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package websocket
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testProxy is an in-process HTTP CONNECT or SOCKS5 proxy. Connections to
+// the host echo.example are forwarded to localhost.
+type testProxy struct {
+	ln       net.Listener
+	user     string
+	password string
+
+	mu      sync.Mutex
+	targets []string
+}
+
+func newTestProxy(user, password string) *testProxy {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		panic(err)
+	}
+	return &testProxy{ln: ln, user: user, password: password}
+}
+
+func (p *testProxy) addr() string {
+	return p.ln.Addr().String()
+}
+
+func (p *testProxy) dialTarget(addr string) (net.Conn, error) {
+	p.mu.Lock()
+	p.targets = append(p.targets, addr)
+	p.mu.Unlock()
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if host == "echo.example" {
+		host = "localhost"
+	}
+	return net.Dial("tcp", net.JoinHostPort(host, port))
+}
+
+func (p *testProxy) lastTarget() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.targets) == 0 {
+		return ""
+	}
+	return p.targets[len(p.targets)-1]
+}
+
+func pipe(a, b net.Conn) {
+	go func() {
+		io.Copy(a, b)
+		a.Close()
+	}()
+	io.Copy(b, a)
+	b.Close()
+}
+
+// ServeHTTP implements an HTTP CONNECT proxy.
+func (p *testProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if p.user != "" {
+		if r.Header.Get("Proxy-Authorization") != "Basic "+basicAuth(p.user, p.password) {
+			http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+			return
+		}
+	}
+	target, err := p.dialTarget(r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	conn, brw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		target.Close()
+		return
+	}
+	brw.WriteString("HTTP/1.1 200 Connection established\r\n\r\n")
+	brw.Flush()
+	pipe(conn, target)
+}
+
+// serveSOCKS5 implements a SOCKS5 proxy supporting the CONNECT command.
+func (p *testProxy) serveSOCKS5() {
+	for {
+		conn, err := p.ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			target, err := p.socks5Handshake(conn)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			pipe(conn, target)
+		}()
+	}
+}
+
+func (p *testProxy) socks5Handshake(conn net.Conn) (net.Conn, error) {
+	readBytes := func(n int) ([]byte, error) {
+		b := make([]byte, n)
+		_, err := io.ReadFull(conn, b)
+		return b, err
+	}
+
+	hdr, err := readBytes(2)
+	if err != nil {
+		return nil, err
+	}
+	methods, err := readBytes(int(hdr[1]))
+	if err != nil {
+		return nil, err
+	}
+	method := byte(socks5AuthNone)
+	if p.user != "" {
+		method = socks5AuthPassword
+	}
+	if !strings.Contains(string(methods), string([]byte{method})) {
+		conn.Write([]byte{socks5Version, 0xff})
+		return nil, io.EOF
+	}
+	conn.Write([]byte{socks5Version, method})
+
+	if method == socks5AuthPassword {
+		b, err := readBytes(2)
+		if err != nil {
+			return nil, err
+		}
+		user, err := readBytes(int(b[1]))
+		if err != nil {
+			return nil, err
+		}
+		b, err = readBytes(1)
+		if err != nil {
+			return nil, err
+		}
+		password, err := readBytes(int(b[0]))
+		if err != nil {
+			return nil, err
+		}
+		if string(user) != p.user || string(password) != p.password {
+			conn.Write([]byte{1, 1})
+			return nil, io.EOF
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	req, err := readBytes(4)
+	if err != nil {
+		return nil, err
+	}
+	var host string
+	switch req[3] {
+	case socks5AddrIPv4:
+		b, err := readBytes(net.IPv4len)
+		if err != nil {
+			return nil, err
+		}
+		host = net.IP(b).String()
+	case socks5AddrDomain:
+		b, err := readBytes(1)
+		if err != nil {
+			return nil, err
+		}
+		b, err = readBytes(int(b[0]))
+		if err != nil {
+			return nil, err
+		}
+		host = string(b)
+	default:
+		conn.Write([]byte{socks5Version, 8, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+		return nil, io.EOF
+	}
+	port, err := readBytes(2)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := p.dialTarget(net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+	if err != nil {
+		conn.Write([]byte{socks5Version, 5, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+		return nil, err
+	}
+	conn.Write([]byte{socks5Version, 0, 0, socks5AddrIPv4, 127, 0, 0, 1, 0, 0})
+	return target, nil
+}
+
+func TestDialHTTPProxy(t *testing.T) {
+	time.Sleep(50 * time.Millisecond) // await server running
+	p := newTestProxy("user", "pass")
+	defer p.ln.Close()
+	go http.Serve(p.ln, p)
+
+	proxyURL := &url.URL{Scheme: "http", User: url.UserPassword("user", "pass"), Host: p.addr()}
+	dialEcho(t, &Dialer{Proxy: http.ProxyURL(proxyURL)}, "ws://"+dialerTestAddr+testpath)
+	if target := p.lastTarget(); target != dialerTestAddr {
+		t.Errorf("proxy target = %q, want %q", target, dialerTestAddr)
+	}
+
+	proxyURL.User = url.UserPassword("user", "wrong")
+	_, _, err := (&Dialer{Proxy: http.ProxyURL(proxyURL)}).Dial(context.Background(), "ws://"+dialerTestAddr+testpath, nil)
+	if err == nil || !strings.Contains(err.Error(), "407") {
+		t.Errorf("Dial() with wrong proxy password returned %v, want 407 error", err)
+	}
+}
+
+func TestDialSOCKS5Proxy(t *testing.T) {
+	time.Sleep(50 * time.Millisecond) // await server running
+	p := newTestProxy("user", "pass")
+	defer p.ln.Close()
+	go p.serveSOCKS5()
+
+	proxyURL := &url.URL{Scheme: "socks5", User: url.UserPassword("user", "pass"), Host: p.addr()}
+	dialEcho(t, &Dialer{Proxy: http.ProxyURL(proxyURL)}, "ws://"+dialerTestAddr+testpath)
+	if target := p.lastTarget(); target != dialerTestAddr {
+		t.Errorf("proxy target = %q, want %q", target, dialerTestAddr)
+	}
+
+	proxyURL.User = nil
+	_, _, err := (&Dialer{Proxy: http.ProxyURL(proxyURL)}).Dial(context.Background(), "ws://"+dialerTestAddr+testpath, nil)
+	if err == nil {
+		t.Error("Dial() without proxy credentials returned nil error")
+	}
+}
+
+func TestDialProxyResolvesHost(t *testing.T) {
+	time.Sleep(50 * time.Millisecond) // await server running
+	p := newTestProxy("", "")
+	defer p.ln.Close()
+	go http.Serve(p.ln, p)
+
+	// Only the proxy can resolve the host of the URL.
+	_, port, _ := net.SplitHostPort(dialerTestAddr)
+	host := "echo.example:" + port
+	d := &Dialer{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: p.addr()})}
+	conn, _, err := d.Dial(context.Background(), "ws://"+host+testpath, http.Header{"Origin": {"http://" + host}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if target := p.lastTarget(); target != host {
+		t.Errorf("proxy target = %q, want %q", target, host)
+	}
+}
+
+func TestDialSOCKS5ProxyResolve(t *testing.T) {
+	time.Sleep(50 * time.Millisecond) // await server running
+	p := newTestProxy("", "")
+	defer p.ln.Close()
+	go p.serveSOCKS5()
+
+	// socks5 sends the address resolved by the client, socks5h the host
+	// name.
+	_, port, _ := net.SplitHostPort(dialerTestAddr)
+	for _, tt := range []struct {
+		scheme, host, target string
+	}{
+		{"socks5", "localhost", "127.0.0.1"},
+		{"socks5h", "localhost", "localhost"},
+		{"socks5h", "echo.example", "echo.example"},
+	} {
+		host := net.JoinHostPort(tt.host, port)
+		d := &Dialer{Proxy: http.ProxyURL(&url.URL{Scheme: tt.scheme, Host: p.addr()})}
+		conn, _, err := d.Dial(context.Background(), "ws://"+host+testpath, http.Header{"Origin": {"http://" + host}})
+		if err != nil {
+			t.Errorf("%s: Dial(%s) returned %v", tt.scheme, host, err)
+			continue
+		}
+		conn.Close()
+		if target, want := p.lastTarget(), net.JoinHostPort(tt.target, port); target != want {
+			t.Errorf("%s: proxy target = %q, want %q", tt.scheme, target, want)
+		}
+	}
+}
+
+// envProxyChild is set in the environment of the test process started by
+// TestDefaultDialerProxyFromEnvironment.
+const envProxyChild = "WEBSOCKET_TEST_ENV_PROXY_CHILD"
+
+// TestDefaultDialerProxyFromEnvironment checks that DefaultDialer uses the
+// proxies configured in the environment. http.ProxyFromEnvironment reads the
+// environment once, so the test runs in a new process.
+func TestDefaultDialerProxyFromEnvironment(t *testing.T) {
+	if os.Getenv(envProxyChild) != "" {
+		time.Sleep(50 * time.Millisecond) // await server running
+		_, port, _ := net.SplitHostPort(dialerTestAddr)
+		host := "echo.example:" + port
+		conn, _, err := DefaultDialer.Dial(context.Background(), "ws://"+host+testpath, http.Header{"Origin": {"http://" + host}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		// The HTTPS proxy tunnels to the plain echo server, so the TLS
+		// handshake fails after the proxy is used.
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		DefaultDialer.Dial(ctx, "wss://"+host+testpath, nil)
+		req := &http.Request{URL: &url.URL{Scheme: "http", Host: "bypass.example:80"}}
+		if u, err := DefaultDialer.Proxy(req); u != nil || err != nil {
+			t.Errorf("Proxy(%v) = %v, %v, want no proxy", req.URL, u, err)
+		}
+		return
+	}
+
+	httpProxy := newTestProxy("", "")
+	defer httpProxy.ln.Close()
+	go http.Serve(httpProxy.ln, httpProxy)
+	httpsProxy := newTestProxy("", "")
+	defer httpsProxy.ln.Close()
+	go http.Serve(httpsProxy.ln, httpsProxy)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDefaultDialerProxyFromEnvironment$")
+	for _, kv := range os.Environ() {
+		if k := strings.ToUpper(kv[:strings.Index(kv, "=")+1]); k != "HTTP_PROXY=" && k != "HTTPS_PROXY=" && k != "NO_PROXY=" {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env,
+		envProxyChild+"=1",
+		"HTTP_PROXY=http://"+httpProxy.addr(),
+		"HTTPS_PROXY=http://"+httpsProxy.addr(),
+		"NO_PROXY=bypass.example",
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	for _, p := range []*testProxy{httpProxy, httpsProxy} {
+		if target := p.lastTarget(); !strings.HasPrefix(target, "echo.example:") {
+			t.Errorf("proxy target = %q, want echo.example", target)
+		}
+	}
+}
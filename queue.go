@@ -0,0 +1,215 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package websocket
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const defaultWriteQueueSize = 256
+
+// ErrWriteQueueFull is reported for messages discarded by a full write queue.
+var ErrWriteQueueFull = errors.New("websocket: write queue full")
+
+// ErrWriteQueueClosed is reported for messages queued on a connection that is
+// closed or that does not have a write queue.
+var ErrWriteQueueClosed = errors.New("websocket: write queue closed")
+
+// OverflowPolicy specifies what a write queue does with a message when the
+// queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock blocks the sender until there is room in the queue.
+	OverflowBlock OverflowPolicy = iota
+
+	// OverflowDropNewest discards the message being queued.
+	OverflowDropNewest
+
+	// OverflowDropOldest discards the oldest message in the queue to make
+	// room for the message being queued.
+	OverflowDropOldest
+
+	// OverflowClose sends a close message with ClosePolicyViolation to the
+	// peer and closes the connection.
+	OverflowClose
+)
+
+// WriteQueueConfig specifies the options for a connection's write queue.
+type WriteQueueConfig struct {
+	// Size is the maximum number of messages waiting to be written. The
+	// default is 256.
+	Size int
+
+	// Overflow specifies what happens to a message queued while the queue is
+	// full. The default is OverflowBlock.
+	Overflow OverflowPolicy
+
+	// WriteTimeout, if non-zero, is the maximum duration of writing a single
+	// message. A write that times out fails the queue.
+	WriteTimeout time.Duration
+}
+
+type queuedMessage struct {
+	messageType int
+	data        []byte
+	pm          *PreparedMessage
+	done        chan error
+}
+
+// writeQueue writes queued messages to a connection from a single goroutine.
+type writeQueue struct {
+	c      *Conn
+	config WriteQueueConfig
+
+	mu       sync.Mutex
+	cond     sync.Cond
+	messages []*queuedMessage
+	err      error // non-nil once the queue is stopped
+}
+
+// EnableWriteQueue starts a goroutine that writes the messages sent with
+// QueueMessage and QueuePreparedMessage to the connection in order. The
+// queue stops when the connection is closed or when a write fails; messages
+// still in the queue are then reported as failed.
+//
+// EnableWriteQueue must be called before other goroutines queue messages.
+// Subsequent calls have no effect. While the queue is enabled, the
+// application must not call the other write methods except WriteControl.
+func (c *Conn) EnableWriteQueue(config WriteQueueConfig) {
+	if c.writeQueue != nil {
+		return
+	}
+	if config.Size <= 0 {
+		config.Size = defaultWriteQueueSize
+	}
+	q := &writeQueue{c: c, config: config}
+	q.cond.L = &q.mu
+	c.writeQueue = q
+	go q.run()
+}
+
+// QueueMessage queues a message for writing and returns a channel that
+// receives the result of the write. The channel is buffered; applications
+// that do not need the result can ignore it. The data must not be modified
+// after the call.
+//
+// If the queue is full, QueueMessage follows the queue's overflow policy.
+// Messages discarded by the policy are reported with ErrWriteQueueFull.
+func (c *Conn) QueueMessage(messageType int, data []byte) <-chan error {
+	return c.queue(&queuedMessage{messageType: messageType, data: data})
+}
+
+// QueuePreparedMessage is like QueueMessage but writes a prepared message.
+func (c *Conn) QueuePreparedMessage(pm *PreparedMessage) <-chan error {
+	return c.queue(&queuedMessage{pm: pm})
+}
+
+func (c *Conn) queue(m *queuedMessage) <-chan error {
+	m.done = make(chan error, 1)
+	if c.writeQueue == nil {
+		m.done <- ErrWriteQueueClosed
+	} else {
+		c.writeQueue.push(m)
+	}
+	return m.done
+}
+
+func (q *writeQueue) push(m *queuedMessage) {
+	q.mu.Lock()
+	for q.err == nil && len(q.messages) >= q.config.Size {
+		switch q.config.Overflow {
+		case OverflowDropNewest:
+			q.mu.Unlock()
+			m.done <- ErrWriteQueueFull
+			return
+		case OverflowDropOldest:
+			q.messages[0].done <- ErrWriteQueueFull
+			q.messages[0] = nil
+			q.messages = q.messages[1:]
+		case OverflowClose:
+			q.err = ErrWriteQueueFull
+			q.cond.Broadcast()
+			q.mu.Unlock()
+			q.c.WriteControl(CloseMessage, FormatCloseMessage(ClosePolicyViolation, "write queue full"), time.Now().Add(time.Second))
+			q.c.Close()
+			m.done <- ErrWriteQueueFull
+			return
+		default:
+			q.cond.Wait()
+		}
+	}
+	if q.err != nil {
+		err := q.err
+		q.mu.Unlock()
+		m.done <- err
+		return
+	}
+	q.messages = append(q.messages, m)
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+// stop fails the queued messages with err and stops the writer goroutine.
+func (q *writeQueue) stop(err error) {
+	q.mu.Lock()
+	if q.err == nil {
+		q.err = err
+	}
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+func (q *writeQueue) run() {
+	for {
+		q.mu.Lock()
+		for q.err == nil && len(q.messages) == 0 {
+			q.cond.Wait()
+		}
+		if q.err != nil {
+			messages, err := q.messages, q.err
+			q.messages = nil
+			q.mu.Unlock()
+			for _, m := range messages {
+				m.done <- err
+			}
+			return
+		}
+		m := q.messages[0]
+		q.messages[0] = nil
+		q.messages = q.messages[1:]
+		q.cond.Broadcast()
+		q.mu.Unlock()
+
+		err := q.write(m)
+		m.done <- err
+		if err != nil {
+			q.stop(err)
+		}
+	}
+}
+
+func (q *writeQueue) write(m *queuedMessage) error {
+	c := q.c
+	var deadline time.Time
+	if q.config.WriteTimeout > 0 {
+		deadline = time.Now().Add(q.config.WriteTimeout)
+	}
+	switch {
+	case m.pm != nil:
+		c.SetWriteDeadline(deadline)
+		return c.WritePreparedMessage(m.pm)
+	case isControl(m.messageType):
+		return c.WriteControl(m.messageType, m.data, deadline)
+	default:
+		c.SetWriteDeadline(deadline)
+		return c.WriteMessage(m.messageType, m.data)
+	}
+}
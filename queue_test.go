@@ -0,0 +1,142 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package websocket
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWriteQueue(t *testing.T) {
+	server, client := newPipeConns()
+	defer client.Close()
+	server.EnableWriteQueue(WriteQueueConfig{Size: 4})
+
+	const senders, messages = 8, 16
+	var wg sync.WaitGroup
+	errs := make(chan error, senders*messages)
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < messages; j++ {
+				errs <- <-server.QueueMessage(TextMessage, []byte(fmt.Sprintf("%d %d", i, j)))
+			}
+		}(i)
+	}
+
+	next := make([]int, senders)
+	for k := 0; k < senders*messages; k++ {
+		_, p, err := client.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var i, j int
+		fmt.Sscanf(string(p), "%d %d", &i, &j)
+		if j != next[i] {
+			t.Fatalf("message %d from sender %d, want %d", j, i, next[i])
+		}
+		next[i]++
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server.Close()
+	if err := <-server.QueueMessage(TextMessage, []byte("closed")); err != ErrWriteQueueClosed {
+		t.Errorf("QueueMessage() after Close reported %v, want %v", err, ErrWriteQueueClosed)
+	}
+}
+
+func TestWriteQueueDisabled(t *testing.T) {
+	server, client := newPipeConns()
+	defer server.Close()
+	defer client.Close()
+	if err := <-server.QueueMessage(TextMessage, []byte("hello")); err != ErrWriteQueueClosed {
+		t.Errorf("QueueMessage() without queue reported %v, want %v", err, ErrWriteQueueClosed)
+	}
+}
+
+// waitQueueEmpty waits for the writer goroutine to take all queued messages.
+func waitQueueEmpty(c *Conn) {
+	for {
+		c.writeQueue.mu.Lock()
+		n := len(c.writeQueue.messages)
+		c.writeQueue.mu.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWriteQueueOverflow(t *testing.T) {
+	for _, policy := range []OverflowPolicy{OverflowBlock, OverflowDropNewest, OverflowDropOldest, OverflowClose} {
+		server, client := newPipeConns()
+		server.EnableWriteQueue(WriteQueueConfig{Size: 1, Overflow: policy})
+
+		// The first message blocks in the writer until the client reads it and
+		// the second message fills the queue.
+		done1 := server.QueueMessage(TextMessage, []byte("1"))
+		waitQueueEmpty(server)
+		done2 := server.QueueMessage(TextMessage, []byte("2"))
+		done3 := make(chan (<-chan error), 1)
+		go func() { done3 <- server.QueueMessage(TextMessage, []byte("3")) }()
+
+		switch policy {
+		case OverflowBlock:
+			for _, want := range []string{"1", "2", "3"} {
+				_, p, err := client.ReadMessage()
+				if err != nil || string(p) != want {
+					t.Fatalf("block: ReadMessage() = %q, %v, want %q", p, err, want)
+				}
+			}
+			for i, done := range []<-chan error{done1, done2, <-done3} {
+				if err := <-done; err != nil {
+					t.Errorf("block: message %d reported %v", i+1, err)
+				}
+			}
+		case OverflowDropNewest:
+			if err := <-<-done3; err != ErrWriteQueueFull {
+				t.Errorf("drop newest: message 3 reported %v, want %v", err, ErrWriteQueueFull)
+			}
+			for _, want := range []string{"1", "2"} {
+				if _, p, err := client.ReadMessage(); err != nil || string(p) != want {
+					t.Fatalf("drop newest: ReadMessage() = %q, %v, want %q", p, err, want)
+				}
+			}
+		case OverflowDropOldest:
+			if err := <-done2; err != ErrWriteQueueFull {
+				t.Errorf("drop oldest: message 2 reported %v, want %v", err, ErrWriteQueueFull)
+			}
+			for _, want := range []string{"1", "3"} {
+				if _, p, err := client.ReadMessage(); err != nil || string(p) != want {
+					t.Fatalf("drop oldest: ReadMessage() = %q, %v, want %q", p, err, want)
+				}
+			}
+		case OverflowClose:
+			if err := <-<-done3; err != ErrWriteQueueFull {
+				t.Errorf("close: message 3 reported %v, want %v", err, ErrWriteQueueFull)
+			}
+			if err := <-done2; err != ErrWriteQueueFull {
+				t.Errorf("close: message 2 reported %v, want %v", err, ErrWriteQueueFull)
+			}
+			if err := <-done1; err == nil {
+				t.Error("close: message 1 written to closed connection")
+			}
+		}
+		server.Close()
+		client.Close()
+	}
+}
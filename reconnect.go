@@ -0,0 +1,284 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package websocket
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/protocol"
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
+)
+
+const (
+	defaultBackoffInitial    = 500 * time.Millisecond
+	defaultBackoffMax        = 30 * time.Second
+	defaultBackoffMultiplier = 2
+	defaultStableDuration    = 10 * time.Second
+)
+
+// DefaultRetryableCloseCodes are the close codes after which a
+// ReconnectingClient redials by default. CloseAbnormalClosure is reported when
+// the connection is lost without a close message.
+var DefaultRetryableCloseCodes = []int{
+	CloseGoingAway,
+	CloseAbnormalClosure,
+	CloseServiceRestart,
+	CloseTryAgainLater,
+}
+
+// Backoff specifies an exponential backoff policy. The zero value uses the
+// defaults documented for each field.
+type Backoff struct {
+	// Initial is the delay before the first retry. The default is 500ms.
+	Initial time.Duration
+
+	// Max is the upper bound of the delay. The default is 30s.
+	Max time.Duration
+
+	// Multiplier is the factor by which the delay grows after every failed
+	// attempt. The default is 2.
+	Multiplier float64
+
+	// Jitter is the fraction of the delay, between 0 and 1, that is
+	// randomized to avoid many clients redialing in lockstep. A jitter of 0.2
+	// yields delays between 80% and 100% of the computed value.
+	Jitter float64
+}
+
+// Delay returns the delay before retry number attempt, starting at zero.
+func (b Backoff) Delay(attempt int) time.Duration {
+	initial, max, multiplier := b.Initial, b.Max, b.Multiplier
+	if initial <= 0 {
+		initial = defaultBackoffInitial
+	}
+	if max <= 0 {
+		max = defaultBackoffMax
+	}
+	if multiplier < 1 {
+		multiplier = defaultBackoffMultiplier
+	}
+
+	d := float64(initial)
+	for i := 0; i < attempt && d < float64(max); i++ {
+		d *= multiplier
+	}
+	if d > float64(max) {
+		d = float64(max)
+	}
+	if b.Jitter > 0 {
+		jitter := b.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		d -= d * jitter * rand.Float64()
+	}
+	return time.Duration(d)
+}
+
+// ReconnectingClient maintains a client connection to a WebSocket server and
+// redials with exponential backoff when the connection fails.
+//
+// Use the OnConnect hook to restore session state, such as subscriptions,
+// after every reconnect.
+type ReconnectingClient struct {
+	// Dialer is used to connect to the server. If nil, DefaultDialer is used.
+	Dialer *Dialer
+
+	// URL is the ws or wss URL of the server.
+	URL string
+
+	// Header is sent with every handshake request.
+	Header http.Header
+
+	// Backoff specifies the delays between dial attempts.
+	Backoff Backoff
+
+	// MaxAttempts is the number of consecutive failed attempts after which
+	// Run gives up. Failed dials and connections that end before
+	// StableDuration both count as failed attempts. Zero means no limit.
+	MaxAttempts int
+
+	// StableDuration is how long a connection must stay up for the backoff
+	// to start over. Connections that end sooner grow the delay before the
+	// next dial as failed dials do. The default is 10s.
+	StableDuration time.Duration
+
+	// RetryableCloseCodes are the close codes after which the client redials.
+	// If nil, DefaultRetryableCloseCodes is used. The connection is not
+	// redialed after other close codes.
+	RetryableCloseCodes []int
+
+	// ShouldRetry, if not nil, decides whether the client redials after err.
+	// It overrides RetryableCloseCodes. By default, close errors are retried
+	// according to RetryableCloseCodes. Errors that cannot clear up on retry
+	// are not retried: a malformed URL or request header, and a handshake
+	// rejected by the server with a status other than 5xx or 429 Too Many
+	// Requests, or completed with a subprotocol or extension that was not
+	// offered. All other errors, such as network errors, are retried.
+	ShouldRetry func(err error) bool
+
+	// OnConnect, if not nil, is called after every successful handshake
+	// before the handler. If OnConnect returns an error, the connection is
+	// closed and the error is handled as if returned by the handler.
+	OnConnect func(ctx context.Context, conn *Conn) error
+
+	// OnDisconnect, if not nil, is called after a connection ends with the
+	// error that ended it.
+	OnDisconnect func(conn *Conn, err error)
+
+	mu   sync.Mutex
+	conn *Conn
+}
+
+// Conn returns the current connection, or nil if the client is not connected.
+// The connection may fail at any time. Applications writing from several
+// goroutines must serialize writes as described in the package documentation.
+func (rc *ReconnectingClient) Conn() *Conn {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.conn
+}
+
+func (rc *ReconnectingClient) setConn(conn *Conn) {
+	rc.mu.Lock()
+	rc.conn = conn
+	rc.mu.Unlock()
+}
+
+func (rc *ReconnectingClient) shouldRetry(err error, resp *protocol.Response) bool {
+	if rc.ShouldRetry != nil {
+		return rc.ShouldRetry(err)
+	}
+	var ue *url.Error
+	if err == errMalformedURL || errors.Is(err, errDuplicateHeader) || (errors.As(err, &ue) && ue.Op == "parse") {
+		return false
+	}
+	if errors.Is(err, ErrBadHandshake) {
+		// The server rejected the handshake or selected a subprotocol or
+		// extension that was not offered. Only server errors and rate
+		// limiting may clear up.
+		if resp == nil {
+			return false
+		}
+		code := resp.StatusCode()
+		return code >= consts.StatusInternalServerError || code == consts.StatusTooManyRequests
+	}
+	var ce *CloseError
+	if errors.As(err, &ce) {
+		codes := rc.RetryableCloseCodes
+		if codes == nil {
+			codes = DefaultRetryableCloseCodes
+		}
+		return IsCloseError(ce, codes...)
+	}
+	return true
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run connects to the server and calls handler with every connection. The
+// handler typically runs the application's read loop and returns the error
+// from reading the connection. When the handler returns a non-nil error that
+// is retryable, Run redials the server; otherwise Run returns the error. A
+// nil error from the handler stops Run.
+//
+// Run closes the current connection and returns the context error when ctx
+// is canceled.
+func (rc *ReconnectingClient) Run(ctx context.Context, handler func(ctx context.Context, conn *Conn) error) error {
+	d := rc.Dialer
+	if d == nil {
+		d = DefaultDialer
+	}
+
+	stable := rc.StableDuration
+	if stable <= 0 {
+		stable = defaultStableDuration
+	}
+
+	attempt := 0
+	for {
+		conn, resp, err := d.Dial(ctx, rc.URL, rc.Header)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			attempt++
+			if !rc.shouldRetry(err, resp) || (rc.MaxAttempts > 0 && attempt >= rc.MaxAttempts) {
+				return err
+			}
+			if err := sleep(ctx, rc.Backoff.Delay(attempt-1)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		start := time.Now()
+		err = rc.serve(ctx, conn, handler)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil || !rc.shouldRetry(err, nil) {
+			return err
+		}
+		if time.Since(start) >= stable {
+			attempt = 0
+		}
+		attempt++
+		if rc.MaxAttempts > 0 && attempt >= rc.MaxAttempts {
+			return err
+		}
+		if err := sleep(ctx, rc.Backoff.Delay(attempt-1)); err != nil {
+			return err
+		}
+	}
+}
+
+// serve runs the hooks and the handler for a single connection.
+func (rc *ReconnectingClient) serve(ctx context.Context, conn *Conn, handler func(ctx context.Context, conn *Conn) error) error {
+	rc.setConn(conn)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	var err error
+	if rc.OnConnect != nil {
+		err = rc.OnConnect(ctx, conn)
+	}
+	if err == nil {
+		err = handler(ctx, conn)
+	}
+
+	close(done)
+	rc.setConn(nil)
+	conn.Close()
+	if rc.OnDisconnect != nil {
+		rc.OnDisconnect(conn, err)
+	}
+	return err
+}
@@ -0,0 +1,210 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package websocket
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/server"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{Initial: 10 * time.Millisecond, Max: 50 * time.Millisecond, Multiplier: 2}
+	want := []time.Duration{10, 20, 40, 50, 50}
+	for i, w := range want {
+		if d := b.Delay(i); d != w*time.Millisecond {
+			t.Errorf("Delay(%d) = %v, want %v", i, d, w*time.Millisecond)
+		}
+	}
+
+	b.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := b.Delay(1); d < 10*time.Millisecond || d > 20*time.Millisecond {
+			t.Fatalf("Delay(1) with jitter = %v, want between 10ms and 20ms", d)
+		}
+	}
+
+	if d := (Backoff{}).Delay(0); d != defaultBackoffInitial {
+		t.Errorf("default Delay(0) = %v, want %v", d, defaultBackoffInitial)
+	}
+}
+
+func TestReconnectingClient(t *testing.T) {
+	addr := freeAddr()
+
+	// The server asks the client to reconnect twice and then closes the
+	// connection normally.
+	var sessions int32
+	h := server.Default(server.WithHostPorts(addr))
+	h.NoHijackConnPool = true
+	h.GET(testpath, func(_ context.Context, c *app.RequestContext) {
+		upgrader := HertzUpgrader{}
+		err := upgrader.Upgrade(c, func(conn *Conn) {
+			code := CloseServiceRestart
+			if atomic.AddInt32(&sessions, 1) > 2 {
+				code = CloseNormalClosure
+			}
+			conn.WriteMessage(CloseMessage, FormatCloseMessage(code, ""))
+		})
+		if err != nil {
+			log.Print("upgrade:", err)
+		}
+	})
+	go h.Run()
+
+	// The client redials until the server is listening.
+	var connects, disconnects int
+	rc := &ReconnectingClient{
+		URL:     "ws://" + addr + testpath,
+		Backoff: Backoff{Initial: 10 * time.Millisecond, Max: 50 * time.Millisecond},
+		OnConnect: func(ctx context.Context, conn *Conn) error {
+			connects++
+			return nil
+		},
+		OnDisconnect: func(conn *Conn, err error) {
+			disconnects++
+		},
+	}
+	err := rc.Run(context.Background(), func(ctx context.Context, conn *Conn) error {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return err
+			}
+		}
+	})
+	if !IsCloseError(err, CloseNormalClosure) {
+		t.Fatalf("Run returned %v, want close error %d", err, CloseNormalClosure)
+	}
+	if connects != 3 || disconnects != 3 {
+		t.Errorf("connects, disconnects = %d, %d, want 3, 3", connects, disconnects)
+	}
+	if rc.Conn() != nil {
+		t.Error("Conn() is not nil after Run returned")
+	}
+
+	// Connections closed right after the handshake count as failed attempts.
+	connects = 0
+	rc = &ReconnectingClient{
+		URL:         "ws://" + addr + testpath,
+		Backoff:     Backoff{Initial: 10 * time.Millisecond},
+		MaxAttempts: 3,
+		ShouldRetry: func(err error) bool { return true },
+		OnConnect: func(ctx context.Context, conn *Conn) error {
+			connects++
+			return nil
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = rc.Run(ctx, func(ctx context.Context, conn *Conn) error {
+		_, _, err := conn.ReadMessage()
+		return err
+	})
+	if !IsCloseError(err, CloseNormalClosure) {
+		t.Fatalf("Run of short-lived connections returned %v, want close error %d", err, CloseNormalClosure)
+	}
+	if connects != 3 {
+		t.Errorf("connects = %d, want 3", connects)
+	}
+}
+
+func TestReconnectingClientDialFailure(t *testing.T) {
+	rc := &ReconnectingClient{
+		URL:         "ws://localhost:1/",
+		Backoff:     Backoff{Initial: time.Millisecond},
+		MaxAttempts: 3,
+	}
+	err := rc.Run(context.Background(), func(ctx context.Context, conn *Conn) error {
+		t.Error("handler called without a connection")
+		return nil
+	})
+	if err == nil {
+		t.Fatal("Run did not return an error")
+	}
+
+	rc = &ReconnectingClient{URL: "http://localhost:1/"}
+	if err := rc.Run(context.Background(), nil); err != errMalformedURL {
+		t.Errorf("Run with http URL returned %v, want %v", err, errMalformedURL)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	rc = &ReconnectingClient{URL: "ws://localhost:1/", Backoff: Backoff{Initial: time.Millisecond}}
+	if err := rc.Run(ctx, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Run with expired context returned %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestReconnectingClientFatalErrors(t *testing.T) {
+	var requests int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch r.URL.Path {
+		case "/forbidden":
+			w.WriteHeader(http.StatusForbidden)
+		case "/unavailable":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/subprotocol":
+			// The server selects a subprotocol the client did not offer.
+			conn, brw, _ := w.(http.Hijacker).Hijack()
+			defer conn.Close()
+			brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+				"Sec-WebSocket-Accept: " + computeAcceptKeyBytes([]byte(r.Header.Get("Sec-Websocket-Key"))) + "\r\n" +
+				"Sec-WebSocket-Protocol: other\r\n\r\n")
+			brw.Flush()
+		}
+	}))
+	defer s.Close()
+	base := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	// The backoff is long enough for a retry to time out the test.
+	for _, tt := range []struct {
+		url    string
+		header http.Header
+		err    error
+	}{
+		{"ws://%zz/", nil, nil}, // URL parse error
+		{base + "/", http.Header{"Upgrade": {"websocket"}}, errDuplicateHeader},
+		{base + "/forbidden", nil, ErrBadHandshake},
+		{base + "/subprotocol", nil, ErrBadHandshake},
+	} {
+		atomic.StoreInt32(&requests, 0)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		rc := &ReconnectingClient{URL: tt.url, Header: tt.header, Backoff: Backoff{Initial: time.Hour}}
+		err := rc.Run(ctx, func(ctx context.Context, conn *Conn) error {
+			t.Errorf("%s: handler called", tt.url)
+			return nil
+		})
+		cancel()
+		if err == nil || errors.Is(err, context.DeadlineExceeded) || (tt.err != nil && !errors.Is(err, tt.err)) {
+			t.Errorf("Run(%s) returned %v, want %v without retrying", tt.url, err, tt.err)
+		}
+		if n := atomic.LoadInt32(&requests); n > 1 {
+			t.Errorf("Run(%s) sent %d requests, want at most 1", tt.url, n)
+		}
+	}
+
+	// Server errors are retried.
+	atomic.StoreInt32(&requests, 0)
+	rc := &ReconnectingClient{URL: base + "/unavailable", Backoff: Backoff{Initial: time.Millisecond}, MaxAttempts: 3}
+	if err := rc.Run(context.Background(), nil); !errors.Is(err, ErrBadHandshake) {
+		t.Errorf("Run(unavailable) returned %v, want %v", err, ErrBadHandshake)
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("Run(unavailable) sent %d requests, want 3", n)
+	}
+}
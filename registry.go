@@ -0,0 +1,263 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package websocket
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNotRegistered is returned for connections that are not in a registry.
+var ErrNotRegistered = errors.New("websocket: connection not registered")
+
+// connIDs generates the connection IDs.
+var connIDs uint64
+
+// ID returns an identifier of the connection that is unique within the
+// process. The ID is assigned on the first call.
+func (c *Conn) ID() string {
+	c.idOnce.Do(func() {
+		c.id = strconv.FormatUint(atomic.AddUint64(&connIDs, 1), 10)
+	})
+	return c.id
+}
+
+type registryLabel struct {
+	key, value string
+}
+
+// Registry tracks live connections by ID and by labels, such as the user ID,
+// tenant or device of a connection. Set HertzUpgrader.Registry to register
+// the upgraded connections for the duration of the handler. A Registry is
+// safe for concurrent use.
+type Registry struct {
+	mu     sync.RWMutex
+	conns  map[string]*Conn
+	labels map[*Conn]map[string]string
+	index  map[registryLabel]map[*Conn]struct{}
+
+	shutdown *shutdownState // nil until Shutdown is called
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		conns:  make(map[string]*Conn),
+		labels: make(map[*Conn]map[string]string),
+		index:  make(map[registryLabel]map[*Conn]struct{}),
+	}
+}
+
+// Add adds c to the registry with the given labels and returns its ID. The
+// labels are added to those of a connection already in the registry.
+func (r *Registry) Add(c *Conn, labels map[string]string) string {
+	id := c.ID()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.labels[c] == nil {
+		r.conns[id] = c
+		r.labels[c] = make(map[string]string)
+		if r.shutdown != nil {
+			go r.shutdown.closeConn(c)
+		}
+	}
+	for key, value := range labels {
+		r.setLabel(c, key, value)
+	}
+	return id
+}
+
+// Remove removes c from the registry.
+func (r *Registry) Remove(c *Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key := range r.labels[c] {
+		r.deleteLabel(c, key)
+	}
+	delete(r.labels, c)
+	if r.conns[c.ID()] == c {
+		delete(r.conns, c.ID())
+		if len(r.conns) == 0 && r.shutdown != nil {
+			r.shutdown.drained()
+		}
+	}
+}
+
+// SetLabel sets the label key of c to value.
+func (r *Registry) SetLabel(c *Conn, key, value string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.labels[c] == nil {
+		return ErrNotRegistered
+	}
+	r.setLabel(c, key, value)
+	return nil
+}
+
+func (r *Registry) setLabel(c *Conn, key, value string) {
+	r.deleteLabel(c, key)
+	r.labels[c][key] = value
+	l := registryLabel{key, value}
+	conns := r.index[l]
+	if conns == nil {
+		conns = make(map[*Conn]struct{})
+		r.index[l] = conns
+	}
+	conns[c] = struct{}{}
+}
+
+// DeleteLabel removes the label key of c.
+func (r *Registry) DeleteLabel(c *Conn, key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deleteLabel(c, key)
+}
+
+func (r *Registry) deleteLabel(c *Conn, key string) {
+	value, ok := r.labels[c][key]
+	if !ok {
+		return
+	}
+	delete(r.labels[c], key)
+	l := registryLabel{key, value}
+	delete(r.index[l], c)
+	if len(r.index[l]) == 0 {
+		delete(r.index, l)
+	}
+}
+
+// Labels returns a copy of the labels of c, nil if c is not registered.
+func (r *Registry) Labels(c *Conn) map[string]string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	labels, ok := r.labels[c]
+	if !ok {
+		return nil
+	}
+	m := make(map[string]string, len(labels))
+	for key, value := range labels {
+		m[key] = value
+	}
+	return m
+}
+
+// Get returns the connection with the given ID.
+func (r *Registry) Get(id string) (*Conn, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	c, ok := r.conns[id]
+	return c, ok
+}
+
+// Lookup returns the connections whose label key is value.
+func (r *Registry) Lookup(key, value string) []*Conn {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	conns := make([]*Conn, 0, len(r.index[registryLabel{key, value}]))
+	for c := range r.index[registryLabel{key, value}] {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// Len returns the number of connections in the registry.
+func (r *Registry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.conns)
+}
+
+// Range calls f for each connection in the registry until f returns false.
+// Range iterates over a snapshot of the registry, so f may add and remove
+// connections.
+func (r *Registry) Range(f func(c *Conn) bool) {
+	r.mu.RLock()
+	conns := make([]*Conn, 0, len(r.conns))
+	for _, c := range r.conns {
+		conns = append(conns, c)
+	}
+	r.mu.RUnlock()
+	for _, c := range conns {
+		if !f(c) {
+			return
+		}
+	}
+}
+
+// Send writes a message to the connection with the given ID. If the
+// connection has a write queue, the message is queued and Send waits for the
+// result; otherwise the application must not write to the connection
+// concurrently, as with WriteMessage.
+func (r *Registry) Send(id string, messageType int, data []byte) error {
+	c, ok := r.Get(id)
+	if !ok {
+		return ErrNotRegistered
+	}
+	return c.send(messageType, data)
+}
+
+// SendLabel writes a message to the connections whose label key is value
+// and returns the number of connections the message was written to. See
+// Send for the rules about concurrent writes.
+func (r *Registry) SendLabel(key, value string, messageType int, data []byte) int {
+	pm, err := NewPreparedMessage(messageType, data)
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, c := range r.Lookup(key, value) {
+		var err error
+		if c.writeQueue != nil {
+			err = <-c.QueuePreparedMessage(pm)
+		} else {
+			err = c.WritePreparedMessage(pm)
+		}
+		if err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+func (c *Conn) send(messageType int, data []byte) error {
+	if c.writeQueue != nil {
+		return <-c.QueueMessage(messageType, data)
+	}
+	return c.WriteMessage(messageType, data)
+}
+
+// Close sends a close message with the given code and text to the
+// connection with the given ID, closes the connection and removes it from
+// the registry. The handler of the connection sees a read error.
+func (r *Registry) Close(id string, code int, text string) error {
+	c, ok := r.Get(id)
+	if !ok {
+		return ErrNotRegistered
+	}
+	r.closeConn(c, code, text)
+	return nil
+}
+
+// CloseLabel closes the connections whose label key is value as with Close
+// and returns the number of connections closed.
+func (r *Registry) CloseLabel(key, value string, code int, text string) int {
+	conns := r.Lookup(key, value)
+	for _, c := range conns {
+		r.closeConn(c, code, text)
+	}
+	return len(conns)
+}
+
+func (r *Registry) closeConn(c *Conn, code int, text string) {
+	c.WriteControl(CloseMessage, FormatCloseMessage(code, text), time.Now().Add(writeWait))
+	c.Close()
+	r.Remove(c)
+}
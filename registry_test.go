@@ -0,0 +1,199 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package websocket
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/server"
+)
+
+func TestConnID(t *testing.T) {
+	c1, c2 := newPipeConns()
+	defer c1.Close()
+	defer c2.Close()
+	if c1.ID() == "" || c1.ID() == c2.ID() || c1.ID() != c1.ID() {
+		t.Errorf("ID() = %q and %q", c1.ID(), c2.ID())
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	s1, c1 := newPipeConns()
+	s2, c2 := newPipeConns()
+	defer c1.Close()
+	defer c2.Close()
+
+	id1 := r.Add(s1, map[string]string{"user": "alice", "device": "phone"})
+	id2 := r.Add(s2, map[string]string{"user": "alice"})
+	if id1 != s1.ID() || r.Len() != 2 {
+		t.Fatalf("Add() = %q, Len() = %d", id1, r.Len())
+	}
+	if c, ok := r.Get(id2); !ok || c != s2 {
+		t.Errorf("Get(%q) = %v, %v", id2, c, ok)
+	}
+	if conns := r.Lookup("user", "alice"); len(conns) != 2 {
+		t.Errorf("Lookup(user, alice) returned %d connections, want 2", len(conns))
+	}
+	if err := r.SetLabel(s2, "user", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if conns := r.Lookup("user", "alice"); len(conns) != 1 || conns[0] != s1 {
+		t.Errorf("Lookup(user, alice) = %v after relabel", conns)
+	}
+	if labels := r.Labels(s1); len(labels) != 2 || labels["device"] != "phone" {
+		t.Errorf("Labels() = %v", labels)
+	}
+	r.DeleteLabel(s1, "device")
+	if conns := r.Lookup("device", "phone"); len(conns) != 0 {
+		t.Errorf("Lookup(device, phone) = %v after DeleteLabel", conns)
+	}
+
+	n := 0
+	r.Range(func(c *Conn) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Errorf("Range() called f %d times after it returned false", n)
+	}
+
+	go r.Send(id1, TextMessage, []byte("hello"))
+	if _, p, err := c1.ReadMessage(); err != nil || string(p) != "hello" {
+		t.Errorf("ReadMessage() = %q, %v", p, err)
+	}
+	s2.EnableWriteQueue(WriteQueueConfig{})
+	sent := make(chan int, 1)
+	go func() { sent <- r.SendLabel("user", "bob", TextMessage, []byte("queued")) }()
+	if _, p, err := c2.ReadMessage(); err != nil || string(p) != "queued" {
+		t.Errorf("ReadMessage() = %q, %v", p, err)
+	}
+	if n := <-sent; n != 1 {
+		t.Errorf("SendLabel() = %d, want 1", n)
+	}
+
+	r.Remove(s1)
+	if _, ok := r.Get(id1); ok || r.Len() != 1 || r.Labels(s1) != nil {
+		t.Errorf("connection found after Remove")
+	}
+	if err := r.Send(id1, TextMessage, nil); err != ErrNotRegistered {
+		t.Errorf("Send() to a removed connection returned %v, want %v", err, ErrNotRegistered)
+	}
+	if err := r.SetLabel(s1, "user", "alice"); err != ErrNotRegistered {
+		t.Errorf("SetLabel() on a removed connection returned %v, want %v", err, ErrNotRegistered)
+	}
+	s1.Close()
+}
+
+func TestRegistryClose(t *testing.T) {
+	r := NewRegistry()
+	s, c := newPipeConns()
+	defer c.Close()
+	r.Add(s, map[string]string{"user": "alice"})
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := c.ReadMessage()
+		done <- err
+	}()
+	if n := r.CloseLabel("user", "alice", ClosePolicyViolation, "kicked"); n != 1 {
+		t.Errorf("CloseLabel() = %d, want 1", n)
+	}
+	var ce *CloseError
+	if err := <-done; !errors.As(err, &ce) || ce.Code != ClosePolicyViolation || ce.Text != "kicked" {
+		t.Errorf("ReadMessage() returned %v, want close %d", err, ClosePolicyViolation)
+	}
+	if r.Len() != 0 {
+		t.Errorf("Len() = %d after CloseLabel", r.Len())
+	}
+	if _, _, err := s.ReadMessage(); err == nil {
+		t.Error("ReadMessage() on the closed connection succeeded")
+	}
+	if err := r.Close(s.ID(), CloseNormalClosure, ""); err != ErrNotRegistered {
+		t.Errorf("Close() returned %v, want %v", err, ErrNotRegistered)
+	}
+}
+
+func TestUpgradeRegistry(t *testing.T) {
+	addr := freeAddr()
+	r := NewRegistry()
+	runServerWithUpgrader(addr, &HertzUpgrader{Registry: r})
+	time.Sleep(50 * time.Millisecond) // await server running
+
+	conn, err := dialTestServer(addr, &ClientUpgrader{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	if r.Len() != 1 {
+		t.Fatalf("Len() = %d while the handler runs, want 1", r.Len())
+	}
+
+	// The connection is removed when the handler returns.
+	conn.Close()
+	for i := 0; r.Len() != 0; i++ {
+		if i == 100 {
+			t.Fatalf("Len() = %d after the handler returned, want 0", r.Len())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUpgradeRegistryHandlerPanic(t *testing.T) {
+	addr := freeAddr()
+	r := NewRegistry()
+	upgrader := HertzUpgrader{Registry: r}
+	h := server.Default(server.WithHostPorts(addr))
+	h.NoHijackConnPool = true
+	h.GET(testpath, func(_ context.Context, ctx *app.RequestContext) {
+		upgrader.Upgrade(ctx, func(conn *Conn) {
+			conn.ReadMessage()
+			panic("handler failed")
+		})
+	})
+	go h.Run()
+	time.Sleep(50 * time.Millisecond) // await server running
+
+	conn, err := dialTestServer(addr, &ClientUpgrader{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; r.Len() != 1; i++ {
+		if i == 100 {
+			t.Fatal("connection not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := conn.WriteMessage(TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The connection is removed when the handler panics, so Shutdown does
+	// not wait for it.
+	for i := 0; r.Len() != 0; i++ {
+		if i == 100 {
+			t.Fatalf("Len() = %d after the handler panicked, want 0", r.Len())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := r.Shutdown(ctx, CloseGoingAway, ""); err != nil {
+		t.Errorf("Shutdown() returned %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Envelope is the message format used by Router. Type selects the handler,
+// ID correlates a reply with its request and Payload holds the message body.
+type Envelope struct {
+	Type    string      `json:"type" msgpack:"type" cbor:"type"`
+	ID      string      `json:"id,omitempty" msgpack:"id,omitempty" cbor:"id,omitempty"`
+	Payload interface{} `json:"payload,omitempty" msgpack:"payload,omitempty" cbor:"payload,omitempty"`
+}
+
+// ErrorType is the envelope type of the errors sent by Router.
+const ErrorType = "error"
+
+// Codes of the errors sent by Router.
+const (
+	ErrorCodeBadMessage  = "bad_message"
+	ErrorCodeBadPayload  = "bad_payload"
+	ErrorCodeUnknownType = "unknown_type"
+)
+
+// MessageError is an error reported to the peer in the payload of an envelope
+// of type ErrorType.
+type MessageError struct {
+	Code    string `json:"code" msgpack:"code" cbor:"code"`
+	Message string `json:"message" msgpack:"message" cbor:"message"`
+}
+
+func (e *MessageError) Error() string {
+	return fmt.Sprintf("websocket: %s: %s", e.Code, e.Message)
+}
+
+// MessageHandler handles a message dispatched by Router. Handlers returning
+// a *MessageError report it to the peer; other errors stop Router.Serve.
+type MessageHandler func(ctx context.Context, m *Message) error
+
+// Router dispatches the envelopes read from a connection to handlers by
+// envelope type. Envelopes are encoded with the codec of the connection,
+// which must support struct fields, such as JSON, MessagePack or CBOR.
+//
+// Routes are registered before Serve is called. A Router may serve several
+// connections concurrently.
+type Router struct {
+	middleware []MessageHandler
+	routes     map[string][]MessageHandler
+}
+
+// NewRouter returns an empty router.
+func NewRouter() *Router {
+	return &Router{routes: make(map[string][]MessageHandler)}
+}
+
+// Use adds middleware run before the handlers of every route.
+func (r *Router) Use(middleware ...MessageHandler) {
+	r.middleware = append(r.middleware, middleware...)
+}
+
+// Handle registers the handlers for messages of type typ. As with Hertz
+// routes, the handlers run in order; a handler calls Message.Next to run the
+// rest of the chain within it, or returns to continue with the next handler.
+func (r *Router) Handle(typ string, handlers ...MessageHandler) {
+	if typ == "" {
+		panic("websocket: empty message type")
+	}
+	if len(handlers) == 0 {
+		panic("websocket: no handlers for message type " + typ)
+	}
+	if _, ok := r.routes[typ]; ok {
+		panic("websocket: handlers already registered for message type " + typ)
+	}
+	r.routes[typ] = handlers
+}
+
+// Serve reads envelopes from c and dispatches them until reading fails or a
+// handler returns an error that is not a *MessageError. Envelopes that
+// cannot be decoded or have no route are answered with an error envelope.
+// Serve returns the error that stopped it.
+func (r *Router) Serve(ctx context.Context, c *Conn) error {
+	for {
+		_, p, err := c.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if err := r.dispatch(ctx, c, p); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *Router) dispatch(ctx context.Context, c *Conn, p []byte) error {
+	m := &Message{Conn: c, data: p, index: -1}
+	var header struct {
+		Type string `json:"type" msgpack:"type" cbor:"type"`
+		ID   string `json:"id" msgpack:"id" cbor:"id"`
+	}
+	err := c.Codec().Unmarshal(p, &header)
+	m.Type, m.ID = header.Type, header.ID
+	switch {
+	case err != nil:
+		err = &MessageError{Code: ErrorCodeBadMessage, Message: err.Error()}
+	case m.Type == "":
+		err = &MessageError{Code: ErrorCodeBadMessage, Message: "message has no type"}
+	case r.routes[m.Type] == nil:
+		err = &MessageError{Code: ErrorCodeUnknownType, Message: fmt.Sprintf("unknown message type %q", m.Type)}
+	default:
+		route := r.routes[m.Type]
+		m.handlers = make([]MessageHandler, 0, len(r.middleware)+len(route))
+		m.handlers = append(append(m.handlers, r.middleware...), route...)
+		err = m.Next(ctx)
+	}
+
+	var me *MessageError
+	if errors.As(err, &me) {
+		return c.WriteValue(Envelope{Type: ErrorType, ID: m.ID, Payload: me})
+	}
+	return err
+}
+
+// Message is an envelope dispatched by Router.
+type Message struct {
+	// Conn is the connection the message was read from.
+	Conn *Conn
+
+	// Type and ID are the type and ID of the envelope.
+	Type, ID string
+
+	data     []byte
+	handlers []MessageHandler
+	index    int
+}
+
+// Next runs the remaining handlers of the route. It returns the first error
+// returned by a handler.
+func (m *Message) Next(ctx context.Context) error {
+	m.index++
+	for m.index < len(m.handlers) {
+		if err := m.handlers[m.index](ctx, m); err != nil {
+			return err
+		}
+		m.index++
+	}
+	return nil
+}
+
+// Abort prevents the remaining handlers of the route from running.
+func (m *Message) Abort() {
+	m.index = len(m.handlers)
+}
+
+// payloadTypes caches the envelope types used to decode payloads.
+var payloadTypes sync.Map // map[reflect.Type]reflect.Type
+
+// Bind decodes the payload of the envelope into the value pointed to by v. A
+// payload that cannot be decoded is reported as a *MessageError.
+func (m *Message) Bind(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("websocket: Bind(non-pointer %T)", v)
+	}
+	t := rv.Type().Elem()
+	et, ok := payloadTypes.Load(t)
+	if !ok {
+		et, _ = payloadTypes.LoadOrStore(t, reflect.StructOf([]reflect.StructField{{
+			Name: "Payload",
+			Type: t,
+			Tag:  `json:"payload" msgpack:"payload" cbor:"payload"`,
+		}}))
+	}
+
+	e := reflect.New(et.(reflect.Type))
+	e.Elem().Field(0).Set(rv.Elem())
+	if err := m.Conn.Codec().Unmarshal(m.data, e.Interface()); err != nil {
+		return &MessageError{Code: ErrorCodeBadPayload, Message: err.Error()}
+	}
+	rv.Elem().Set(e.Elem().Field(0))
+	return nil
+}
+
+// Reply writes an envelope with the type and ID of the message and the given
+// payload to the connection.
+func (m *Message) Reply(payload interface{}) error {
+	return m.Conn.WriteValue(Envelope{Type: m.Type, ID: m.ID, Payload: payload})
+}
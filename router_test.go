@@ -0,0 +1,133 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package websocket
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type routerAdd struct {
+	A int `json:"a"`
+	B int `json:"b"`
+}
+
+type routerReply struct {
+	Type    string                 `json:"type"`
+	ID      string                 `json:"id"`
+	Payload map[string]interface{} `json:"payload"`
+}
+
+func newTestRouter(trace *[]string) *Router {
+	r := NewRouter()
+	r.Use(func(ctx context.Context, m *Message) error {
+		*trace = append(*trace, "global:"+m.Type)
+		return nil
+	})
+	r.Handle("add", func(ctx context.Context, m *Message) error {
+		*trace = append(*trace, "before")
+		err := m.Next(ctx)
+		*trace = append(*trace, "after")
+		return err
+	}, func(ctx context.Context, m *Message) error {
+		var req routerAdd
+		if err := m.Bind(&req); err != nil {
+			return err
+		}
+		return m.Reply(map[string]int{"sum": req.A + req.B})
+	})
+	r.Handle("denied", func(ctx context.Context, m *Message) error {
+		m.Abort()
+		return &MessageError{Code: "forbidden", Message: "not allowed"}
+	}, func(ctx context.Context, m *Message) error {
+		*trace = append(*trace, "not reached")
+		return nil
+	})
+	r.Handle("fail", func(ctx context.Context, m *Message) error {
+		return errors.New("fatal")
+	})
+	return r
+}
+
+func TestRouter(t *testing.T) {
+	for _, codec := range []Codec{nil, StdJSONCodec{}} {
+		server, client := newPipeConns()
+		server.SetCodec(codec)
+		client.SetCodec(codec)
+
+		var trace []string
+		done := make(chan error, 1)
+		go func() { done <- newTestRouter(&trace).Serve(context.Background(), server) }()
+
+		roundTrip := func(v interface{}) routerReply {
+			t.Helper()
+			if err := client.WriteValue(v); err != nil {
+				t.Fatalf("%T: WriteValue() returned %v", codec, err)
+			}
+			var reply routerReply
+			if err := client.ReadValue(&reply); err != nil {
+				t.Fatalf("%T: ReadValue() returned %v", codec, err)
+			}
+			return reply
+		}
+
+		reply := roundTrip(Envelope{Type: "add", ID: "1", Payload: routerAdd{2, 3}})
+		if reply.Type != "add" || reply.ID != "1" || reflect.ValueOf(reply.Payload["sum"]).Convert(reflect.TypeOf(0)).Int() != 5 {
+			t.Errorf("%T: add reply = %+v", codec, reply)
+		}
+
+		for _, tt := range []struct {
+			v    interface{}
+			code string
+		}{
+			{Envelope{Type: "nope", ID: "2"}, ErrorCodeUnknownType},
+			{Envelope{ID: "3"}, ErrorCodeBadMessage},
+			{Envelope{Type: "add", ID: "4", Payload: "not an object"}, ErrorCodeBadPayload},
+			{Envelope{Type: "denied", ID: "5"}, "forbidden"},
+		} {
+			reply := roundTrip(tt.v)
+			id := tt.v.(Envelope).ID
+			if reply.Type != ErrorType || reply.ID != id || reply.Payload["code"] != tt.code {
+				t.Errorf("%T: reply to %+v = %+v, want code %s", codec, tt.v, reply, tt.code)
+			}
+		}
+
+		client.WriteValue(Envelope{Type: "fail"})
+		if err := <-done; err == nil || err.Error() != "fatal" {
+			t.Errorf("%T: Serve() returned %v, want fatal", codec, err)
+		}
+		// Middleware runs only for routed messages, and Abort skips the rest
+		// of the route.
+		want := []string{"global:add", "before", "after", "global:add", "before", "after", "global:denied", "global:fail"}
+		if !reflect.DeepEqual(trace, want) {
+			t.Errorf("%T: trace = %v, want %v", codec, trace, want)
+		}
+		server.Close()
+		client.Close()
+	}
+}
+
+func TestRouterHandlePanics(t *testing.T) {
+	h := func(ctx context.Context, m *Message) error { return nil }
+	for _, f := range []func(r *Router){
+		func(r *Router) { r.Handle("", h) },
+		func(r *Router) { r.Handle("x") },
+		func(r *Router) { r.Handle("x", h); r.Handle("x", h) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("Handle() did not panic")
+				}
+			}()
+			f(NewRouter())
+		}()
+	}
+}
@@ -8,10 +8,12 @@
 package websocket
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"net/url"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cloudwego/hertz/pkg/app"
@@ -21,8 +23,6 @@ import (
 
 const badHandshake = "websocket: the client is not using the websocket protocol: "
 
-var strPermessageDeflate = []byte("permessage-deflate")
-
 // HandshakeError describes an error with the handshake from the peer.
 type HandshakeError struct {
 	message string
@@ -30,6 +30,28 @@ type HandshakeError struct {
 
 func (e HandshakeError) Error() string { return e.message }
 
+// HandshakeTimeoutError is returned when the opening handshake does not
+// complete within HandshakeTimeout. It satisfies the net.Error interface.
+type HandshakeTimeoutError struct {
+	// Duration is the handshake timeout that was exceeded.
+	Duration time.Duration
+
+	// Err is the underlying error, if any.
+	Err error
+}
+
+func (e *HandshakeTimeoutError) Error() string {
+	s := "websocket: handshake timed out after " + e.Duration.String()
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+func (e *HandshakeTimeoutError) Unwrap() error   { return e.Err }
+func (e *HandshakeTimeoutError) Timeout() bool   { return true }
+func (e *HandshakeTimeoutError) Temporary() bool { return false }
+
 var poolWriteBuffer = sync.Pool{
 	New: func() interface{} {
 		var buf []byte
@@ -41,12 +63,35 @@ var poolWriteBuffer = sync.Pool{
 // completed. This must be provided.
 type HertzHandler func(*Conn)
 
+// HertzContextHandler receives a websocket connection after the handshake has
+// been completed, together with the context passed to UpgradeContext. The
+// context is canceled when the handler returns.
+type HertzContextHandler func(context.Context, *Conn)
+
 // HertzUpgrader specifies parameters for upgrading an HTTP connection to a
 // WebSocket connection.
 type HertzUpgrader struct {
 	// HandshakeTimeout specifies the duration for the handshake to complete.
+	// The timeout starts when Upgrade is called and covers writing the
+	// handshake response, hijacking the connection and reading the first
+	// frame from the client. If the timeout expires before the response is
+	// sent, Upgrade replies with 503 Service Unavailable and returns a
+	// *HandshakeTimeoutError. If it expires after Upgrade returns, while
+	// Hertz writes the response or before it hijacks the connection, the
+	// connection is closed without calling the handler and the error is
+	// passed to HandshakeTimeoutHandler. If the first frame does not arrive
+	// in time, the read methods return a *HandshakeTimeoutError. The timeout
+	// no longer applies once the first frame is read or the handler sets a
+	// read deadline. Zero means no timeout.
 	HandshakeTimeout time.Duration
 
+	// HandshakeTimeoutHandler, if not nil, is called with the context passed
+	// to UpgradeContext and a *HandshakeTimeoutError when HandshakeTimeout
+	// expires after Upgrade returned, for example because the client does
+	// not read the handshake response. Upgrade has returned nil by then, so
+	// this is the only report of the failed handshake.
+	HandshakeTimeoutHandler func(c context.Context, err error)
+
 	// ReadBufferSize and WriteBufferSize specify I/O buffer sizes in bytes. If a buffer
 	// size is zero, then buffers allocated by the HTTP server are used. The
 	// I/O buffer sizes do not limit the size of the messages that can be sent
@@ -87,9 +132,72 @@ type HertzUpgrader struct {
 
 	// EnableCompression specify if the server should attempt to negotiate per
 	// message compression (RFC 7692). Setting this value to true does not
-	// guarantee that compression will be supported. Currently only "no context
-	// takeover" modes are supported.
+	// guarantee that compression will be supported. Offers that require the
+	// server to compress with a sliding window smaller than 32KB are declined.
 	EnableCompression bool
+
+	// ServerContextTakeover specifies if the server may reuse its compression
+	// context across messages. If false, the server negotiates
+	// "server_no_context_takeover". Context takeover improves the compression
+	// ratio of similar messages at the cost of keeping a compressor alive for
+	// the lifetime of the connection. At compression level 1 (flate.BestSpeed)
+	// messages shorter than 128 bytes are not compressed against earlier
+	// messages.
+	ServerContextTakeover bool
+
+	// ClientContextTakeover specifies if the client may reuse its compression
+	// context across messages. If false, the server negotiates
+	// "client_no_context_takeover". Otherwise the server keeps a sliding window
+	// of decompressed data for the lifetime of the connection.
+	ClientContextTakeover bool
+
+	// ClientMaxWindowBits limits the LZ77 sliding window the client may use
+	// to compress messages, and with it the memory the server needs for
+	// ClientContextTakeover. Valid values are 8 to 15. The limit is only sent
+	// to clients that advertise support for the "client_max_window_bits"
+	// parameter. Zero means no limit.
+	ClientMaxWindowBits int
+
+	// Extensions specifies the extensions the server supports in addition to
+	// permessage-deflate. An extension is used if the client offers it and
+	// Extension.Accept accepts the offer.
+	//
+	// If the application sets the Sec-WebSocket-Extensions response header
+	// before calling Upgrade, the header is sent as is and no extensions are
+	// negotiated. The application then processes the extensions itself, for
+	// example with Conn.NextFrame and Conn.WriteFrame.
+	Extensions []Extension
+
+	// Codecs maps subprotocols to the codec used by Conn.WriteValue and
+	// Conn.ReadValue. The codec of the negotiated subprotocol, or of the
+	// empty string if no subprotocol is negotiated, is set on the connection.
+	// Subprotocols must still list the subprotocols the server selects from.
+	Codecs map[string]Codec
+
+	// Registry, if not nil, holds the upgraded connections while the handler
+	// runs. The connection is added before the handler is called and removed
+	// when it returns; the handler labels the connection with
+	// Registry.SetLabel.
+	Registry *Registry
+
+	// Keepalive specifies the pings sent to detect unresponsive clients. The
+	// zero value disables keepalive.
+	Keepalive KeepaliveConfig
+
+	// ValidateUTF8 specifies if text messages received from the client are
+	// checked for valid UTF-8 while they are read, after decompression. On
+	// invalid text, the read methods return ErrInvalidUTF8 and the connection
+	// is failed with CloseInvalidFramePayloadData.
+	ValidateUTF8 bool
+
+	// ValidateWriteUTF8 specifies if text messages written to the client are
+	// checked for valid UTF-8. Writing invalid text returns ErrInvalidUTF8.
+	ValidateWriteUTF8 bool
+
+	// Interceptors are called in order for every data message read from and
+	// written to the client, for example to audit, redact or authorize
+	// messages. See Interceptor.
+	Interceptors []Interceptor
 }
 
 func (u *HertzUpgrader) returnError(ctx *app.RequestContext, status int, reason string) error {
@@ -104,6 +212,17 @@ func (u *HertzUpgrader) returnError(ctx *app.RequestContext, status int, reason
 	return err
 }
 
+func (u *HertzUpgrader) returnTimeoutError(ctx *app.RequestContext) error {
+	err := &HandshakeTimeoutError{Duration: u.HandshakeTimeout}
+	if u.Error != nil {
+		u.Error(ctx, consts.StatusServiceUnavailable, err)
+	} else {
+		ctx.AbortWithMsg(consts.StatusMessage(consts.StatusServiceUnavailable), consts.StatusServiceUnavailable)
+	}
+
+	return err
+}
+
 func (u *HertzUpgrader) selectSubprotocol(ctx *app.RequestContext) []byte {
 	if u.Subprotocols != nil {
 		clientProtocols := parseDataHeader(ctx.Request.Header.Peek("Sec-Websocket-Protocol"))
@@ -122,19 +241,76 @@ func (u *HertzUpgrader) selectSubprotocol(ctx *app.RequestContext) []byte {
 	return nil
 }
 
-func (u *HertzUpgrader) isCompressionEnable(ctx *app.RequestContext) bool {
-	extensions := parseDataHeader(ctx.Request.Header.Peek("Sec-WebSocket-Extensions"))
+// extensions returns the extensions the server negotiates.
+func (u *HertzUpgrader) extensions() []Extension {
+	if !u.EnableCompression {
+		return u.Extensions
+	}
+	return append([]Extension{deflateExtension{server: u}}, u.Extensions...)
+}
 
-	// Negotiate PMCE
-	if u.EnableCompression {
-		for _, ext := range extensions {
-			if bytes.HasPrefix(ext, strPermessageDeflate) {
-				return true
+// acceptDeflateOffer builds the response to a single permessage-deflate offer
+// as specified in RFC 7692, section 7.1. The offer is declined if it contains
+// unknown or invalid parameters or asks for a server window smaller than the
+// one used by compress/flate.
+func (u *HertzUpgrader) acceptDeflateOffer(params map[string]string) (CompressionParams, string, bool) {
+	cp := CompressionParams{
+		ServerNoContextTakeover: !u.ServerContextTakeover,
+		ClientNoContextTakeover: !u.ClientContextTakeover,
+		ServerMaxWindowBits:     defaultWindowBits,
+		ClientMaxWindowBits:     defaultWindowBits,
+	}
+	serverWindowBitsOffered := false
+	clientWindowBitsOffered := false
+	for k, v := range params {
+		switch k {
+		case "server_no_context_takeover":
+			if v != "" {
+				return CompressionParams{}, "", false
+			}
+			cp.ServerNoContextTakeover = true
+		case "client_no_context_takeover":
+			if v != "" {
+				return CompressionParams{}, "", false
 			}
+			cp.ClientNoContextTakeover = true
+		case "server_max_window_bits":
+			bits, ok := parseWindowBits(v)
+			if !ok || bits < defaultWindowBits {
+				return CompressionParams{}, "", false
+			}
+			serverWindowBitsOffered = true
+		case "client_max_window_bits":
+			if v != "" {
+				bits, ok := parseWindowBits(v)
+				if !ok {
+					return CompressionParams{}, "", false
+				}
+				cp.ClientMaxWindowBits = bits
+			}
+			clientWindowBitsOffered = true
+		default:
+			return CompressionParams{}, "", false
 		}
 	}
+	if clientWindowBitsOffered && isValidWindowBits(u.ClientMaxWindowBits) && u.ClientMaxWindowBits < cp.ClientMaxWindowBits {
+		cp.ClientMaxWindowBits = u.ClientMaxWindowBits
+	}
 
-	return false
+	resp := "permessage-deflate"
+	if cp.ServerNoContextTakeover {
+		resp += "; server_no_context_takeover"
+	}
+	if cp.ClientNoContextTakeover {
+		resp += "; client_no_context_takeover"
+	}
+	if serverWindowBitsOffered {
+		resp += "; server_max_window_bits=" + strconv.Itoa(cp.ServerMaxWindowBits)
+	}
+	if clientWindowBitsOffered && cp.ClientMaxWindowBits < defaultWindowBits {
+		resp += "; client_max_window_bits=" + strconv.Itoa(cp.ClientMaxWindowBits)
+	}
+	return cp, resp, true
 }
 
 // Upgrade upgrades the HTTP server connection to the WebSocket protocol.
@@ -146,6 +322,22 @@ func (u *HertzUpgrader) isCompressionEnable(ctx *app.RequestContext) bool {
 // If the upgrade fails, then Upgrade replies to the client with an HTTP error
 // response.
 func (u *HertzUpgrader) Upgrade(ctx *app.RequestContext, handler HertzHandler) error {
+	return u.UpgradeContext(context.Background(), ctx, func(_ context.Context, c *Conn) {
+		handler(c)
+	})
+}
+
+// UpgradeContext is like Upgrade but passes c, usually the context received
+// by the Hertz handler, on to the websocket handler. Values stored in c by
+// Hertz middleware remain available for the lifetime of the connection. Use
+// Conn.RequestContext to access the path parameters, query arguments, headers
+// and keys of the upgraded request.
+func (u *HertzUpgrader) UpgradeContext(c context.Context, ctx *app.RequestContext, handler HertzContextHandler) error {
+	var deadline time.Time
+	if u.HandshakeTimeout > 0 {
+		deadline = time.Now().Add(u.HandshakeTimeout)
+	}
+
 	if !ctx.IsGet() {
 		return u.returnError(ctx, consts.StatusMethodNotAllowed, fmt.Sprintf("%s request method is not GET", badHandshake))
 	}
@@ -162,10 +354,6 @@ func (u *HertzUpgrader) Upgrade(ctx *app.RequestContext, handler HertzHandler) e
 		return u.returnError(ctx, consts.StatusBadRequest, "websocket: unsupported version: 13 not found in 'Sec-Websocket-Version' header")
 	}
 
-	if len(ctx.Response.Header.Peek("Sec-Websocket-Extensions")) > 0 {
-		return u.returnError(ctx, consts.StatusInternalServerError, "websocket: application specific 'Sec-WebSocket-Extensions' headers are unsupported")
-	}
-
 	checkOrigin := u.CheckOrigin
 	if checkOrigin == nil {
 		checkOrigin = fastHTTPCheckSameOrigin
@@ -179,41 +367,114 @@ func (u *HertzUpgrader) Upgrade(ctx *app.RequestContext, handler HertzHandler) e
 		return u.returnError(ctx, consts.StatusBadRequest, "websocket: not a websocket handshake: `Sec-WebSocket-Key' header is missing or blank")
 	}
 
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return u.returnTimeoutError(ctx)
+		}
+		// Bound the time spent writing the handshake response.
+		if netConn := ctx.GetConn(); netConn != nil {
+			netConn.SetWriteTimeout(d)
+		}
+	}
+
 	subprotocol := u.selectSubprotocol(ctx)
-	compress := u.isCompressionEnable(ctx)
+	var negotiated []NegotiatedExtension
+	if len(ctx.Response.Header.Peek("Sec-Websocket-Extensions")) == 0 {
+		var extensions string
+		extensions, negotiated = negotiateExtensions(ctx.Request.Header.Peek("Sec-WebSocket-Extensions"), u.extensions())
+		if extensions != "" {
+			ctx.Response.Header.Set("Sec-WebSocket-Extensions", extensions)
+		}
+	}
+	// The request context is reset when the hijack handler returns, take a
+	// snapshot for the lifetime of the websocket connection.
+	reqCtx := ctx.Copy()
 
 	ctx.SetStatusCode(consts.StatusSwitchingProtocols)
 	ctx.Response.Header.Set("Upgrade", "websocket")
 	ctx.Response.Header.Set("Connection", "Upgrade")
 	ctx.Response.Header.Set("Sec-WebSocket-Accept", computeAcceptKeyBytes(challengeKey))
-	if compress {
-		ctx.Response.Header.Set("Sec-WebSocket-Extensions", "permessage-deflate; server_no_context_takeover; client_no_context_takeover")
-	}
 	if subprotocol != nil {
 		ctx.Response.Header.SetBytesV("Sec-WebSocket-Protocol", subprotocol)
 	}
 
+	// The handshake completes when the connection is hijacked, after
+	// Upgrade returns. Hertz does not hijack the connection if writing the
+	// response fails, so the timeout is reported by a timer. state is set
+	// by the first of the timer and the hijack handler.
+	var (
+		state int32
+		timer *time.Timer
+	)
+	if !deadline.IsZero() {
+		timer = time.AfterFunc(time.Until(deadline), func() {
+			if atomic.CompareAndSwapInt32(&state, 0, 1) && u.HandshakeTimeoutHandler != nil {
+				u.HandshakeTimeoutHandler(c, &HandshakeTimeoutError{Duration: u.HandshakeTimeout})
+			}
+		})
+	}
+
 	ctx.Hijack(func(netConn network.Conn) {
+		if timer != nil {
+			if !atomic.CompareAndSwapInt32(&state, 0, 1) {
+				netConn.Close()
+				return
+			}
+			timer.Stop()
+			netConn.SetWriteTimeout(0)
+		}
+
 		writeBuf := poolWriteBuffer.Get().([]byte)
-		c := newConn(netConn, true, u.ReadBufferSize, u.WriteBufferSize, u.WriteBufferPool, nil, writeBuf)
+		conn := newConn(netConn, true, u.ReadBufferSize, u.WriteBufferSize, u.WriteBufferPool, nil, writeBuf)
+		conn.reqCtx = reqCtx
 		if subprotocol != nil {
-			c.subprotocol = b2s(subprotocol)
+			conn.subprotocol = b2s(subprotocol)
 		}
 
-		if compress {
-			c.newCompressionWriter = compressNoContextTakeover
-			c.newDecompressionReader = decompressNoContextTakeover
+		if len(negotiated) > 0 {
+			conn.setExtensions(negotiated)
 		}
+		conn.codec = u.Codecs[conn.subprotocol]
+		conn.validateUTF8 = u.ValidateUTF8
+		conn.validateWriteUTF8 = u.ValidateWriteUTF8
+		conn.interceptors = u.Interceptors
+		conn.startKeepalive(u.Keepalive)
 
 		// Clear deadlines set by HTTP server.
 		netConn.SetDeadline(time.Time{})
+		if timer != nil {
+			d := time.Until(deadline)
+			if d <= 0 {
+				d = time.Nanosecond
+			}
+			conn.setHandshakeTimeout(u.HandshakeTimeout, d)
+		}
 
-		handler(c)
+		if u.Registry != nil {
+			u.Registry.Add(conn, nil)
+		}
+		hc, cancel := context.WithCancel(c)
+		// The cleanup is deferred so that it runs if the handler panics.
+		defer func() {
+			cancel()
+			if u.Registry != nil {
+				u.Registry.Remove(conn)
+			}
+
+			// Hertz may reuse the connection after the handler returns,
+			// stop writing to it from other goroutines.
+			conn.stopKeepalive()
+			if conn.writeQueue != nil {
+				conn.writeQueue.stop(ErrWriteQueueClosed)
+			}
 
-		writeBuf = writeBuf[0:0]
+			writeBuf = writeBuf[0:0]
 
-		// FIXME: argument should be pointer-like to avoid allocations (staticcheck)
-		poolWriteBuffer.Put(writeBuf) // nolint: staticcheck
+			// FIXME: argument should be pointer-like to avoid allocations (staticcheck)
+			poolWriteBuffer.Put(writeBuf) // nolint: staticcheck
+		}()
+		handler(hc, conn)
 	})
 
 	return nil
@@ -0,0 +1,300 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/client"
+	"github.com/cloudwego/hertz/pkg/app/server"
+	"github.com/cloudwego/hertz/pkg/network/standard"
+	"github.com/cloudwego/hertz/pkg/protocol"
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
+)
+
+var negotiateCompressionTests = []struct {
+	upgrader HertzUpgrader
+	offer    string
+	resp     string
+	params   CompressionParams
+	ok       bool
+}{
+	{
+		HertzUpgrader{},
+		"permessage-deflate",
+		"", CompressionParams{}, false,
+	},
+	{
+		HertzUpgrader{EnableCompression: true},
+		"permessage-deflate; server_no_context_takeover; client_no_context_takeover",
+		"permessage-deflate; server_no_context_takeover; client_no_context_takeover",
+		CompressionParams{true, true, 15, 15}, true,
+	},
+	{
+		HertzUpgrader{EnableCompression: true, ServerContextTakeover: true, ClientContextTakeover: true},
+		"permessage-deflate; client_max_window_bits",
+		"permessage-deflate",
+		CompressionParams{false, false, 15, 15}, true,
+	},
+	{
+		HertzUpgrader{EnableCompression: true, ServerContextTakeover: true, ClientContextTakeover: true, ClientMaxWindowBits: 10},
+		"permessage-deflate; client_max_window_bits",
+		"permessage-deflate; client_max_window_bits=10",
+		CompressionParams{false, false, 15, 10}, true,
+	},
+	{
+		HertzUpgrader{EnableCompression: true, ServerContextTakeover: true, ClientContextTakeover: true, ClientMaxWindowBits: 10},
+		"permessage-deflate",
+		"permessage-deflate",
+		CompressionParams{false, false, 15, 15}, true,
+	},
+	{
+		HertzUpgrader{EnableCompression: true, ServerContextTakeover: true},
+		"permessage-deflate; server_no_context_takeover",
+		"permessage-deflate; server_no_context_takeover; client_no_context_takeover",
+		CompressionParams{true, true, 15, 15}, true,
+	},
+	{
+		HertzUpgrader{EnableCompression: true},
+		"permessage-deflate; server_max_window_bits=10, permessage-deflate; server_max_window_bits=15",
+		"permessage-deflate; server_no_context_takeover; client_no_context_takeover; server_max_window_bits=15",
+		CompressionParams{true, true, 15, 15}, true,
+	},
+	{
+		HertzUpgrader{EnableCompression: true},
+		"permessage-deflate; server_max_window_bits=10",
+		"", CompressionParams{}, false,
+	},
+	{
+		HertzUpgrader{EnableCompression: true},
+		"permessage-deflate; unknown_param, x-webkit-deflate-frame",
+		"", CompressionParams{}, false,
+	},
+	{
+		HertzUpgrader{EnableCompression: true},
+		"permessage-deflate; client_no_context_takeover; client_no_context_takeover",
+		"", CompressionParams{}, false,
+	},
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	for _, tt := range negotiateCompressionTests {
+		ctx := app.NewContext(0)
+		ctx.Request.Header.Set("Sec-WebSocket-Extensions", tt.offer)
+		resp, extensions := negotiateExtensions(ctx.Request.Header.Peek("Sec-WebSocket-Extensions"), tt.upgrader.extensions())
+		var params CompressionParams
+		ok := len(extensions) == 1
+		if ok {
+			params = extensions[0].(*perMessageDeflate).params
+		}
+		if ok != tt.ok || resp != tt.resp || params != tt.params {
+			t.Errorf("negotiateExtensions(%q) = %+v, %q, %v, want %+v, %q, %v",
+				tt.offer, params, resp, ok, tt.params, tt.resp, tt.ok)
+		}
+	}
+}
+
+func newUpgradeRequestContext() *app.RequestContext {
+	ctx := app.NewContext(0)
+	ctx.Request.SetMethod(consts.MethodGet)
+	ctx.Request.Header.Set("Connection", "Upgrade")
+	ctx.Request.Header.Set("Upgrade", "websocket")
+	ctx.Request.Header.Set("Sec-WebSocket-Version", "13")
+	ctx.Request.Header.Set("Sec-WebSocket-Key", generateChallengeKey())
+	return ctx
+}
+
+func TestUpgradeHandshakeTimeout(t *testing.T) {
+	u := HertzUpgrader{
+		HandshakeTimeout: 10 * time.Millisecond,
+		CheckOrigin: func(ctx *app.RequestContext) bool {
+			time.Sleep(20 * time.Millisecond)
+			return true
+		},
+	}
+	ctx := newUpgradeRequestContext()
+	err := u.Upgrade(ctx, func(*Conn) {})
+	var te *HandshakeTimeoutError
+	if !errors.As(err, &te) || te.Duration != u.HandshakeTimeout {
+		t.Fatalf("Upgrade() returned %v, want *HandshakeTimeoutError", err)
+	}
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Upgrade() returned %v, want timeout net.Error", err)
+	}
+	if code := ctx.Response.StatusCode(); code != consts.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", code, consts.StatusServiceUnavailable)
+	}
+	if ctx.Hijacked() {
+		t.Fatal("connection hijacked after handshake timeout")
+	}
+}
+
+func TestUpgradeHandshakeTimeoutStalledPeer(t *testing.T) {
+	addr := freeAddr()
+	timedOut := make(chan error, 1)
+	called := make(chan struct{}, 1)
+	upgrader := HertzUpgrader{
+		HandshakeTimeout: 100 * time.Millisecond,
+		HandshakeTimeoutHandler: func(_ context.Context, err error) {
+			timedOut <- err
+		},
+	}
+	h := server.Default(server.WithHostPorts(addr))
+	h.NoHijackConnPool = true
+	h.GET(testpath, func(_ context.Context, ctx *app.RequestContext) {
+		// The response is too large to fit in the socket buffers, so
+		// writing it stalls while the client does not read.
+		ctx.Response.Header.Set("X-Padding", strings.Repeat("x", 16<<20))
+		if err := upgrader.Upgrade(ctx, func(*Conn) { called <- struct{}{} }); err != nil {
+			t.Errorf("Upgrade() returned %v", err)
+		}
+	})
+	go h.Run()
+	time.Sleep(50 * time.Millisecond) // await server running
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: %s\r\n\r\n", testpath, addr, generateChallengeKey())
+
+	select {
+	case err := <-timedOut:
+		var te *HandshakeTimeoutError
+		if !errors.As(err, &te) || te.Duration != upgrader.HandshakeTimeout {
+			t.Errorf("HandshakeTimeoutHandler called with %v, want *HandshakeTimeoutError", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("HandshakeTimeoutHandler not called")
+	}
+	// Reading now drains the response, which lets a late hijack proceed.
+	go io.Copy(io.Discard, conn)
+	select {
+	case <-called:
+		t.Error("handler called after the handshake timed out")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestUpgradeHandshakeTimeoutFirstFrame(t *testing.T) {
+	addr := freeAddr()
+	upgrader := HertzUpgrader{HandshakeTimeout: 100 * time.Millisecond}
+	results := make(chan error, 10)
+	h := server.Default(server.WithHostPorts(addr))
+	h.NoHijackConnPool = true
+	h.GET(testpath, func(_ context.Context, ctx *app.RequestContext) {
+		upgrader.Upgrade(ctx, func(conn *Conn) {
+			for {
+				_, _, err := conn.ReadMessage()
+				results <- err
+				if err != nil {
+					return
+				}
+			}
+		})
+	})
+	go h.Run()
+	time.Sleep(50 * time.Millisecond) // await server running
+
+	// The timeout no longer applies once the first frame is read.
+	conn, err := dialTestServer(addr, &ClientUpgrader{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.WriteMessage(TextMessage, []byte("first"))
+	time.Sleep(2 * upgrader.HandshakeTimeout)
+	conn.WriteMessage(TextMessage, []byte("second"))
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Fatalf("read %d returned %v", i, err)
+		}
+	}
+	conn.Close()
+	<-results
+
+	// A client that sends nothing times out.
+	conn, err = dialTestServer(addr, &ClientUpgrader{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case err := <-results:
+		var te *HandshakeTimeoutError
+		if !errors.As(err, &te) || te.Duration != upgrader.HandshakeTimeout {
+			t.Errorf("ReadMessage() returned %v, want *HandshakeTimeoutError", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ReadMessage() did not time out")
+	}
+}
+
+type testContextKey struct{}
+
+func TestUpgradeContext(t *testing.T) {
+	addr := freeAddr()
+	upgrader := HertzUpgrader{}
+	h := server.Default(server.WithHostPorts(addr))
+	h.NoHijackConnPool = true
+	h.Use(func(c context.Context, ctx *app.RequestContext) {
+		ctx.Set("user", "alice")
+		ctx.Next(context.WithValue(c, testContextKey{}, "trace-1"))
+	})
+	done := make(chan struct{})
+	h.GET("/rooms/:room", func(c context.Context, ctx *app.RequestContext) {
+		err := upgrader.UpgradeContext(c, ctx, func(c context.Context, conn *Conn) {
+			defer close(done)
+			rc := conn.RequestContext()
+			msg := fmt.Sprintf("%s %s %s %s %v",
+				rc.Param("room"), rc.Query("q"), rc.GetString("user"),
+				rc.Request.Header.Get("X-Test"), c.Value(testContextKey{}))
+			conn.WriteMessage(TextMessage, []byte(msg))
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	go h.Spin()
+	time.Sleep(50 * time.Millisecond) // await server running
+
+	c, err := client.NewClient(client.WithDialer(standard.NewDialer()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, resp := protocol.AcquireRequest(), protocol.AcquireResponse()
+	req.SetRequestURI("http://" + addr + "/rooms/lobby?q=hello")
+	req.SetMethod("GET")
+	req.Header.Set("X-Test", "header")
+	conn, err := (&ClientUpgrader{}).Handshake(context.Background(), c, req, resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.RequestContext() != nil {
+		t.Error("client connection has a request context")
+	}
+
+	_, p, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "lobby hello alice header trace-1"; string(p) != want {
+		t.Fatalf("got %q, want %q", p, want)
+	}
+	<-done
+}
@@ -0,0 +1,79 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package websocket
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type shutdownState struct {
+	data []byte // close message
+	done chan struct{}
+	once sync.Once
+}
+
+func (s *shutdownState) closeConn(c *Conn) {
+	c.WriteControl(CloseMessage, s.data, time.Now().Add(writeWait))
+}
+
+func (s *shutdownState) drained() {
+	s.once.Do(func() { close(s.done) })
+}
+
+// Shutdown gracefully closes the connections in the registry. Shutdown sends
+// a close message with the given code, usually CloseGoingAway or
+// CloseServiceRestart, to every connection and waits until the handlers of
+// the connections return or ctx is done. Handlers see the close message as a
+// *CloseError from the read methods once the peer completes the closing
+// handshake. When ctx is done, Shutdown closes the remaining connections and
+// returns the context error.
+//
+// Connections added to the registry after Shutdown is called receive the
+// close message as well. Calling Shutdown again waits for the same
+// connections; the code and text of the first call are used.
+func (r *Registry) Shutdown(ctx context.Context, code int, text string) error {
+	r.mu.Lock()
+	if r.shutdown == nil {
+		r.shutdown = &shutdownState{data: FormatCloseMessage(code, text), done: make(chan struct{})}
+		if len(r.conns) == 0 {
+			r.shutdown.drained()
+		}
+		for _, c := range r.conns {
+			go r.shutdown.closeConn(c)
+		}
+	}
+	s := r.shutdown
+	r.mu.Unlock()
+
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		r.Range(func(c *Conn) bool {
+			c.Close()
+			return true
+		})
+		return ctx.Err()
+	}
+}
+
+// ShutdownHook returns a function that calls Shutdown with the given code and
+// text. Append it to the OnShutdown hooks of a Hertz server to drain the
+// connections upgraded with HertzUpgrader.Registry set to r:
+//
+//	h.OnShutdown = append(h.OnShutdown, registry.ShutdownHook(websocket.CloseGoingAway, ""))
+//
+// Hertz runs the hooks with a context that expires after the exit wait
+// timeout of the server (server.WithExitWaitTime).
+func (r *Registry) ShutdownHook(code int, text string) func(ctx context.Context) {
+	return func(ctx context.Context) {
+		r.Shutdown(ctx, code, text)
+	}
+}
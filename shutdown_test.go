@@ -0,0 +1,131 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package websocket
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/server"
+)
+
+// serveRegistered adds c to r and reads from c until an error, as the
+// handler of an upgraded connection does.
+func serveRegistered(r *Registry, c *Conn) {
+	r.Add(c, nil)
+	go func() {
+		defer r.Remove(c)
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func TestRegistryShutdown(t *testing.T) {
+	r := NewRegistry()
+	s, c := newPipeConns()
+	defer s.Close()
+	serveRegistered(r, s)
+
+	// The client completes the closing handshake.
+	result := make(chan error, 1)
+	go func() {
+		_, _, err := c.ReadMessage()
+		result <- err
+		c.Close()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := r.Shutdown(ctx, CloseServiceRestart, "restart"); err != nil {
+		t.Errorf("Shutdown() returned %v", err)
+	}
+	var ce *CloseError
+	if err := <-result; !errors.As(err, &ce) || ce.Code != CloseServiceRestart || ce.Text != "restart" {
+		t.Errorf("client read returned %v, want close %d", err, CloseServiceRestart)
+	}
+	if r.Len() != 0 {
+		t.Errorf("Len() = %d after Shutdown", r.Len())
+	}
+	if err := r.Shutdown(ctx, CloseGoingAway, ""); err != nil {
+		t.Errorf("second Shutdown() returned %v", err)
+	}
+}
+
+func TestRegistryShutdownTimeout(t *testing.T) {
+	r := NewRegistry()
+	s, c := newPipeConns()
+	defer c.Close()
+	serveRegistered(r, s)
+
+	// The client never reads, so the close message is not delivered and the
+	// connection is closed when the context expires.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := r.Shutdown(ctx, CloseGoingAway, ""); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown() returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	for i := 0; r.Len() != 0; i++ {
+		if i == 100 {
+			t.Fatal("handler still running after Shutdown closed the connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHertzShutdownHook(t *testing.T) {
+	addr := freeAddr()
+	r := NewRegistry()
+	upgrader := HertzUpgrader{Registry: r}
+	h := server.Default(server.WithHostPorts(addr), server.WithExitWaitTime(time.Second))
+	h.NoHijackConnPool = true
+	h.OnShutdown = append(h.OnShutdown, r.ShutdownHook(CloseGoingAway, "bye"))
+	h.GET(testpath, func(_ context.Context, ctx *app.RequestContext) {
+		upgrader.Upgrade(ctx, func(conn *Conn) {
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		})
+	})
+	go h.Run()
+	time.Sleep(50 * time.Millisecond) // await server running
+
+	conn, err := dialTestServer(addr, &ClientUpgrader{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; r.Len() != 1; i++ {
+		if i == 100 {
+			t.Fatal("connection not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		_, _, err := conn.ReadMessage()
+		result <- err
+	}()
+	if err := h.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var ce *CloseError
+	if err := <-result; !errors.As(err, &ce) || ce.Code != CloseGoingAway || ce.Text != "bye" {
+		t.Errorf("client read returned %v, want close %d", err, CloseGoingAway)
+	}
+	if r.Len() != 0 {
+		t.Errorf("Len() = %d after the server shut down", r.Len())
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package websocket
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnStats is a snapshot of the statistics of a connection.
+type ConnStats struct {
+	// BytesRead and BytesWritten count the bytes of the frames received and
+	// sent, including the frame headers. A received frame is counted when
+	// its header is read.
+	BytesRead, BytesWritten int64
+
+	// MessagesRead and MessagesWritten count the data messages.
+	MessagesRead, MessagesWritten int64
+
+	// FramesRead and FramesWritten count all frames, including control
+	// frames and the continuation frames of fragmented messages.
+	FramesRead, FramesWritten int64
+
+	// ControlFramesRead and ControlFramesWritten count the close, ping and
+	// pong frames.
+	ControlFramesRead, ControlFramesWritten int64
+
+	// UncompressedBytesWritten and CompressedBytesWritten count the payload
+	// of the messages compressed with permessage-deflate before and after
+	// compression.
+	UncompressedBytesWritten, CompressedBytesWritten int64
+
+	// WriteStalls counts the frame writes that waited for a write by another
+	// goroutine, such as a control message written while a message is being
+	// written. WriteStallTime is the total time spent waiting.
+	WriteStalls    int64
+	WriteStallTime time.Duration
+
+	// RTT is the round-trip time measured by the last answered ping sent by
+	// Ping or by keepalive, or zero if no ping has been answered.
+	RTT time.Duration
+}
+
+// CompressionRatio returns the ratio of the uncompressed to the compressed
+// size of the messages written with compression, or zero if no message was
+// compressed.
+func (s ConnStats) CompressionRatio() float64 {
+	if s.CompressedBytesWritten == 0 {
+		return 0
+	}
+	return float64(s.UncompressedBytesWritten) / float64(s.CompressedBytesWritten)
+}
+
+// connStats holds the counters of a connection. The counters are updated
+// with atomic operations so that Stats may be called from any goroutine.
+type connStats struct {
+	bytesRead, bytesWritten                 int64
+	messagesRead, messagesWritten           int64
+	framesRead, framesWritten               int64
+	controlFramesRead, controlFramesWritten int64
+	uncompressedWritten, compressedWritten  int64
+	writeStalls, writeStallTime             int64
+	rtt                                     int64 // time.Duration
+}
+
+// Stats returns a snapshot of the statistics of the connection. It is safe to
+// call Stats concurrently with the other methods.
+func (c *Conn) Stats() ConnStats {
+	s := &c.stats
+	return ConnStats{
+		BytesRead:                atomic.LoadInt64(&s.bytesRead),
+		BytesWritten:             atomic.LoadInt64(&s.bytesWritten),
+		MessagesRead:             atomic.LoadInt64(&s.messagesRead),
+		MessagesWritten:          atomic.LoadInt64(&s.messagesWritten),
+		FramesRead:               atomic.LoadInt64(&s.framesRead),
+		FramesWritten:            atomic.LoadInt64(&s.framesWritten),
+		ControlFramesRead:        atomic.LoadInt64(&s.controlFramesRead),
+		ControlFramesWritten:     atomic.LoadInt64(&s.controlFramesWritten),
+		UncompressedBytesWritten: atomic.LoadInt64(&s.uncompressedWritten),
+		CompressedBytesWritten:   atomic.LoadInt64(&s.compressedWritten),
+		WriteStalls:              atomic.LoadInt64(&s.writeStalls),
+		WriteStallTime:           time.Duration(atomic.LoadInt64(&s.writeStallTime)),
+		RTT:                      time.Duration(atomic.LoadInt64(&s.rtt)),
+	}
+}
+
+// frameWritten counts a frame of n bytes written to the network.
+func (s *connStats) frameWritten(frameType int, n int) {
+	atomic.AddInt64(&s.framesWritten, 1)
+	atomic.AddInt64(&s.bytesWritten, int64(n))
+	if isControl(frameType) {
+		atomic.AddInt64(&s.controlFramesWritten, 1)
+	}
+}
+
+// frameRead counts a received frame. The frame length is the header size
+// plus the payload length.
+func (s *connStats) frameRead(frameType int, n int64) {
+	atomic.AddInt64(&s.framesRead, 1)
+	atomic.AddInt64(&s.bytesRead, n)
+	switch {
+	case isControl(frameType):
+		atomic.AddInt64(&s.controlFramesRead, 1)
+	case isData(frameType):
+		atomic.AddInt64(&s.messagesRead, 1)
+	}
+}
+
+// lockWrite acquires the write lock of c, counting a stall if another
+// goroutine holds it.
+func (c *Conn) lockWrite() {
+	select {
+	case <-c.mu:
+	default:
+		start := time.Now()
+		<-c.mu
+		c.stats.stalled(time.Since(start))
+	}
+}
+
+func (s *connStats) stalled(d time.Duration) {
+	atomic.AddInt64(&s.writeStalls, 1)
+	atomic.AddInt64(&s.writeStallTime, int64(d))
+}
+
+// frameHeaderSize returns the size of a frame header given its second byte.
+func frameHeaderSize(b1 byte) int {
+	n := 2
+	switch b1 & 0x7f {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	if b1&maskBit != 0 {
+		n += 4
+	}
+	return n
+}
+
+// uncompressedCounter counts the bytes written to a compressor.
+type uncompressedCounter struct {
+	w io.WriteCloser
+	s *connStats
+}
+
+func (w uncompressedCounter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	atomic.AddInt64(&w.s.uncompressedWritten, int64(n))
+	return n, err
+}
+
+func (w uncompressedCounter) Close() error {
+	return w.w.Close()
+}
+
+// pingPrefix starts the payload of the pings sent by Ping. Keepalive pings
+// contain digits only.
+const pingPrefix = "ping-"
+
+// pingIDs generates the payloads of the pings sent by Ping.
+var pingIDs uint64
+
+// pings tracks the unanswered pings sent by Ping.
+type pings struct {
+	mu      sync.Mutex
+	waiting map[string]chan time.Time
+}
+
+// Ping sends a ping with a unique payload to the peer and returns the
+// round-trip time when the matching pong arrives. The measured time is also
+// reported by Stats.
+//
+// Pongs are processed by the read methods, so another goroutine must read
+// the connection while Ping waits. If ctx has no deadline, the ping is
+// written with a deadline of one second. Ping returns the context error if
+// ctx is done before the pong arrives and the read error if the connection
+// fails.
+//
+// Ping may be called concurrently with the other methods.
+func (c *Conn) Ping(ctx context.Context) (time.Duration, error) {
+	payload := pingPrefix + strconv.FormatUint(atomic.AddUint64(&pingIDs, 1), 10)
+	ch := make(chan time.Time, 1)
+	c.pings.mu.Lock()
+	if c.pings.waiting == nil {
+		c.pings.waiting = make(map[string]chan time.Time)
+	}
+	c.pings.waiting[payload] = ch
+	c.pings.mu.Unlock()
+	defer func() {
+		c.pings.mu.Lock()
+		delete(c.pings.waiting, payload)
+		c.pings.mu.Unlock()
+	}()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(writeWait)
+	}
+	start := time.Now()
+	if err := c.WriteControl(PingMessage, []byte(payload), deadline); err != nil {
+		return 0, err
+	}
+	select {
+	case received := <-ch:
+		rtt := received.Sub(start)
+		atomic.StoreInt64(&c.stats.rtt, int64(rtt))
+		return rtt, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-c.readDone:
+		return 0, c.readErr
+	}
+}
+
+// pong processes a pong received from the peer.
+func (c *Conn) pong(payload string) {
+	if c.keepalive != nil {
+		c.keepalive.pong(payload)
+	}
+	if !strings.HasPrefix(payload, pingPrefix) {
+		return
+	}
+	c.pings.mu.Lock()
+	ch := c.pings.waiting[payload]
+	c.pings.mu.Unlock()
+	if ch != nil {
+		select {
+		case ch <- time.Now():
+		default:
+		}
+	}
+}
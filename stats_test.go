@@ -0,0 +1,206 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	server, client := newPipeConns()
+	defer server.Close()
+	defer client.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		// A 200 byte message has a 4 byte extended length and a 4 byte mask.
+		if err := client.WriteMessage(TextMessage, []byte("hello")); err != nil {
+			done <- err
+			return
+		}
+		if err := client.WriteMessage(BinaryMessage, make([]byte, 200)); err != nil {
+			done <- err
+			return
+		}
+		done <- client.WriteControl(PingMessage, []byte("p"), time.Now().Add(time.Second))
+	}()
+	for i := 0; i < 2; i++ {
+		if _, _, err := server.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pinged := make(chan struct{})
+	server.SetPingHandler(func(string) error {
+		close(pinged)
+		return nil
+	})
+	go server.ReadMessage()
+	<-pinged
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	want := ConnStats{
+		BytesWritten:         (2 + 4 + 5) + (4 + 4 + 200) + (2 + 4 + 1),
+		MessagesWritten:      2,
+		FramesWritten:        3,
+		ControlFramesWritten: 1,
+	}
+	if got := client.Stats(); got.BytesWritten != want.BytesWritten || got.MessagesWritten != want.MessagesWritten ||
+		got.FramesWritten != want.FramesWritten || got.ControlFramesWritten != want.ControlFramesWritten {
+		t.Errorf("client Stats() = %+v, want %+v", got, want)
+	}
+	if got := server.Stats(); got.BytesRead != want.BytesWritten || got.MessagesRead != 2 ||
+		got.FramesRead != 3 || got.ControlFramesRead != 1 {
+		t.Errorf("server Stats() = %+v", got)
+	}
+}
+
+func TestStatsCompression(t *testing.T) {
+	p1, p2 := net.Pipe()
+	params := &CompressionParams{true, true, 15, 15}
+	server := NewConn(p1, ConnConfig{IsServer: true, Compression: params})
+	client := NewConn(p2, ConnConfig{Compression: params})
+	defer server.Close()
+	defer client.Close()
+
+	data := bytes.Repeat([]byte("compressible "), 100)
+	pm, err := NewPreparedMessage(TextMessage, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		server.WriteMessage(TextMessage, data)
+		server.WritePreparedMessage(pm)
+		close(done)
+	}()
+	for i := 0; i < 2; i++ {
+		if _, p, err := client.ReadMessage(); err != nil || !bytes.Equal(p, data) {
+			t.Fatalf("ReadMessage() = %d bytes, %v", len(p), err)
+		}
+	}
+	<-done
+
+	s := server.Stats()
+	if s.MessagesWritten != 2 || s.UncompressedBytesWritten != int64(2*len(data)) {
+		t.Errorf("Stats() = %+v", s)
+	}
+	if s.CompressionRatio() < 10 {
+		t.Errorf("CompressionRatio() = %v", s.CompressionRatio())
+	}
+	if r := client.Stats().CompressionRatio(); r != 0 {
+		t.Errorf("CompressionRatio() of the reader = %v, want 0", r)
+	}
+}
+
+func TestStatsWriteStall(t *testing.T) {
+	var buf bytes.Buffer
+	c := newTestConn(nil, &buf, true)
+
+	// Hold the write lock as a concurrent writer does.
+	<-c.mu
+	done := make(chan error, 1)
+	go func() { done <- c.WriteMessage(TextMessage, []byte("hello")) }()
+	time.Sleep(20 * time.Millisecond)
+	c.mu <- struct{}{}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if s := c.Stats(); s.WriteStalls != 1 || s.WriteStallTime < 10*time.Millisecond {
+		t.Errorf("Stats() = %d stalls in %v, want 1 stall", s.WriteStalls, s.WriteStallTime)
+	}
+
+	if err := c.WriteControl(PingMessage, nil, time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if s := c.Stats(); s.WriteStalls != 1 {
+		t.Errorf("Stats() = %d stalls after an uncontended write, want 1", s.WriteStalls)
+	}
+}
+
+func TestPing(t *testing.T) {
+	server, client := newPipeConns()
+	defer server.Close()
+	defer client.Close()
+
+	// Both ends read: the client to answer the ping, the server to process
+	// the pong.
+	go client.ReadMessage()
+	go server.ReadMessage()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		rtt, err := server.Ping(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rtt <= 0 || server.Stats().RTT != rtt {
+			t.Errorf("Ping() = %v, Stats().RTT = %v", rtt, server.Stats().RTT)
+		}
+	}
+
+	client.Close()
+	if _, err := server.Ping(ctx); err == nil {
+		t.Error("Ping() succeeded after the peer closed the connection")
+	}
+}
+
+func TestPingTimeout(t *testing.T) {
+	server, client := newPipeConns()
+	defer server.Close()
+	defer client.Close()
+
+	// The client reads the ping but the server does not process the pong.
+	go client.ReadMessage()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := server.Ping(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Ping() returned %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestPingNextFrame(t *testing.T) {
+	server, client := newPipeConns()
+	defer server.Close()
+	defer client.Close()
+
+	go client.ReadMessage()
+	frames := make(chan Frame, 10)
+	go func() {
+		for {
+			f, err := server.NextFrame()
+			if err != nil {
+				close(frames)
+				return
+			}
+			frames <- f
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	rtt, err := server.Ping(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := <-frames
+	if f.Opcode != PongMessage {
+		t.Errorf("NextFrame() returned opcode %d, want %d", f.Opcode, PongMessage)
+	}
+	// The pong of the client has a 4 byte mask.
+	s := server.Stats()
+	if s.RTT != rtt || s.FramesRead != 1 || s.ControlFramesRead != 1 || s.BytesRead != int64(2+4+len(f.Payload)) {
+		t.Errorf("Stats() = %+v", s)
+	}
+}
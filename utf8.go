@@ -0,0 +1,131 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package websocket
+
+import (
+	"errors"
+	"io"
+	"time"
+	"unicode/utf8"
+)
+
+// ErrInvalidUTF8 is returned when a text message is not valid UTF-8 and
+// validation is enabled for the connection.
+var ErrInvalidUTF8 = errors.New("websocket: invalid UTF-8 in text message")
+
+// utf8Validator validates UTF-8 text that arrives in pieces. A rune split
+// across pieces is held until it is complete.
+type utf8Validator struct {
+	buf [utf8.UTFMax]byte
+	n   int // length of the incomplete rune in buf
+}
+
+// write reports whether p is a valid continuation of the text seen so far.
+// Invalid text is detected at the first byte that cannot be part of a valid
+// encoding.
+func (v *utf8Validator) write(p []byte) bool {
+	// Complete the rune left over from the previous piece.
+	for v.n > 0 && len(p) > 0 {
+		v.buf[v.n] = p[0]
+		v.n++
+		p = p[1:]
+		if utf8.FullRune(v.buf[:v.n]) {
+			if r, size := utf8.DecodeRune(v.buf[:v.n]); r == utf8.RuneError && size == 1 {
+				return false
+			}
+			v.n = 0
+		}
+	}
+
+	// Hold an incomplete rune at the end of p. FullRune reports invalid
+	// prefixes as full runes, so what is held can still become valid.
+	for i := len(p) - 1; i >= 0 && i > len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if !utf8.FullRune(p[i:]) {
+				v.n = copy(v.buf[:], p[i:])
+				p = p[:i]
+			}
+			break
+		}
+	}
+	return utf8.Valid(p)
+}
+
+// complete reports whether the text seen so far does not end in the middle
+// of a rune.
+func (v *utf8Validator) complete() bool {
+	return v.n == 0
+}
+
+// utf8Reader validates the text message read from r. On invalid text, the
+// connection is failed with CloseInvalidFramePayloadData.
+type utf8Reader struct {
+	c *Conn
+	r io.ReadCloser
+	v utf8Validator
+}
+
+func (r *utf8Reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if !r.v.write(p[:n]) || (err == io.EOF && !r.v.complete()) {
+		c := r.c
+		c.setReadErr(ErrInvalidUTF8)
+		c.WriteControl(CloseMessage, FormatCloseMessage(CloseInvalidFramePayloadData, "invalid UTF-8"), time.Now().Add(writeWait))
+		return 0, ErrInvalidUTF8
+	}
+	return n, err
+}
+
+func (r *utf8Reader) Close() error {
+	return r.r.Close()
+}
+
+// utf8Writer validates the text message written to w before passing it on.
+type utf8Writer struct {
+	mw  *messageWriter
+	w   io.WriteCloser
+	v   utf8Validator
+	err error
+}
+
+func (w *utf8Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if !w.v.write(p) {
+		return 0, w.fail()
+	}
+	return w.w.Write(p)
+}
+
+func (w *utf8Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if !w.v.complete() {
+		return w.fail()
+	}
+	return w.w.Close()
+}
+
+// fail abandons the message. If part of the message was already sent to the
+// peer or may have changed the state of an extension, the connection cannot
+// recover and later writes fail too.
+func (w *utf8Writer) fail() error {
+	w.err = ErrInvalidUTF8
+	mw := w.mw
+	if mw.err != nil {
+		return w.err
+	}
+	c := mw.c
+	stateful := !c.onlyDeflate() || (c.deflate != nil && c.deflate.writeCtx != nil)
+	if mw.frameType == continuationFrame || (w.w != mw && stateful) {
+		c.writeFatal(ErrInvalidUTF8)
+	}
+	return mw.endMessage(ErrInvalidUTF8)
+}
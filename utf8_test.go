@@ -0,0 +1,170 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package websocket
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"unicode/utf8"
+)
+
+var utf8Tests = []string{
+	"",
+	"hello",
+	"héllo wörld",
+	"€uro",
+	"\U0001F600 smile",
+	"\xef\xbf\xbd",     // U+FFFD
+	"\xff",             // invalid byte
+	"a\x80b",           // unexpected continuation byte
+	"\xe2\x82",         // truncated rune
+	"\xe2\x82a",        // truncated rune
+	"\xed\xa0\x80",     // surrogate
+	"\xc0\xaf",         // overlong encoding
+	"\xf4\x90\x80\x80", // above U+10FFFF
+	"\xf0\x9f\x98",     // truncated 4-byte rune
+}
+
+func TestUTF8Validator(t *testing.T) {
+	for _, s := range utf8Tests {
+		want := utf8.ValidString(s)
+		for i := 0; i <= len(s); i++ {
+			var v utf8Validator
+			ok := v.write([]byte(s[:i])) && v.write([]byte(s[i:])) && v.complete()
+			if ok != want {
+				t.Errorf("%q split at %d: valid = %v, want %v", s, i, ok, want)
+			}
+		}
+		var v utf8Validator
+		ok := true
+		for i := 0; i < len(s) && ok; i++ {
+			ok = v.write([]byte{s[i]})
+		}
+		if ok = ok && v.complete(); ok != want {
+			t.Errorf("%q byte by byte: valid = %v, want %v", s, ok, want)
+		}
+	}
+
+	// Invalid text is detected without waiting for the rest of the rune.
+	var v utf8Validator
+	if v.write([]byte{0xed, 0xa0}) {
+		t.Error("surrogate prefix accepted")
+	}
+}
+
+func TestReadUTF8(t *testing.T) {
+	// The runes are split across frames and reads.
+	valid := strings.Repeat("€", 1000)
+	for _, compress := range []bool{false, true} {
+		for _, m := range []string{valid, valid[:len(valid)-1], valid[:2000] + "\xff" + valid} {
+			var connBuf, closeBuf bytes.Buffer
+			wc := newTestConn(nil, &connBuf, false)
+			rc := newTestConn(iotest.OneByteReader(&connBuf), &closeBuf, true)
+			if compress {
+				wc.setCompression(CompressionParams{})
+				rc.setCompression(CompressionParams{})
+			}
+			rc.validateUTF8 = true
+
+			wc.WriteMessage(BinaryMessage, []byte(m))
+			wc.WriteMessage(TextMessage, []byte(m))
+			if _, p, err := rc.ReadMessage(); err != nil || string(p) != m {
+				t.Fatalf("compress=%v: binary ReadMessage() returned %d bytes, %v", compress, len(p), err)
+			}
+
+			_, p, err := rc.ReadMessage()
+			if m == valid {
+				if err != nil || string(p) != m {
+					t.Errorf("compress=%v: ReadMessage() returned %d bytes, %v", compress, len(p), err)
+				}
+				continue
+			}
+			if err != ErrInvalidUTF8 {
+				t.Errorf("compress=%v, len=%d: ReadMessage() returned %v, want %v", compress, len(m), err, ErrInvalidUTF8)
+			}
+			if !bytes.Contains(closeBuf.Bytes(), FormatCloseMessage(CloseInvalidFramePayloadData, "invalid UTF-8")) {
+				t.Errorf("compress=%v, len=%d: close message %d not sent", compress, len(m), CloseInvalidFramePayloadData)
+			}
+			if _, _, err := rc.NextReader(); err != ErrInvalidUTF8 {
+				t.Errorf("compress=%v, len=%d: NextReader() returned %v, want %v", compress, len(m), err, ErrInvalidUTF8)
+			}
+		}
+	}
+}
+
+func TestWriteUTF8(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		var connBuf bytes.Buffer
+		wc := newTestConn(nil, &connBuf, true)
+		rc := newTestConn(&connBuf, nil, false)
+		if compress {
+			wc.setCompression(CompressionParams{})
+			rc.setCompression(CompressionParams{})
+		}
+		wc.validateWriteUTF8 = true
+
+		if err := wc.WriteMessage(TextMessage, []byte("\xff")); err != ErrInvalidUTF8 {
+			t.Errorf("compress=%v: WriteMessage() returned %v, want %v", compress, err, ErrInvalidUTF8)
+		}
+		pm, _ := NewPreparedMessage(TextMessage, []byte("\xff"))
+		if err := wc.WritePreparedMessage(pm); err != ErrInvalidUTF8 {
+			t.Errorf("compress=%v: WritePreparedMessage() returned %v, want %v", compress, err, ErrInvalidUTF8)
+		}
+		if err := wc.WriteMessage(BinaryMessage, []byte("\xff")); err != nil {
+			t.Errorf("compress=%v: binary WriteMessage() returned %v", compress, err)
+		}
+
+		// A rune split across writes is valid.
+		w, _ := wc.NextWriter(TextMessage)
+		w.Write([]byte("\xe2\x82"))
+		w.Write([]byte("\xac"))
+		if err := w.Close(); err != nil {
+			t.Errorf("compress=%v: Close() returned %v", compress, err)
+		}
+
+		// A message that was not sent can be abandoned, unless its text was
+		// added to the compression context.
+		w, _ = wc.NextWriter(TextMessage)
+		w.Write([]byte("\xe2\x82"))
+		if err := w.Close(); err != ErrInvalidUTF8 {
+			t.Errorf("compress=%v: Close() returned %v, want %v", compress, err, ErrInvalidUTF8)
+		}
+		want := []string{"\xff", "€", "ok"}
+		var wantErr error
+		if compress {
+			want, wantErr = want[:2], ErrInvalidUTF8
+		}
+		if err := wc.WriteMessage(TextMessage, []byte("ok")); err != wantErr {
+			t.Errorf("compress=%v: WriteMessage() after abandoned message returned %v, want %v", compress, err, wantErr)
+		}
+
+		for _, m := range want {
+			if _, p, err := rc.ReadMessage(); err != nil || string(p) != m {
+				t.Fatalf("compress=%v: ReadMessage() = %q, %v, want %q", compress, p, err, m)
+			}
+		}
+	}
+}
+
+func TestWriteUTF8AfterFlush(t *testing.T) {
+	var connBuf bytes.Buffer
+	wc := newTestConn(nil, &connBuf, true)
+	wc.validateWriteUTF8 = true
+
+	w, _ := wc.NextWriter(TextMessage)
+	w.Write(bytes.Repeat([]byte("a"), 4096))
+	if _, err := w.Write([]byte("\xff")); err != ErrInvalidUTF8 {
+		t.Fatalf("Write() returned %v, want %v", err, ErrInvalidUTF8)
+	}
+	// Part of the message was sent, so the connection cannot be written to.
+	if err := wc.WriteMessage(TextMessage, []byte("ok")); err != ErrInvalidUTF8 {
+		t.Errorf("WriteMessage() returned %v, want %v", err, ErrInvalidUTF8)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"encoding/base64"
 	"encoding/binary"
 	"math/rand"
+	"strings"
 	"unicode/utf8"
 	"unsafe"
 )
@@ -131,6 +132,85 @@ func nextToken(s string) (token, rest string) {
 	return s[:i], s[i:]
 }
 
+// nextTokenOrQuoted returns the leading token or quoted string per RFC 2616
+// and the string following the token or quoted string.
+func nextTokenOrQuoted(s string) (value, rest string) {
+	if !strings.HasPrefix(s, "\"") {
+		return nextToken(s)
+	}
+	s = s[1:]
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return s[:i], s[i+1:]
+		case '\\':
+			p := make([]byte, len(s)-1)
+			j := copy(p, s[:i])
+			escape := true
+			for i = i + 1; i < len(s); i++ {
+				b := s[i]
+				switch {
+				case escape:
+					escape = false
+					p[j] = b
+					j++
+				case b == '\\':
+					escape = true
+				case b == '"':
+					return string(p[:j]), s[i+1:]
+				default:
+					p[j] = b
+					j++
+				}
+			}
+			return "", ""
+		}
+	}
+	return "", ""
+}
+
+// parseExtension parses a single element of the Sec-WebSocket-Extensions
+// header as defined in RFC 6455, section 9.1:
+//
+//	extension = extension-token *( ";" extension-param )
+//	extension-param = token [ "=" (token | quoted-string) ]
+//
+// Parameters without a value map to the empty string. The ok result is false
+// if the element is malformed or contains a parameter more than once.
+func parseExtension(ext string) (name string, params map[string]string, ok bool) {
+	name, s := nextToken(skipSpace(ext))
+	if name == "" {
+		return "", nil, false
+	}
+	params = make(map[string]string)
+	for {
+		s = skipSpace(s)
+		if s == "" {
+			return name, params, true
+		}
+		if s[0] != ';' {
+			return "", nil, false
+		}
+		var k, v string
+		k, s = nextToken(skipSpace(s[1:]))
+		if k == "" {
+			return "", nil, false
+		}
+		s = skipSpace(s)
+		if strings.HasPrefix(s, "=") {
+			v, s = nextTokenOrQuoted(skipSpace(s[1:]))
+			if v == "" {
+				return "", nil, false
+			}
+		}
+		k = strings.ToLower(k)
+		if _, dup := params[k]; dup {
+			return "", nil, false
+		}
+		params[k] = v
+	}
+}
+
 // equalASCIIFold returns true if s is equal to t with ASCII case folding as
 // defined in RFC 4790.
 func equalASCIIFold(s, t string) bool {
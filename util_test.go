@@ -0,0 +1,38 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// This file may have been modified by CloudWeGo authors. All CloudWeGo
+// Modifications are Copyright 2022 CloudWeGo Authors.
+
+package websocket
+
+import (
+	"reflect"
+	"testing"
+)
+
+var parseExtensionTests = []struct {
+	value  string
+	name   string
+	params map[string]string
+	ok     bool
+}{
+	{"permessage-deflate", "permessage-deflate", map[string]string{}, true},
+	{" foo ;bar; baz=1 ", "foo", map[string]string{"bar": "", "baz": "1"}, true},
+	{`foo; bar="hello \"world\""`, "foo", map[string]string{"bar": `hello "world"`}, true},
+	{"foo; Bar=1", "foo", map[string]string{"bar": "1"}, true},
+	{"foo; bar; bar", "", nil, false},
+	{"foo; bar=", "", nil, false},
+	{"foo bar", "", nil, false},
+	{"; bar", "", nil, false},
+}
+
+func TestParseExtension(t *testing.T) {
+	for _, tt := range parseExtensionTests {
+		name, params, ok := parseExtension(tt.value)
+		if name != tt.name || ok != tt.ok || !reflect.DeepEqual(params, tt.params) {
+			t.Errorf("parseExtension(%q) = %q, %v, %v, want %q, %v, %v", tt.value, name, params, ok, tt.name, tt.params, tt.ok)
+		}
+	}
+}